@@ -4,6 +4,7 @@ import (
 	"net"
 	"sync/atomic"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 
 	"google.golang.org/grpc"
@@ -26,12 +27,39 @@ type Api struct {
 	}
 	cache    *cache.Cache
 	listener *net.TCPListener
+
+	prometheus struct {
+		cacheRequests        prometheus.Counter
+		cacheRequestMetrics  prometheus.Counter
+		cacheResponseMetrics prometheus.Counter
+		cacheResponsePoints  prometheus.Counter
+	}
 }
 
 func New(c *cache.Cache) *Api {
-	return &Api{
+	api := &Api{
 		cache: c,
 	}
+
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	}
+	api.prometheus.cacheRequests = counter("grpc_cache_requests_total", "Number of gRPC cache requests")
+	api.prometheus.cacheRequestMetrics = counter("grpc_cache_request_metrics_total", "Metrics requested by gRPC cache requests")
+	api.prometheus.cacheResponseMetrics = counter("grpc_cache_response_metrics_total", "Metrics found in cache by gRPC cache requests")
+	api.prometheus.cacheResponsePoints = counter("grpc_cache_response_points_total", "Points returned by gRPC cache requests")
+
+	return api
+}
+
+// InitPrometheus registers gRPC api metrics
+func (api *Api) InitPrometheus(reg prometheus.Registerer) {
+	reg.MustRegister(
+		api.prometheus.cacheRequests,
+		api.prometheus.cacheRequestMetrics,
+		api.prometheus.cacheResponseMetrics,
+		api.prometheus.cacheResponsePoints,
+	)
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
@@ -117,6 +145,10 @@ func (api *Api) CacheQuery(ctx context.Context, req *carbonpb.CacheRequest) (*ca
 	atomic.AddUint32(&api.stat.cacheRequestMetrics, uint32(len(req.Metrics)))
 	atomic.AddUint32(&api.stat.cacheResponseMetrics, uint32(resMetrics))
 	atomic.AddUint32(&api.stat.cacheResponsePoints, uint32(resPoints))
+	api.prometheus.cacheRequests.Inc()
+	api.prometheus.cacheRequestMetrics.Add(float64(len(req.Metrics)))
+	api.prometheus.cacheResponseMetrics.Add(float64(resMetrics))
+	api.prometheus.cacheResponsePoints.Add(float64(resPoints))
 
 	return res, nil
 }
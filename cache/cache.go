@@ -7,11 +7,15 @@ Based on https://github.com/orcaman/concurrent-map
 import (
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/helper/tracing"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/go-carbon/tags"
 )
@@ -22,19 +26,50 @@ const (
 	MaximumLength WriteStrategy = iota
 	TimestampOrder
 	Noop
+	Hybrid
 )
 
+func (s WriteStrategy) String() string {
+	switch s {
+	case MaximumLength:
+		return "max"
+	case TimestampOrder:
+		return "sorted"
+	case Noop:
+		return "noop"
+	case Hybrid:
+		return "hybrid"
+	}
+	return "unknown"
+}
+
 const shardCount = 1024
 
 type cacheSettings struct {
 	maxSize     int32
+	maxMemory   int64
 	xlog        io.Writer
 	tagsEnabled bool
+
+	// time of first point arrival is tracked for hybrid write strategy
+	trackAddTime   bool
+	maxTimeInCache time.Duration
+
+	pointsPolicy func(metric string) *PointsPolicy
+
+	// cardinality limits of tagged series. nil - disabled
+	tagLimiter *tagLimiter
+
+	// backpressure watermarks in percents of maxSize. 0 - disabled
+	backpressureHigh int32
+	backpressureLow  int32
 }
 
 // A "thread" safe map of type string:Anything.
 // To avoid lock bottlenecks this map is dived to several (shardCount) map shards.
 type Cache struct {
+	memory int64 // approximate memory usage in bytes. changing via atomic. first field for 64-bit alignment
+
 	sync.Mutex
 
 	queueLastBuild time.Time
@@ -46,14 +81,32 @@ type Cache struct {
 
 	settings atomic.Value // cacheSettings
 
+	prometheus cachePrometheus
+
+	backpressure struct {
+		sync.Mutex
+		active  int32         // 1 if receivers should be paused. changing via atomic
+		release chan struct{} // closed when cache size goes below low watermark
+	}
+
 	stat struct {
 		size                int32  // changing via atomic
 		queueBuildCnt       uint32 // number of times writeout queue was built
 		queueBuildTimeMs    uint32 // time spent building writeout queue in milliseconds
 		queueWriteoutTime   uint32 // in milliseconds
 		overflowCnt         uint32 // drop packages if cache full
+		overflowMemoryCnt   uint32 // drop packages if cache memory limit reached
 		queryCnt            uint32 // number of queries
 		tagsNormalizeErrors uint32 // tags normalize errors count
+		backpressureCnt     uint32 // number of times receivers were paused
+		oldestPointAge      uint32 // age of oldest point in cache on last queue build in seconds
+		oldestTimeInCache   uint32 // max time spent in cache by metric on last queue build in seconds (hybrid only)
+		overdueCnt          uint32 // number of metrics prioritized by max-time-in-cache on last queue build (hybrid only)
+		droppedLagCnt       uint32 // points older than max-lag
+		droppedSkewCnt      uint32 // points newer than now + max-skew
+		duplicatesCnt       uint32 // points merged by duplicates policy
+		tagLimitDroppedCnt  uint32 // points of series over tag cardinality limits
+		tagLimitRewriteCnt  uint32 // points of series with tag values replaced by placeholder
 	}
 }
 
@@ -63,6 +116,9 @@ type Shard struct {
 	items            map[string]*points.Points
 	notConfirmed     []*points.Points // linear search for value/slot
 	notConfirmedUsed int              // search value in notConfirmed[:notConfirmedUsed]
+	memory           int64            // approximate memory usage of items in bytes
+	addTime          map[string]int64 // unix time of first point arrival. Only for hybrid write strategy
+	policies         map[string]*PointsPolicy
 }
 
 // Creates a new cache instance
@@ -76,18 +132,22 @@ func New() *Cache {
 		c.data[i] = &Shard{
 			items:        make(map[string]*points.Points),
 			notConfirmed: make([]*points.Points, 4),
+			addTime:      make(map[string]int64),
+			policies:     make(map[string]*PointsPolicy),
 		}
 	}
 
 	settings := cacheSettings{
-		maxSize:     1000000,
-		tagsEnabled: false,
-		xlog:        nil,
+		maxSize:        1000000,
+		tagsEnabled:    false,
+		xlog:           nil,
+		maxTimeInCache: time.Hour,
 	}
 
 	c.settings.Store(&settings)
 
 	c.writeoutQueue = NewWriteoutQueue(c)
+	c.prometheus = newCachePrometheus(c)
 	return c
 }
 
@@ -103,18 +163,66 @@ func (c *Cache) SetWriteStrategy(s string) (err error) {
 		c.writeStrategy = TimestampOrder
 	case "noop":
 		c.writeStrategy = Noop
+	case "hybrid":
+		c.writeStrategy = Hybrid
 	default:
-		return fmt.Errorf("Unknown write strategy '%s', should be one of: max, sorted, noop", s)
+		return fmt.Errorf("Unknown write strategy '%s', should be one of: max, sorted, noop, hybrid", s)
 	}
+
+	settings := c.settings.Load().(*cacheSettings)
+	newSettings := *settings
+	newSettings.trackAddTime = c.writeStrategy == Hybrid
+	c.settings.Store(&newSettings)
+
 	return nil
 }
 
+// SetPointsPolicy sets function which returns duplicates and out-of-range points policy for metric.
+// It is called once per metric when metric is added to empty cache. nil - disable policies
+func (c *Cache) SetPointsPolicy(pointsPolicy func(metric string) *PointsPolicy) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.pointsPolicy = pointsPolicy
+	c.settings.Store(&newSettings)
+}
+
+// SetMaxTimeInCache sets time after which metric is written before others by hybrid write strategy
+func (c *Cache) SetMaxTimeInCache(d time.Duration) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.maxTimeInCache = d
+	c.settings.Store(&newSettings)
+}
+
 // SetMaxSize of cache
 func (c *Cache) SetMaxSize(maxSize uint32) {
 	s := c.settings.Load().(*cacheSettings)
 	newSettings := *s
 	newSettings.maxSize = int32(maxSize)
 	c.settings.Store(&newSettings)
+
+	c.updateBackpressure(&newSettings)
+}
+
+// SetBackpressure enables pausing of receivers when cache size reaches highWatermark
+// percents of max size. Receivers are resumed when size goes below lowWatermark percents.
+// Zero highWatermark disables backpressure
+func (c *Cache) SetBackpressure(highWatermark, lowWatermark uint32) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.backpressureHigh = int32(highWatermark)
+	newSettings.backpressureLow = int32(lowWatermark)
+	c.settings.Store(&newSettings)
+
+	c.updateBackpressure(&newSettings)
+}
+
+// SetMaxMemory sets approximate limit of cache memory usage in bytes. 0 - unlimited
+func (c *Cache) SetMaxMemory(maxMemory uint64) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.maxMemory = int64(maxMemory)
+	c.settings.Store(&newSettings)
 }
 
 func (c *Cache) SetTagsEnabled(value bool) {
@@ -133,14 +241,48 @@ func (c *Cache) Stat(send helper.StatCallback) {
 	send("size", float64(c.Size()))
 	send("metrics", float64(c.Len()))
 	send("maxSize", float64(s.maxSize))
+	send("memory", float64(c.Memory()))
+	send("maxMemory", float64(s.maxMemory))
 
 	helper.SendAndSubstractUint32("queries", &c.stat.queryCnt, send)
 	helper.SendAndSubstractUint32("tagsNormalizeErrors", &c.stat.tagsNormalizeErrors, send)
 	helper.SendAndSubstractUint32("overflow", &c.stat.overflowCnt, send)
+	helper.SendAndSubstractUint32("overflowMemory", &c.stat.overflowMemoryCnt, send)
+	helper.SendAndSubstractUint32("dropped.lag", &c.stat.droppedLagCnt, send)
+	helper.SendAndSubstractUint32("dropped.skew", &c.stat.droppedSkewCnt, send)
+	helper.SendAndSubstractUint32("duplicates", &c.stat.duplicatesCnt, send)
+	helper.SendAndSubstractUint32("dropped.tagLimit", &c.stat.tagLimitDroppedCnt, send)
+	helper.SendAndSubstractUint32("tagLimitRewritten", &c.stat.tagLimitRewriteCnt, send)
+	if s.tagLimiter != nil {
+		s.tagLimiter.stat(send)
+	}
+
+	c.shardMemoryStat(send)
+
+	send("backpressure", float64(atomic.LoadInt32(&c.backpressure.active)))
+	helper.SendAndSubstractUint32("backpressureCount", &c.stat.backpressureCnt, send)
+
+	c.Lock()
+	writeStrategy := c.writeStrategy
+	c.Unlock()
+
+	queueBuildCnt := atomic.SwapUint32(&c.stat.queueBuildCnt, 0)
+	queueBuildTimeMs := atomic.SwapUint32(&c.stat.queueBuildTimeMs, 0)
 
-	helper.SendAndSubstractUint32("queueBuildCount", &c.stat.queueBuildCnt, send)
-	helper.SendAndSubstractUint32("queueBuildTimeMs", &c.stat.queueBuildTimeMs, send)
+	send("queueBuildCount", float64(queueBuildCnt))
+	send("queueBuildTimeMs", float64(queueBuildTimeMs))
 	helper.SendUint32("queueWriteoutTime", &c.stat.queueWriteoutTime, send)
+
+	// per-strategy stats
+	prefix := "queue." + writeStrategy.String() + "."
+	send(prefix+"buildCount", float64(queueBuildCnt))
+	send(prefix+"buildTimeMs", float64(queueBuildTimeMs))
+	helper.SendUint32(prefix+"oldestPointAge", &c.stat.oldestPointAge, send)
+	if writeStrategy == Hybrid {
+		send(prefix+"maxTimeInCache", float64(s.maxTimeInCache/time.Second))
+		helper.SendUint32(prefix+"oldestTimeInCache", &c.stat.oldestTimeInCache, send)
+		helper.SendUint32(prefix+"overdue", &c.stat.overdueCnt, send)
+	}
 }
 
 // hash function
@@ -163,6 +305,7 @@ func (c *Cache) GetShard(key string) *Shard {
 
 func (c *Cache) Get(key string) []points.Point {
 	atomic.AddUint32(&c.stat.queryCnt, 1)
+	c.prometheus.queries.Inc()
 
 	shard := c.GetShard(key)
 
@@ -223,6 +366,11 @@ func (c *Cache) Size() int32 {
 	return atomic.LoadInt32(&c.stat.size)
 }
 
+// Memory returns approximate memory usage of cached points in bytes
+func (c *Cache) Memory() int64 {
+	return atomic.LoadInt64(&c.memory)
+}
+
 func (c *Cache) DivertToXlog(w io.Writer) {
 	s := c.settings.Load().(*cacheSettings)
 	newSettings := *s
@@ -234,6 +382,12 @@ func (c *Cache) DivertToXlog(w io.Writer) {
 func (c *Cache) Add(p *points.Points) {
 	s := c.settings.Load().(*cacheSettings)
 
+	if p.SpanContext != nil {
+		span := tracing.StartLinkedSpan(*p.SpanContext, "cache.add")
+		span.SetAttributes(attribute.String("metric", p.Metric))
+		defer span.End()
+	}
+
 	if s.xlog != nil {
 		p.WriteTo(s.xlog)
 		return
@@ -244,8 +398,23 @@ func (c *Cache) Add(p *points.Points) {
 		p.Metric, err = tags.Normalize(p.Metric)
 		if err != nil {
 			atomic.AddUint32(&c.stat.tagsNormalizeErrors, 1)
+			c.prometheus.tagsNormalizeErrors.Inc()
 			return
 		}
+
+		if s.tagLimiter != nil && strings.IndexByte(p.Metric, ';') >= 0 {
+			series, rewritten, ok := s.tagLimiter.check(p.Metric)
+			if !ok {
+				atomic.AddUint32(&c.stat.tagLimitDroppedCnt, uint32(len(p.Data)))
+				c.prometheus.droppedTagLimit.Add(float64(len(p.Data)))
+				return
+			}
+			if rewritten {
+				atomic.AddUint32(&c.stat.tagLimitRewriteCnt, uint32(len(p.Data)))
+				c.prometheus.tagLimitRewritten.Add(float64(len(p.Data)))
+			}
+			p.Metric = series
+		}
 	}
 
 	// Get map shard.
@@ -253,20 +422,144 @@ func (c *Cache) Add(p *points.Points) {
 
 	if s.maxSize > 0 && c.Size() > s.maxSize {
 		atomic.AddUint32(&c.stat.overflowCnt, uint32(count))
+		c.prometheus.droppedOverflow.Add(float64(count))
+		return
+	}
+
+	if s.maxMemory > 0 && c.Memory() > s.maxMemory {
+		atomic.AddUint32(&c.stat.overflowMemoryCnt, uint32(count))
+		c.prometheus.droppedOverflowMemory.Add(float64(count))
 		return
 	}
 
 	shard := c.GetShard(p.Metric)
 
+	var memory int64
+
 	shard.Lock()
-	if values, exists := shard.items[p.Metric]; exists {
+	values, exists := shard.items[p.Metric]
+
+	if s.pointsPolicy != nil {
+		var policy *PointsPolicy
+		if exists {
+			policy = shard.policies[p.Metric]
+		} else {
+			policy = s.pointsPolicy(p.Metric)
+		}
+
+		if policy != nil {
+			lag, skew := policy.filter(p, time.Now().Unix())
+			if lag > 0 {
+				atomic.AddUint32(&c.stat.droppedLagCnt, uint32(lag))
+				c.prometheus.droppedLag.Add(float64(lag))
+			}
+			if skew > 0 {
+				atomic.AddUint32(&c.stat.droppedSkewCnt, uint32(skew))
+				c.prometheus.droppedSkew.Add(float64(skew))
+			}
+			count = len(p.Data)
+
+			if count == 0 {
+				shard.Unlock()
+				return
+			}
+
+			if !exists {
+				shard.policies[p.Metric] = policy
+			}
+		}
+	}
+
+	if exists {
+		if values.SpanContext == nil {
+			values.SpanContext = p.SpanContext
+		}
+		oldCap := cap(values.Data)
 		values.Data = append(values.Data, p.Data...)
+		memory = int64(cap(values.Data)-oldCap) * pointSize
 	} else {
 		shard.items[p.Metric] = p
+		memory = itemMemory(p)
+		if s.trackAddTime {
+			shard.addTime[p.Metric] = time.Now().Unix()
+		}
 	}
+	shard.memory += memory
 	shard.Unlock()
 
 	atomic.AddInt32(&c.stat.size, int32(count))
+	atomic.AddInt64(&c.memory, memory)
+
+	if s.backpressureHigh > 0 {
+		c.updateBackpressure(s)
+	}
+}
+
+// Backpressure returns channel which is closed when receivers may continue to read data.
+// Returns nil if cache is not overloaded
+func (c *Cache) Backpressure() <-chan struct{} {
+	if atomic.LoadInt32(&c.backpressure.active) == 0 {
+		return nil
+	}
+
+	c.backpressure.Lock()
+	ch := c.backpressure.release
+	c.backpressure.Unlock()
+
+	return ch
+}
+
+func (c *Cache) updateBackpressure(s *cacheSettings) {
+	active := atomic.LoadInt32(&c.backpressure.active) == 1
+
+	if s.backpressureHigh <= 0 || s.maxSize <= 0 {
+		if active {
+			c.releaseBackpressure()
+		}
+		return
+	}
+
+	size := int64(c.Size())
+
+	if !active && size >= int64(s.maxSize)*int64(s.backpressureHigh)/100 {
+		c.backpressure.Lock()
+		if atomic.LoadInt32(&c.backpressure.active) == 0 {
+			c.backpressure.release = make(chan struct{})
+			atomic.StoreInt32(&c.backpressure.active, 1)
+			atomic.AddUint32(&c.stat.backpressureCnt, 1)
+			c.prometheus.backpressure.Inc()
+		}
+		c.backpressure.Unlock()
+	} else if active && size < int64(s.maxSize)*int64(s.backpressureLow)/100 {
+		c.releaseBackpressure()
+	}
+}
+
+func (c *Cache) releaseBackpressure() {
+	c.backpressure.Lock()
+	if atomic.LoadInt32(&c.backpressure.active) == 1 {
+		close(c.backpressure.release)
+		atomic.StoreInt32(&c.backpressure.active, 0)
+	}
+	c.backpressure.Unlock()
+}
+
+// deduplicate applies duplicates policy of popped item. Called with shard lock held
+func (c *Cache) deduplicate(shard *Shard, p *points.Points) {
+	if len(shard.policies) == 0 {
+		return
+	}
+
+	policy, exists := shard.policies[p.Metric]
+	if !exists {
+		return
+	}
+	delete(shard.policies, p.Metric)
+
+	if removed := policy.deduplicate(p); removed > 0 {
+		atomic.AddUint32(&c.stat.duplicatesCnt, uint32(removed))
+		c.prometheus.duplicates.Add(float64(removed))
+	}
 }
 
 // Pop removes an element from the map and returns it
@@ -276,10 +569,25 @@ func (c *Cache) Pop(key string) (p *points.Points, exists bool) {
 	shard.Lock()
 	p, exists = shard.items[key]
 	delete(shard.items, key)
+	if len(shard.addTime) > 0 {
+		delete(shard.addTime, key)
+	}
+	var size int
+	var memory int64
+	if exists {
+		size, memory = len(p.Data), itemMemory(p)
+		shard.memory -= memory
+		c.deduplicate(shard, p)
+	}
 	shard.Unlock()
 
 	if exists {
-		atomic.AddInt32(&c.stat.size, -int32(len(p.Data)))
+		atomic.AddInt32(&c.stat.size, -int32(size))
+		atomic.AddInt64(&c.memory, -memory)
+
+		if atomic.LoadInt32(&c.backpressure.active) == 1 {
+			c.updateBackpressure(c.settings.Load().(*cacheSettings))
+		}
 	}
 
 	return p, exists
@@ -291,8 +599,17 @@ func (c *Cache) PopNotConfirmed(key string) (p *points.Points, exists bool) {
 	shard.Lock()
 	p, exists = shard.items[key]
 	delete(shard.items, key)
+	if len(shard.addTime) > 0 {
+		delete(shard.addTime, key)
+	}
 
+	var size int
+	var memory int64
 	if exists {
+		size, memory = len(p.Data), itemMemory(p)
+		shard.memory -= memory
+		c.deduplicate(shard, p)
+
 		if shard.notConfirmedUsed < len(shard.notConfirmed) {
 			shard.notConfirmed[shard.notConfirmedUsed] = p
 		} else {
@@ -303,7 +620,12 @@ func (c *Cache) PopNotConfirmed(key string) (p *points.Points, exists bool) {
 	shard.Unlock()
 
 	if exists {
-		atomic.AddInt32(&c.stat.size, -int32(len(p.Data)))
+		atomic.AddInt32(&c.stat.size, -int32(size))
+		atomic.AddInt64(&c.memory, -memory)
+
+		if atomic.LoadInt32(&c.backpressure.active) == 1 {
+			c.updateBackpressure(c.settings.Load().(*cacheSettings))
+		}
 	}
 
 	return p, exists
@@ -3,7 +3,9 @@ package cache
 import (
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/lomik/go-carbon/points"
 )
@@ -81,6 +83,315 @@ func benchmarkStrategy(b *testing.B, strategy string) {
 	}
 }
 
-func BenchmarkUpdateQueueMax(b *testing.B)  { benchmarkStrategy(b, "max") }
-func BenchmarkUpdateQueueSort(b *testing.B) { benchmarkStrategy(b, "sort") }
-func BenchmarkUpdateQueueNoop(b *testing.B) { benchmarkStrategy(b, "noop") }
+func BenchmarkUpdateQueueMax(b *testing.B)    { benchmarkStrategy(b, "max") }
+func BenchmarkUpdateQueueSort(b *testing.B)   { benchmarkStrategy(b, "sort") }
+func BenchmarkUpdateQueueNoop(b *testing.B)   { benchmarkStrategy(b, "noop") }
+func BenchmarkUpdateQueueHybrid(b *testing.B) { benchmarkStrategy(b, "hybrid") }
+
+func TestCacheBackpressure(t *testing.T) {
+	c := New()
+	c.SetMaxSize(10)
+	c.SetBackpressure(50, 20)
+
+	for i := 0; i < 4; i++ {
+		c.Add(points.OnePoint(fmt.Sprintf("metric%d", i), 42, 10))
+	}
+
+	if c.Backpressure() != nil {
+		t.Fatal("backpressure should not be active below high watermark")
+	}
+
+	c.Add(points.OnePoint("metric4", 42, 10))
+
+	release := c.Backpressure()
+	if release == nil {
+		t.Fatal("backpressure should be active on high watermark")
+	}
+
+	c.Pop("metric0")
+	c.Pop("metric1")
+
+	select {
+	case <-release:
+		t.Fatal("backpressure should be active above low watermark")
+	default:
+	}
+
+	c.Pop("metric2")
+	c.Pop("metric3")
+
+	select {
+	case <-release:
+	default:
+		t.Fatal("backpressure should be released below low watermark")
+	}
+
+	if c.Backpressure() != nil {
+		t.Fatal("backpressure should not be active below low watermark")
+	}
+
+	c.Add(points.OnePoint("metric5", 42, 10).Add(43, 11).Add(44, 12).Add(45, 13).Add(46, 14))
+	release = c.Backpressure()
+	if release == nil {
+		t.Fatal("backpressure should be active on high watermark")
+	}
+
+	c.SetBackpressure(0, 0)
+	select {
+	case <-release:
+	default:
+		t.Fatal("backpressure should be released when disabled")
+	}
+}
+
+func TestCacheMemory(t *testing.T) {
+	c := New()
+
+	c.Add(points.OnePoint("hello.world", 42, 10))
+	m1 := c.Memory()
+	if m1 <= int64(len("hello.world")) {
+		t.Fatalf("unexpected memory usage %d", m1)
+	}
+
+	c.Add(points.OnePoint("hello.world", 43, 11))
+	c.Add(points.OnePoint("metric.name", 44, 12))
+	if c.Memory() <= m1 {
+		t.Fatalf("memory usage should grow, got %d", c.Memory())
+	}
+
+	var shardMemory int64
+	for _, shard := range c.data {
+		shardMemory += shard.memory
+	}
+	if shardMemory != c.Memory() {
+		t.Fatalf("shards memory %d != cache memory %d", shardMemory, c.Memory())
+	}
+
+	c.Pop("hello.world")
+	c.PopNotConfirmed("metric.name")
+	if c.Memory() != 0 {
+		t.Fatalf("memory usage should be 0, got %d", c.Memory())
+	}
+
+	c.SetMaxMemory(1)
+	c.Add(points.OnePoint("hello.world", 42, 10))
+	c.Add(points.OnePoint("hello.world", 43, 11))
+	if c.Size() != 1 {
+		t.Fatalf("point should be dropped by memory limit, size %d", c.Size())
+	}
+
+	stat := make(map[string]float64)
+	c.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+
+	if stat["overflowMemory"] != 1 {
+		t.Fatalf("expected 1 overflowMemory, got %v", stat["overflowMemory"])
+	}
+	if stat["shardMemory.max"] != float64(c.Memory()) || stat["shardMemory.min"] != 0 {
+		t.Fatalf("unexpected shard memory distribution: %#v", stat)
+	}
+}
+
+func TestHybridWriteStrategy(t *testing.T) {
+	c := New()
+	if err := c.SetWriteStrategy("hybrid"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetMaxTimeInCache(10 * time.Minute)
+
+	c.Add(points.OnePoint("light.old", 42, 10))
+	c.Add(points.OnePoint("light.new", 42, 10))
+	c.Add(points.OnePoint("heavy", 42, 10).Add(43, 11).Add(44, 12))
+
+	shard := c.GetShard("light.old")
+	shard.Lock()
+	if _, exists := shard.addTime["light.old"]; !exists {
+		t.Fatal("add time is not tracked")
+	}
+	shard.addTime["light.old"] = time.Now().Add(-time.Hour).Unix()
+	shard.Unlock()
+
+	q := c.makeQueue()
+
+	var order []string
+	for m := range q {
+		order = append(order, m)
+		if len(q) == 0 {
+			break
+		}
+	}
+
+	expected := []string{"light.old", "heavy", "light.new"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Fatalf("%#v != %#v", order, expected)
+	}
+
+	stat := make(map[string]float64)
+	c.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+
+	if stat["queue.hybrid.overdue"] != 1 {
+		t.Fatalf("expected 1 overdue metric, got %v", stat["queue.hybrid.overdue"])
+	}
+	if stat["queue.hybrid.oldestTimeInCache"] < 3600 {
+		t.Fatalf("unexpected oldestTimeInCache %v", stat["queue.hybrid.oldestTimeInCache"])
+	}
+
+	c.Pop("light.old")
+	shard.Lock()
+	if _, exists := shard.addTime["light.old"]; exists {
+		t.Fatal("add time is not removed on pop")
+	}
+	shard.Unlock()
+}
+
+func TestCachePointsPolicy(t *testing.T) {
+	now := time.Now().Unix()
+
+	table := []struct {
+		duplicates DuplicatesPolicy
+		expected   []points.Point
+	}{
+		{DuplicatesKeepAll, []points.Point{{Value: 1, Timestamp: now}, {Value: 3, Timestamp: now - 60}, {Value: 2, Timestamp: now}}},
+		{DuplicatesLast, []points.Point{{Value: 3, Timestamp: now - 60}, {Value: 2, Timestamp: now}}},
+		{DuplicatesFirst, []points.Point{{Value: 3, Timestamp: now - 60}, {Value: 1, Timestamp: now}}},
+		{DuplicatesSum, []points.Point{{Value: 3, Timestamp: now - 60}, {Value: 3, Timestamp: now}}},
+		{DuplicatesMax, []points.Point{{Value: 3, Timestamp: now - 60}, {Value: 2, Timestamp: now}}},
+	}
+
+	for _, tt := range table {
+		c := New()
+		c.SetPointsPolicy(func(metric string) *PointsPolicy {
+			if metric != "hello.world" {
+				return nil
+			}
+			return &PointsPolicy{
+				Duplicates: tt.duplicates,
+				MaxLag:     time.Hour,
+				MaxSkew:    time.Minute,
+			}
+		})
+
+		c.Add(points.OnePoint("hello.world", 1, now))
+		c.Add(points.OnePoint("hello.world", 4, now-7200))
+		c.Add(points.OnePoint("hello.world", 3, now-60))
+		c.Add(points.OnePoint("hello.world", 5, now+600))
+		c.Add(points.OnePoint("hello.world", 2, now))
+		c.Add(points.OnePoint("other.metric", 6, now-7200))
+
+		p, exists := c.Pop("hello.world")
+		if !exists {
+			t.Fatalf("%d: metric not found in cache", tt.duplicates)
+		}
+		if fmt.Sprint(p.Data) != fmt.Sprint(tt.expected) {
+			t.Fatalf("%d: expected %v, got %v", tt.duplicates, tt.expected, p.Data)
+		}
+
+		if _, exists = c.Pop("other.metric"); !exists {
+			t.Fatalf("%d: metric without policy should be kept", tt.duplicates)
+		}
+
+		if c.Size() != 0 || c.Memory() != 0 {
+			t.Fatalf("%d: cache should be empty, size %d, memory %d", tt.duplicates, c.Size(), c.Memory())
+		}
+
+		stat := make(map[string]float64)
+		c.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+
+		if stat["dropped.lag"] != 1 || stat["dropped.skew"] != 1 {
+			t.Fatalf("%d: unexpected dropped stats: %#v", tt.duplicates, stat)
+		}
+		if stat["duplicates"] != float64(3-len(tt.expected)) {
+			t.Fatalf("%d: unexpected duplicates stat: %v", tt.duplicates, stat["duplicates"])
+		}
+	}
+}
+
+func TestCacheTagLimits(t *testing.T) {
+	table := []struct {
+		placeholder string
+		expected    []string
+		dropped     float64
+		rewritten   float64
+		offenders   string
+	}{
+		{"", []string{"cpu;host=a", "cpu;host=b", "cpu;dc=x;host=a", "mem;dc=z", "untagged.metric"}, 3, 0, "[{tag.host 2} {name.cpu 1}]"},
+		{"_over_limit_", []string{"cpu;host=a", "cpu;host=b", "cpu;host=_over_limit_", "mem;dc=z", "untagged.metric"}, 2, 2, "[{name.cpu 2} {tag.host 2}]"},
+	}
+
+	for _, tt := range table {
+		c := New()
+		c.SetTagsEnabled(true)
+		c.SetTagLimits(TagLimits{
+			MaxValuesPerTag:  2,
+			MaxValues:        map[string]int{"dc": 0},
+			MaxSeriesPerName: 3,
+			Placeholder:      tt.placeholder,
+		})
+
+		c.Add(points.OnePoint("cpu;host=a", 1, 10))
+		c.Add(points.OnePoint("cpu;host=b", 1, 10))
+		c.Add(points.OnePoint("cpu;host=c", 1, 10))
+		c.Add(points.OnePoint("cpu;host=d", 1, 10))
+		c.Add(points.OnePoint("cpu;host=a;dc=x", 1, 10))
+		c.Add(points.OnePoint("cpu;host=a;dc=y", 1, 10))
+		c.Add(points.OnePoint("mem;dc=z", 1, 10))
+		c.Add(points.OnePoint("untagged.metric", 1, 10))
+
+		for _, metric := range tt.expected {
+			if _, exists := c.Pop(metric); !exists {
+				t.Fatalf("%q: metric %s not found in cache", tt.placeholder, metric)
+			}
+		}
+		if c.Size() != 0 {
+			t.Fatalf("%q: unexpected cache size %d", tt.placeholder, c.Size())
+		}
+
+		stat := make(map[string]float64)
+		c.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+
+		if stat["dropped.tagLimit"] != tt.dropped || stat["tagLimitRewritten"] != tt.rewritten || stat["tagLimits.top.tag.host"] != 2 {
+			t.Fatalf("%q: unexpected tag limits stats: %#v", tt.placeholder, stat)
+		}
+		if offenders := c.TagLimitOffenders(10); fmt.Sprint(offenders) != tt.offenders {
+			t.Fatalf("%q: unexpected offenders: %v", tt.placeholder, offenders)
+		}
+	}
+}
+
+func TestTagLimiterExpire(t *testing.T) {
+	l := newTagLimiter(TagLimits{MaxValuesPerTag: 2, MaxSeriesPerName: 2, Expire: time.Hour})
+
+	for _, metric := range []string{"cpu;host=a", "cpu;host=b"} {
+		if _, _, ok := l.check(metric); !ok {
+			t.Fatalf("%s is dropped", metric)
+		}
+	}
+	if _, _, ok := l.check("cpu;host=c"); ok {
+		t.Fatalf("series over the limit is accepted")
+	}
+
+	// cpu;host=a is not seen for an hour, cpu;host=b is fresh
+	now := time.Now().Unix()
+	atomic.StoreInt64(l.series["cpu;host=a"], now-3600)
+	l.expire(now)
+	if len(l.series) != 1 || l.names["cpu"] != 1 || len(l.values["host"]) != 1 {
+		t.Fatalf("unexpected state after expire: %v %v %v", l.series, l.names, l.values)
+	}
+	if _, _, ok := l.check("cpu;host=c"); !ok {
+		t.Fatalf("expired series still counts towards the limit")
+	}
+
+	// expire runs ten times per Expire at most
+	atomic.StoreInt64(l.series["cpu;host=b"], now-3600)
+	l.expire(now + 60)
+	if len(l.series) != 2 {
+		t.Fatalf("expire is done too often")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/lomik/go-carbon/helper"
@@ -144,6 +145,8 @@ type CarbonlinkListener struct {
 	cache       *Cache
 	readTimeout time.Duration
 	tcpListener *net.TCPListener
+
+	promRequests *prometheus.CounterVec
 }
 
 // NewCarbonlinkListener create new instance of CarbonlinkListener
@@ -151,9 +154,21 @@ func NewCarbonlinkListener(cache *Cache) *CarbonlinkListener {
 	return &CarbonlinkListener{
 		cache:       cache,
 		readTimeout: 30 * time.Second,
+		promRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "carbonlink_requests_total",
+				Help: "Carbonlink requests, partitioned by result",
+			},
+			[]string{"result"},
+		),
 	}
 }
 
+// InitPrometheus registers carbonlink metrics
+func (listener *CarbonlinkListener) InitPrometheus(reg prometheus.Registerer) {
+	reg.MustRegister(listener.promRequests)
+}
+
 // SetReadTimeout for read request from client
 func (listener *CarbonlinkListener) SetReadTimeout(timeout time.Duration) {
 	listener.readTimeout = timeout
@@ -234,17 +249,20 @@ func (listener *CarbonlinkListener) HandleConnection(conn framing.Conn) {
 		if err != nil {
 			conn.Conn.(*net.TCPConn).SetLinger(0)
 			logger.Warn("request parse failed", zap.Error(err))
+			listener.promRequests.WithLabelValues("error").Inc()
 			break
 		}
 		if req != nil {
 			if req.Type != "cache-query" {
 				logger.Warn("unknown query", zap.String("type", req.Type))
+				listener.promRequests.WithLabelValues("error").Inc()
 				conn.Write([]byte(fmt.Sprintf("\x80\x02}q\x00U\x05errorq\x01U\x1aInvalid request type %qq\x02s.", req.Type)))
 				break
 			}
 
 			if req.Type == "cache-query" {
 				data := listener.cache.Get(req.Metric)
+				listener.promRequests.WithLabelValues("ok").Inc()
 
 				packed := packReply(data)
 				if packed == nil {
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"sort"
+	"unsafe"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+)
+
+var (
+	pointSize  = int64(unsafe.Sizeof(points.Point{}))
+	pointsSize = int64(unsafe.Sizeof(points.Points{}))
+)
+
+// mapItemOverhead is approximate size of map bucket slot: key string header, value pointer and tophash
+const mapItemOverhead = 32
+
+// itemMemory returns approximate memory used by cache item: metric name, points.Points header and data slice
+func itemMemory(p *points.Points) int64 {
+	return mapItemOverhead + pointsSize + int64(len(p.Metric)) + int64(cap(p.Data))*pointSize
+}
+
+// shardMemoryStat sends distribution of memory usage by shards
+func (c *Cache) shardMemoryStat(send helper.StatCallback) {
+	values := make([]int64, shardCount)
+	for i := 0; i < shardCount; i++ {
+		shard := c.data[i]
+		shard.Lock()
+		values[i] = shard.memory
+		shard.Unlock()
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	send("shardMemory.min", float64(values[0]))
+	send("shardMemory.p50", float64(values[shardCount*50/100]))
+	send("shardMemory.p90", float64(values[shardCount*90/100]))
+	send("shardMemory.p99", float64(values[shardCount*99/100]))
+	send("shardMemory.max", float64(values[shardCount-1]))
+}
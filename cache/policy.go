@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+// DuplicatesPolicy defines which value is written if cache contains several points with same timestamp
+type DuplicatesPolicy int
+
+const (
+	// DuplicatesKeepAll passes all points to whisper. Last written point wins
+	DuplicatesKeepAll DuplicatesPolicy = iota
+	DuplicatesLast
+	DuplicatesFirst
+	DuplicatesSum
+	DuplicatesMax
+)
+
+// ParseDuplicatesPolicy parses policy name. Empty string means DuplicatesKeepAll
+func ParseDuplicatesPolicy(s string) (DuplicatesPolicy, error) {
+	switch s {
+	case "":
+		return DuplicatesKeepAll, nil
+	case "last":
+		return DuplicatesLast, nil
+	case "first":
+		return DuplicatesFirst, nil
+	case "sum":
+		return DuplicatesSum, nil
+	case "max":
+		return DuplicatesMax, nil
+	}
+	return DuplicatesKeepAll, fmt.Errorf("unknown duplicates policy %#v, should be one of: last, first, sum, max", s)
+}
+
+// PointsPolicy defines handling of duplicate and out-of-range points for metric
+type PointsPolicy struct {
+	Duplicates DuplicatesPolicy
+	MaxLag     time.Duration // drop points older than now-MaxLag. 0 - disabled
+	MaxSkew    time.Duration // drop points newer than now+MaxSkew. 0 - disabled
+}
+
+// filter removes points outside of [now-MaxLag, now+MaxSkew]. Returns number of dropped points by reason
+func (policy *PointsPolicy) filter(p *points.Points, now int64) (lag int, skew int) {
+	if policy.MaxLag == 0 && policy.MaxSkew == 0 {
+		return 0, 0
+	}
+
+	minTimestamp := int64(0)
+	if policy.MaxLag > 0 {
+		minTimestamp = now - int64(policy.MaxLag/time.Second)
+	}
+
+	maxTimestamp := int64(0)
+	if policy.MaxSkew > 0 {
+		maxTimestamp = now + int64(policy.MaxSkew/time.Second)
+	}
+
+	data := p.Data[:0]
+	for _, d := range p.Data {
+		if minTimestamp > 0 && d.Timestamp < minTimestamp {
+			lag++
+			continue
+		}
+		if maxTimestamp > 0 && d.Timestamp > maxTimestamp {
+			skew++
+			continue
+		}
+		data = append(data, d)
+	}
+	p.Data = data
+
+	return lag, skew
+}
+
+// deduplicate merges points with same timestamp. Returns number of removed points
+func (policy *PointsPolicy) deduplicate(p *points.Points) int {
+	if policy.Duplicates == DuplicatesKeepAll || len(p.Data) < 2 {
+		return 0
+	}
+
+	// keep arrival order of points with same timestamp for first/last policies
+	sort.SliceStable(p.Data, func(i, j int) bool { return p.Data[i].Timestamp < p.Data[j].Timestamp })
+
+	data := p.Data[:1]
+	for _, d := range p.Data[1:] {
+		last := &data[len(data)-1]
+		if d.Timestamp != last.Timestamp {
+			data = append(data, d)
+			continue
+		}
+
+		switch policy.Duplicates {
+		case DuplicatesLast:
+			last.Value = d.Value
+		case DuplicatesSum:
+			last.Value += d.Value
+		case DuplicatesMax:
+			if d.Value > last.Value {
+				last.Value = d.Value
+			}
+		}
+	}
+
+	removed := len(p.Data) - len(data)
+	p.Data = data
+
+	return removed
+}
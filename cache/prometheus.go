@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cachePrometheus mirrors cache stats as Prometheus metrics. Metrics are updated
+// even if Prometheus is disabled, InitPrometheus only registers them
+type cachePrometheus struct {
+	collectors []prometheus.Collector
+
+	queries             prometheus.Counter
+	tagsNormalizeErrors prometheus.Counter
+	tagLimitRewritten   prometheus.Counter
+	duplicates          prometheus.Counter
+	backpressure        prometheus.Counter
+
+	// dropped points by reason
+	droppedOverflow       prometheus.Counter
+	droppedOverflowMemory prometheus.Counter
+	droppedLag            prometheus.Counter
+	droppedSkew           prometheus.Counter
+	droppedTagLimit       prometheus.Counter
+
+	queueBuildDuration prometheus.Histogram
+	pointAge           prometheus.Histogram
+	timeInCache        prometheus.Histogram
+}
+
+func newCachePrometheus(c *Cache) cachePrometheus {
+	dropped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_dropped_points_total",
+			Help: "Points dropped by cache, partitioned by reason",
+		},
+		[]string{"reason"},
+	)
+
+	p := cachePrometheus{
+		queries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_queries_total",
+			Help: "Number of cache queries",
+		}),
+		tagsNormalizeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_tags_normalize_errors_total",
+			Help: "Number of tagged metrics with invalid names",
+		}),
+		tagLimitRewritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_tag_limit_rewritten_points_total",
+			Help: "Points of tagged series with tag values replaced by placeholder",
+		}),
+		duplicates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_duplicate_points_total",
+			Help: "Points merged by duplicates policy",
+		}),
+		backpressure: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_backpressure_total",
+			Help: "Number of times receivers were paused",
+		}),
+
+		droppedOverflow:       dropped.WithLabelValues("overflow"),
+		droppedOverflowMemory: dropped.WithLabelValues("overflow_memory"),
+		droppedLag:            dropped.WithLabelValues("lag"),
+		droppedSkew:           dropped.WithLabelValues("skew"),
+		droppedTagLimit:       dropped.WithLabelValues("tag_limit"),
+
+		queueBuildDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cache_queue_build_duration_seconds_exp",
+			Help:    "Duration of writeout queue build (exponential buckets)",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2.0, 16),
+		}),
+		pointAge: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cache_point_age_seconds_exp",
+			Help:    "Age of the oldest point of cached metrics on writeout queue build (exponential buckets)",
+			Buckets: prometheus.ExponentialBuckets(1, 2.0, 16),
+		}),
+		timeInCache: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cache_time_in_cache_seconds_exp",
+			Help:    "Time spent in cache by metrics on writeout queue build, hybrid write strategy only (exponential buckets)",
+			Buckets: prometheus.ExponentialBuckets(1, 2.0, 16),
+		}),
+	}
+
+	gauge := func(name, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, value)
+	}
+
+	p.collectors = []prometheus.Collector{
+		p.queries, p.tagsNormalizeErrors, p.tagLimitRewritten, p.duplicates, p.backpressure, dropped,
+		p.queueBuildDuration, p.pointAge, p.timeInCache,
+		gauge("cache_size", "Number of points in cache", func() float64 {
+			return float64(c.Size())
+		}),
+		gauge("cache_metrics", "Number of metrics in cache", func() float64 {
+			return float64(c.Len())
+		}),
+		gauge("cache_memory_bytes", "Approximate memory usage of cached points", func() float64 {
+			return float64(c.Memory())
+		}),
+		gauge("cache_max_size", "Max number of points in cache", func() float64 {
+			return float64(c.settings.Load().(*cacheSettings).maxSize)
+		}),
+		gauge("cache_max_memory_bytes", "Limit of cache memory usage", func() float64 {
+			return float64(c.settings.Load().(*cacheSettings).maxMemory)
+		}),
+		gauge("cache_backpressure_active", "1 if receivers are paused", func() float64 {
+			return float64(atomic.LoadInt32(&c.backpressure.active))
+		}),
+	}
+
+	return p
+}
+
+// InitPrometheus registers cache metrics
+func (c *Cache) InitPrometheus(reg prometheus.Registerer) {
+	for _, m := range c.prometheus.collectors {
+		reg.MustRegister(m)
+	}
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"math"
 	"sort"
 	"sync/atomic"
 	"time"
@@ -21,6 +22,9 @@ func (v byOrderKey) Len() int           { return len(v) }
 func (v byOrderKey) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
 func (v byOrderKey) Less(i, j int) bool { return v[i].orderKey < v[j].orderKey }
 
+// overdueOrderKey is added to order key of metrics which reached max-time-in-cache in hybrid write strategy
+const overdueOrderKey = int64(1) << 48
+
 func (c *Cache) makeQueue() chan string {
 	c.Lock()
 	writeStrategy := c.writeStrategy
@@ -37,41 +41,91 @@ func (c *Cache) makeQueue() chan string {
 	defer func() {
 		atomic.AddUint32(&c.stat.queueBuildTimeMs, uint32(time.Since(start)/time.Millisecond))
 		atomic.AddUint32(&c.stat.queueBuildCnt, 1)
+		c.prometheus.queueBuildDuration.Observe(time.Since(start).Seconds())
 
 		c.Lock()
 		c.queueLastBuild = time.Now()
 		c.Unlock()
 	}()
 
-	orderKey := func(p *points.Points) int64 {
+	now := start.Unix()
+
+	// metrics added before overdueTime will be written first by hybrid strategy.
+	// Last writeout time is subtracted from max-time-in-cache, so metric is written
+	// before deadline even if it is placed to the end of the next queue
+	maxTimeInCache := c.settings.Load().(*cacheSettings).maxTimeInCache
+	overdueTime := now - int64(maxTimeInCache/time.Second) + int64(atomic.LoadUint32(&c.stat.queueWriteoutTime))
+
+	orderKey := func(p *points.Points, addTime int64) int64 {
 		return 0
 	}
 
 	switch writeStrategy {
 	case MaximumLength:
-		orderKey = func(p *points.Points) int64 {
+		orderKey = func(p *points.Points, addTime int64) int64 {
 			return int64(len(p.Data))
 		}
 	case TimestampOrder:
-		orderKey = func(p *points.Points) int64 {
+		orderKey = func(p *points.Points, addTime int64) int64 {
 			return p.Data[0].Timestamp
 		}
+	case Hybrid:
+		orderKey = func(p *points.Points, addTime int64) int64 {
+			if addTime <= overdueTime {
+				// oldest first
+				return overdueOrderKey + now - addTime
+			}
+			return int64(len(p.Data))
+		}
 	}
 
 	size := c.Len() * 2
 	q := make(queue, size)
 	index := int32(0)
 
+	oldestPoint := int64(math.MaxInt64)
+	oldestAddTime := now
+	overdue := uint32(0)
+
 	for i := 0; i < shardCount; i++ {
 		shard := c.data[i]
 		shard.Lock()
 
 		for _, p := range shard.items {
+			var addTime int64
+			if writeStrategy == Hybrid {
+				var exists bool
+				addTime, exists = shard.addTime[p.Metric]
+				if !exists {
+					// strategy was changed on the fly
+					addTime = now
+					shard.addTime[p.Metric] = now
+				}
+				if addTime < oldestAddTime {
+					oldestAddTime = addTime
+				}
+				c.prometheus.timeInCache.Observe(float64(now - addTime))
+				if addTime <= overdueTime {
+					overdue++
+				}
+			}
+
+			if len(p.Data) > 0 {
+				if p.Data[0].Timestamp < oldestPoint {
+					oldestPoint = p.Data[0].Timestamp
+				}
+				if p.Data[0].Timestamp < now {
+					c.prometheus.pointAge.Observe(float64(now - p.Data[0].Timestamp))
+				} else {
+					c.prometheus.pointAge.Observe(0)
+				}
+			}
+
 			if index < size {
 				q[index].metric = p.Metric
-				q[index].orderKey = orderKey(p)
+				q[index].orderKey = orderKey(p, addTime)
 			} else {
-				q = append(q, queueItem{p.Metric, orderKey(p)})
+				q = append(q, queueItem{p.Metric, orderKey(p, addTime)})
 			}
 			index++
 		}
@@ -81,8 +135,16 @@ func (c *Cache) makeQueue() chan string {
 
 	q = q[:index]
 
+	if oldestPoint < now {
+		atomic.StoreUint32(&c.stat.oldestPointAge, uint32(now-oldestPoint))
+	} else {
+		atomic.StoreUint32(&c.stat.oldestPointAge, 0)
+	}
+	atomic.StoreUint32(&c.stat.oldestTimeInCache, uint32(now-oldestAddTime))
+	atomic.StoreUint32(&c.stat.overdueCnt, overdue)
+
 	switch writeStrategy {
-	case MaximumLength:
+	case MaximumLength, Hybrid:
 		sort.Sort(sort.Reverse(byOrderKey(q)))
 	case TimestampOrder:
 		sort.Sort(byOrderKey(q))
@@ -0,0 +1,318 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/go-carbon/helper"
+)
+
+// maxTagLimitOffenders limits number of tracked offending keys
+const maxTagLimitOffenders = 1000
+
+// tagLimitsTopStat is number of offending keys sent by Stat
+const tagLimitsTopStat = 10
+
+// TagLimits defines cardinality limits of tagged series. Zero limit - unlimited
+type TagLimits struct {
+	MaxValuesPerTag  int            // distinct values of every tag
+	MaxValues        map[string]int // overrides MaxValuesPerTag for some tags
+	MaxSeriesPerName int            // distinct series with the same metric name
+	// Placeholder replaces tag value over the limit. Empty - series is dropped
+	Placeholder string
+	// Expire is time after which series without points stop counting towards the
+	// limits. Zero - series are kept until restart
+	Expire time.Duration
+}
+
+func (limits *TagLimits) enabled() bool {
+	if limits.MaxValuesPerTag > 0 || limits.MaxSeriesPerName > 0 {
+		return true
+	}
+	for _, max := range limits.MaxValues {
+		if max > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (limits *TagLimits) maxValues(tag string) int {
+	if max, ok := limits.MaxValues[tag]; ok {
+		return max
+	}
+	return limits.MaxValuesPerTag
+}
+
+// TagLimitOffender is a tag or metric name which reached the limit
+type TagLimitOffender struct {
+	Key      string `json:"key"` // tag.<tag> or name.<metric name>
+	Rejected uint64 `json:"rejected"`
+}
+
+// tagLimiter remembers accepted series and checks limits of new ones. Known series
+// are checked under read lock, so limits cost nothing for the most of points.
+// Series are kept in memory only: after restart limits are counted from scratch by
+// series received since start, not by series already stored in whisper files or
+// TagDB. Series without points for limits.Expire are forgotten.
+type tagLimiter struct {
+	sync.RWMutex
+	limits TagLimits
+
+	series  map[string]*int64         // last time when series was seen, unix seconds
+	values  map[string]map[string]int // number of series by value of limited tags
+	names   map[string]int            // number of series by metric name
+	expired int64                     // time of the last expire
+
+	offenders map[string]uint64 // rejected series by key since start
+	recent    map[string]uint64 // rejected series by key since last Stat
+}
+
+func newTagLimiter(limits TagLimits) *tagLimiter {
+	return &tagLimiter{
+		limits:    limits,
+		series:    make(map[string]*int64),
+		values:    make(map[string]map[string]int),
+		names:     make(map[string]int),
+		offenders: make(map[string]uint64),
+		recent:    make(map[string]uint64),
+	}
+}
+
+func (l *tagLimiter) offend(key string) {
+	if _, ok := l.offenders[key]; ok || len(l.offenders) < maxTagLimitOffenders {
+		l.offenders[key]++
+	}
+	if _, ok := l.recent[key]; ok || len(l.recent) < maxTagLimitOffenders {
+		l.recent[key]++
+	}
+}
+
+// check returns series to store, possibly with rewritten tag values. ok is false if
+// series should be dropped. metric should be normalized
+func (l *tagLimiter) check(metric string) (series string, rewritten bool, ok bool) {
+	now := time.Now().Unix()
+
+	l.RLock()
+	seen, known := l.series[metric]
+	l.RUnlock()
+	if known {
+		touch(seen, now)
+		return metric, false, true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if seen, known := l.series[metric]; known {
+		touch(seen, now)
+		return metric, false, true
+	}
+
+	arr := strings.Split(metric, ";")
+	name := arr[0]
+
+	// new values are remembered only if series is accepted
+	for i := 1; i < len(arr); i++ {
+		p := strings.IndexByte(arr[i], '=')
+		tag, value := arr[i][:p], arr[i][p+1:]
+
+		max := l.limits.maxValues(tag)
+		if max <= 0 || value == l.limits.Placeholder {
+			continue
+		}
+		if _, ok := l.values[tag][value]; ok || len(l.values[tag]) < max {
+			continue
+		}
+
+		l.offend("tag." + tag)
+		if l.limits.Placeholder == "" {
+			return "", false, false
+		}
+		arr[i] = tag + "=" + l.limits.Placeholder
+		rewritten = true
+	}
+
+	series = metric
+	if rewritten {
+		series = strings.Join(arr, ";")
+		if seen, known := l.series[series]; known {
+			touch(seen, now)
+			return series, true, true
+		}
+	}
+
+	if l.limits.MaxSeriesPerName > 0 && l.names[name] >= l.limits.MaxSeriesPerName {
+		l.offend("name." + name)
+		return "", false, false
+	}
+
+	l.series[series] = &now
+	l.names[name]++
+	l.forEachValue(series, func(tag, value string) {
+		if l.values[tag] == nil {
+			l.values[tag] = make(map[string]int)
+		}
+		l.values[tag][value]++
+	})
+
+	return series, rewritten, true
+}
+
+// touch updates last seen time of series, memory is written once a second at most
+func touch(seen *int64, now int64) {
+	if atomic.LoadInt64(seen) != now {
+		atomic.StoreInt64(seen, now)
+	}
+}
+
+// forEachValue calls cb for values of limited tags of accepted series
+func (l *tagLimiter) forEachValue(series string, cb func(tag, value string)) {
+	arr := strings.Split(series, ";")
+	for i := 1; i < len(arr); i++ {
+		p := strings.IndexByte(arr[i], '=')
+		tag, value := arr[i][:p], arr[i][p+1:]
+		if l.limits.maxValues(tag) <= 0 || value == l.limits.Placeholder {
+			continue
+		}
+		cb(tag, value)
+	}
+}
+
+// expire forgets series not seen for limits.Expire. Whole set is scanned under lock,
+// so it's done ten times per Expire at most.
+func (l *tagLimiter) expire(now int64) {
+	expire := int64(l.limits.Expire / time.Second)
+	if expire <= 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if now-l.expired < expire/10 {
+		return
+	}
+	l.expired = now
+
+	for series, seen := range l.series {
+		if now-atomic.LoadInt64(seen) < expire {
+			continue
+		}
+		delete(l.series, series)
+
+		name := series[:strings.IndexByte(series, ';')]
+		if l.names[name]--; l.names[name] <= 0 {
+			delete(l.names, name)
+		}
+		l.forEachValue(series, func(tag, value string) {
+			if l.values[tag][value]--; l.values[tag][value] <= 0 {
+				delete(l.values[tag], value)
+			}
+		})
+	}
+}
+
+func topOffenders(m map[string]uint64, n int) []TagLimitOffender {
+	res := make([]TagLimitOffender, 0, len(m))
+	for k, v := range m {
+		res = append(res, TagLimitOffender{Key: k, Rejected: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Rejected != res[j].Rejected {
+			return res[i].Rejected > res[j].Rejected
+		}
+		return res[i].Key < res[j].Key
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+func (l *tagLimiter) stat(send helper.StatCallback) {
+	l.expire(time.Now().Unix())
+
+	l.Lock()
+	series := len(l.series)
+	recent := l.recent
+	l.recent = make(map[string]uint64)
+	l.Unlock()
+
+	send("tagLimits.series", float64(series))
+	for _, o := range topOffenders(recent, tagLimitsTopStat) {
+		// dots of metric name would add levels to stat metric
+		kv := strings.SplitN(o.Key, ".", 2)
+		send("tagLimits.top."+kv[0]+"."+strings.Replace(kv[1], ".", "_", -1), float64(o.Rejected))
+	}
+}
+
+// SetTagLimits sets cardinality limits of tagged series. Accepted series are kept if
+// limits are not changed
+func (c *Cache) SetTagLimits(limits TagLimits) {
+	c.Lock()
+	defer c.Unlock()
+
+	s := c.settings.Load().(*cacheSettings)
+	if s.tagLimiter != nil && reflect.DeepEqual(s.tagLimiter.limits, limits) {
+		return
+	}
+
+	newSettings := *s
+	newSettings.tagLimiter = nil
+	if limits.enabled() {
+		newSettings.tagLimiter = newTagLimiter(limits)
+	}
+	c.settings.Store(&newSettings)
+}
+
+// TagLimitOffenders returns n tags and metric names with the most rejected series
+func (c *Cache) TagLimitOffenders(n int) []TagLimitOffender {
+	l := c.settings.Load().(*cacheSettings).tagLimiter
+	if l == nil {
+		return nil
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+	return topOffenders(l.offenders, n)
+}
+
+// ServeTagLimits shows tags and metric names with the most rejected series
+func (c *Cache) ServeTagLimits(w http.ResponseWriter, r *http.Request) {
+	l := c.settings.Load().(*cacheSettings).tagLimiter
+	if l == nil {
+		http.Error(w, "tag limits are disabled", http.StatusNotFound)
+		return
+	}
+
+	n := 10
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("Bad request (invalid n %q)", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	l.RLock()
+	res := struct {
+		Series    int                `json:"series"`
+		Offenders []TagLimitOffender `json:"offenders"`
+	}{len(l.series), topOffenders(l.offenders, n)}
+	l.RUnlock()
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -3,6 +3,7 @@ package carbon
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"runtime"
@@ -15,6 +16,7 @@ import (
 	"github.com/lomik/go-carbon/api"
 	"github.com/lomik/go-carbon/cache"
 	"github.com/lomik/go-carbon/carbonserver"
+	"github.com/lomik/go-carbon/helper/tracing"
 	"github.com/lomik/go-carbon/persister"
 	"github.com/lomik/go-carbon/receiver"
 	"github.com/lomik/go-carbon/tags"
@@ -23,6 +25,8 @@ import (
 	// register receivers
 	_ "github.com/lomik/go-carbon/receiver/http"
 	_ "github.com/lomik/go-carbon/receiver/kafka"
+	_ "github.com/lomik/go-carbon/receiver/mqtt"
+	_ "github.com/lomik/go-carbon/receiver/nats"
 	_ "github.com/lomik/go-carbon/receiver/pubsub"
 	_ "github.com/lomik/go-carbon/receiver/tcp"
 	_ "github.com/lomik/go-carbon/receiver/udp"
@@ -96,8 +100,30 @@ func (app *App) configure() error {
 	}
 	if !(cfg.Cache.WriteStrategy == "max" ||
 		cfg.Cache.WriteStrategy == "sorted" ||
-		cfg.Cache.WriteStrategy == "noop") {
-		return fmt.Errorf("go-carbon support only \"max\", \"sorted\"  or \"noop\" write-strategy")
+		cfg.Cache.WriteStrategy == "noop" ||
+		cfg.Cache.WriteStrategy == "hybrid") {
+		return fmt.Errorf("go-carbon support only \"max\", \"sorted\", \"noop\" or \"hybrid\" write-strategy")
+	}
+
+	if cfg.Cache.Backpressure {
+		if cfg.Cache.BackpressureHighWatermark == 0 || cfg.Cache.BackpressureHighWatermark > 100 {
+			return fmt.Errorf("cache.backpressure-high-watermark should be in range 1..100")
+		}
+		if cfg.Cache.BackpressureLowWatermark > cfg.Cache.BackpressureHighWatermark {
+			return fmt.Errorf("cache.backpressure-low-watermark should not be greater than cache.backpressure-high-watermark")
+		}
+	}
+
+	if err := checkTagLimits(cfg.Tags); err != nil {
+		return err
+	}
+
+	if err := checkTagDBEndpoints(cfg.Tags); err != nil {
+		return err
+	}
+
+	if err := checkAPILimits(cfg.Carbonserver.APILimits, cfg.Carbonserver.APILimitsClientHeader); err != nil {
+		return err
 	}
 
 	if cfg.Common.MetricEndpoint == "" {
@@ -116,11 +142,197 @@ func (app *App) configure() error {
 		}
 	}
 
+	for _, e := range cfg.MetricExporters {
+		if err := checkMetricExporter(e); err != nil {
+			return err
+		}
+	}
+
+	if err := tracing.Check(tracingOptions(cfg.Tracing)); err != nil {
+		return err
+	}
+
 	app.Config = cfg
 
 	return nil
 }
 
+func checkAPILimits(limits map[string]carbonserverAPILimitConfig, clientHeader string) error {
+	for endpoint, limit := range limits {
+		known := false
+		for _, e := range carbonserver.LimitedEndpoints {
+			if e == endpoint {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("carbonserver.api-limits: unknown endpoint %q, supported: %s", endpoint, strings.Join(carbonserver.LimitedEndpoints, ", "))
+		}
+		if limit.Rate < 0 || limit.Burst < 0 || limit.MaxInflight < 0 || limit.MaxInflightTotal < 0 {
+			return fmt.Errorf("carbonserver.api-limits.%s: limits should not be negative", endpoint)
+		}
+	}
+
+	for header := range carbonserver.TraceHeaders {
+		if strings.EqualFold(header, clientHeader) {
+			return fmt.Errorf("carbonserver.api-limits-client-header: %q is unique per request and can't identify clients", clientHeader)
+		}
+	}
+	return nil
+}
+
+func apiLimits(limits map[string]carbonserverAPILimitConfig) map[string]carbonserver.APILimit {
+	res := make(map[string]carbonserver.APILimit, len(limits))
+	for endpoint, limit := range limits {
+		res[endpoint] = carbonserver.APILimit{
+			Rate:             limit.Rate,
+			Burst:            limit.Burst,
+			MaxInflight:      limit.MaxInflight,
+			MaxInflightTotal: limit.MaxInflightTotal,
+		}
+	}
+	return res
+}
+
+func slowQueryThresholds(conf carbonserverConfig) carbonserver.QueryCostThresholds {
+	return carbonserver.QueryCostThresholds{
+		Duration:  conf.SlowQueryDuration.Value(),
+		Files:     conf.SlowQueryFiles,
+		TrieNodes: conf.SlowQueryTrieNodes,
+		Points:    conf.SlowQueryPoints,
+		Bytes:     conf.SlowQueryBytes,
+	}
+}
+
+func checkTagLimits(conf tagsConfig) error {
+	switch conf.LimitAction {
+	case "drop":
+	case "rewrite":
+		if conf.LimitPlaceholder == "" || strings.ContainsAny(conf.LimitPlaceholder, ";=") {
+			return fmt.Errorf("tags.limit-placeholder should be non-empty and should not contain \";\" and \"=\"")
+		}
+	default:
+		return fmt.Errorf("go-carbon support only \"drop\" or \"rewrite\" tags.limit-action")
+	}
+	return nil
+}
+
+func checkTagDBEndpoints(conf tagsConfig) error {
+	for _, e := range conf.TagDBEndpoints {
+		switch e.Mode {
+		case "", tags.EndpointBroadcast, tags.EndpointFailover, tags.EndpointShard:
+		default:
+			return fmt.Errorf("go-carbon support only \"broadcast\", \"failover\" or \"shard\" mode of tags.tagdb-endpoint, got %#v", e.Mode)
+		}
+		if e.URL == "" {
+			return fmt.Errorf("tags.tagdb-endpoint url should be set")
+		}
+	}
+	return nil
+}
+
+func tagsOptions(conf tagsConfig) *tags.Options {
+	options := &tags.Options{
+		LocalPath:           conf.LocalDir,
+		TagDB:               conf.TagDB,
+		TagDBTimeout:        conf.TagDBTimeout.Value(),
+		TagDBChunkSize:      conf.TagDBChunkSize,
+		TagDBUpdateInterval: conf.TagDBUpdateInterval,
+	}
+	for _, e := range conf.TagDBEndpoints {
+		options.TagDBEndpoints = append(options.TagDBEndpoints, tags.Endpoint{URL: e.URL, Mode: e.Mode})
+	}
+	return options
+}
+
+// tracingOptions returns options of global tracing configuration
+func tracingOptions(conf tracingConfig) tracing.Options {
+	return tracing.Options{
+		Enabled:          conf.Enabled,
+		QuerySampleRate:  conf.QuerySampleRate,
+		IngestSampleRate: conf.IngestSampleRate,
+		Exporter:         conf.Exporter,
+		Endpoint:         conf.Endpoint,
+		Path:             conf.Path,
+		ServiceName:      conf.ServiceName,
+	}
+}
+
+// tagLimits returns cardinality limits of tagged series checked by cache
+func tagLimits(conf tagsConfig) cache.TagLimits {
+	limits := cache.TagLimits{
+		MaxValuesPerTag:  conf.MaxTagValues,
+		MaxValues:        conf.MaxTagValuesByTag,
+		MaxSeriesPerName: conf.MaxSeriesPerName,
+		Expire:           conf.LimitExpire.Value(),
+	}
+	if conf.LimitAction == "rewrite" {
+		limits.Placeholder = conf.LimitPlaceholder
+	}
+	return limits
+}
+
+// tagsHandler serves local TagDB. Tags are re-created on config reload
+func (app *App) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	app.RLock()
+	t := app.Tags
+	app.RUnlock()
+
+	if t == nil {
+		http.Error(w, "tags are disabled", http.StatusNotFound)
+		return
+	}
+	t.ServeHTTP(w, r)
+}
+
+// StatsHandler serves /debug/stats with internal metrics of the last collect.
+// Collector is re-created on config reload
+func (app *App) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	app.RLock()
+	c := app.Collector
+	app.RUnlock()
+
+	if c == nil {
+		http.Error(w, "collector is not started", http.StatusNotFound)
+		return
+	}
+	c.ServeStats(w, r)
+}
+
+// deleteTagged removes series of deleted tagged whisper file from TagDB
+func (app *App) deleteTagged(series string) {
+	app.RLock()
+	t := app.Tags
+	app.RUnlock()
+
+	if t != nil {
+		t.Delete(series)
+	}
+}
+
+// metricSchema returns retentions and aggregation of new whisper file of metric
+func (app *App) metricSchema(metric string) (carbonserver.MetricSchema, bool) {
+	app.RLock()
+	schemas := app.Config.Whisper.Schemas
+	aggregation := app.Config.Whisper.Aggregation
+	app.RUnlock()
+
+	schema, ok := schemas.Match(metric)
+	if !ok || aggregation == nil {
+		return carbonserver.MetricSchema{}, false
+	}
+	aggr := aggregation.Match(metric)
+	if aggr == nil {
+		return carbonserver.MetricSchema{}, false
+	}
+	return carbonserver.MetricSchema{
+		Retentions:   schema.Retentions,
+		Aggregation:  aggr.AggregationMethod(),
+		XFilesFactor: aggr.XFilesFactor(),
+	}, true
+}
+
 // ParseConfig loads config from config file, schemas.conf, aggregation.conf
 func (app *App) ParseConfig() error {
 	app.Lock()
@@ -151,8 +363,18 @@ func (app *App) ReloadConfig() error {
 	runtime.GOMAXPROCS(app.Config.Common.MaxCPU)
 
 	app.Cache.SetMaxSize(app.Config.Cache.MaxSize)
+	app.Cache.SetMaxMemory(app.Config.Cache.MaxMemory)
 	app.Cache.SetWriteStrategy(app.Config.Cache.WriteStrategy)
+	app.Cache.SetMaxTimeInCache(app.Config.Cache.MaxTimeInCache.Value())
 	app.Cache.SetTagsEnabled(app.Config.Tags.Enabled)
+	app.Cache.SetTagLimits(tagLimits(app.Config.Tags))
+	app.setCacheBackpressure(app.Cache)
+	app.setCachePointsPolicy(app.Cache)
+
+	// reopens file of exporter, e.g. after logrotate
+	if err = tracing.Setup(tracingOptions(app.Config.Tracing)); err != nil {
+		zapwriter.Logger("app").Error("tracing setup failed", zap.Error(err))
+	}
 
 	if app.Persister != nil {
 		app.Persister.Stop()
@@ -239,6 +461,8 @@ func (app *App) stopAll() {
 		logger.Debug("collector stopped")
 	}
 
+	tracing.Setup(tracing.Options{})
+
 	if app.exit != nil {
 		close(app.exit)
 		app.exit = nil
@@ -253,15 +477,64 @@ func (app *App) Stop() {
 	app.stopAll()
 }
 
+func (app *App) setCacheBackpressure(c *cache.Cache) {
+	if app.Config.Cache.Backpressure {
+		c.SetBackpressure(app.Config.Cache.BackpressureHighWatermark, app.Config.Cache.BackpressureLowWatermark)
+	} else {
+		c.SetBackpressure(0, 0)
+	}
+}
+
+// setCachePointsPolicy passes duplicates and max-lag/max-skew settings from storage-schemas to cache
+func (app *App) setCachePointsPolicy(c *cache.Cache) {
+	schemas := app.Config.Whisper.Schemas
+	policies := make(map[string]*cache.PointsPolicy)
+
+	for _, schema := range schemas {
+		if !schema.HasPointsPolicy() {
+			continue
+		}
+		// already validated in ReadWhisperSchemas
+		duplicates, _ := cache.ParseDuplicatesPolicy(schema.Duplicates)
+		policies[schema.Name] = &cache.PointsPolicy{
+			Duplicates: duplicates,
+			MaxLag:     schema.MaxLag,
+			MaxSkew:    schema.MaxSkew,
+		}
+	}
+
+	if len(policies) == 0 {
+		c.SetPointsPolicy(nil)
+		return
+	}
+
+	c.SetPointsPolicy(func(metric string) *cache.PointsPolicy {
+		if schema, ok := schemas.Match(metric); ok {
+			return policies[schema.Name]
+		}
+		return nil
+	})
+}
+
+// addReceiver registers started receiver. Receivers which are able to slow down clients
+// are subscribed to cache backpressure
+func (app *App) addReceiver(name string, rcv receiver.Receiver) {
+	if r, ok := rcv.(receiver.BackpressureReceiver); ok {
+		r.SetBackpressure(app.Cache.Backpressure)
+	}
+
+	app.Receivers = append(app.Receivers, &NamedReceiver{
+		Receiver: rcv,
+		Name:     name,
+	})
+}
+
 func (app *App) startPersister() {
 	if app.Config.Tags.Enabled {
-		app.Tags = tags.New(&tags.Options{
-			LocalPath:           app.Config.Tags.LocalDir,
-			TagDB:               app.Config.Tags.TagDB,
-			TagDBTimeout:        app.Config.Tags.TagDBTimeout.Value(),
-			TagDBChunkSize:      app.Config.Tags.TagDBChunkSize,
-			TagDBUpdateInterval: app.Config.Tags.TagDBUpdateInterval,
-		})
+		app.Tags = tags.New(tagsOptions(app.Config.Tags))
+		if app.Config.Prometheus.Enabled {
+			app.Tags.InitPrometheus(app.PromRegisterer)
+		}
 	}
 
 	if app.Config.Whisper.Enabled {
@@ -284,6 +557,10 @@ func (app *App) startPersister() {
 		p.SetWorkers(app.Config.Whisper.Workers)
 		p.SetHashFilenames(app.Config.Whisper.HashFilenames)
 
+		if app.Config.Prometheus.Enabled {
+			p.InitPrometheus(app.PromRegisterer)
+		}
+
 		if app.Tags != nil {
 			p.SetTagsEnabled(true)
 			p.SetTaggedFn(app.Tags.Add)
@@ -310,10 +587,23 @@ func (app *App) Start() (err error) {
 
 	runtime.GOMAXPROCS(conf.Common.MaxCPU)
 
+	if err = tracing.Setup(tracingOptions(conf.Tracing)); err != nil {
+		return
+	}
+
 	core := cache.New()
 	core.SetMaxSize(conf.Cache.MaxSize)
+	core.SetMaxMemory(conf.Cache.MaxMemory)
 	core.SetWriteStrategy(conf.Cache.WriteStrategy)
+	core.SetMaxTimeInCache(conf.Cache.MaxTimeInCache.Value())
 	core.SetTagsEnabled(conf.Tags.Enabled)
+	core.SetTagLimits(tagLimits(conf.Tags))
+	app.setCacheBackpressure(core)
+	app.setCachePointsPolicy(core)
+
+	if conf.Prometheus.Enabled {
+		core.InitPrometheus(app.PromRegisterer)
+	}
 
 	app.Cache = core
 
@@ -327,6 +617,10 @@ func (app *App) Start() (err error) {
 
 		grpcApi := api.New(core)
 
+		if conf.Prometheus.Enabled {
+			grpcApi.InitPrometheus(app.PromRegisterer)
+		}
+
 		if err = grpcApi.Listen(grpcAddr); err != nil {
 			return
 		}
@@ -349,14 +643,11 @@ func (app *App) Start() (err error) {
 			return
 		}
 
-		if rcv, err = receiver.New("udp", rcvOptions, core.Add); err != nil {
+		if rcv, err = receiver.New("udp", rcvOptions, tracing.Store("udp", core.Add)); err != nil {
 			return
 		}
 
-		app.Receivers = append(app.Receivers, &NamedReceiver{
-			Receiver: rcv,
-			Name:     "udp",
-		})
+		app.addReceiver("udp", rcv)
 	}
 	/* UDP end */
 
@@ -366,7 +657,7 @@ func (app *App) Start() (err error) {
 			return
 		}
 
-		if rcv, err = receiver.New("tcp", rcvOptions, core.Add); err != nil {
+		if rcv, err = receiver.New("tcp", rcvOptions, tracing.Store("tcp", core.Add)); err != nil {
 			return
 		}
 
@@ -374,10 +665,7 @@ func (app *App) Start() (err error) {
 			rcv.InitPrometheus(app.PromRegisterer)
 		}
 
-		app.Receivers = append(app.Receivers, &NamedReceiver{
-			Receiver: rcv,
-			Name:     "tcp",
-		})
+		app.addReceiver("tcp", rcv)
 	}
 	/* TCP end */
 
@@ -387,27 +675,25 @@ func (app *App) Start() (err error) {
 			return
 		}
 
-		if rcv, err = receiver.New("pickle", rcvOptions, core.Add); err != nil {
+		if rcv, err = receiver.New("pickle", rcvOptions, tracing.Store("pickle", core.Add)); err != nil {
 			return
 		}
 
-		app.Receivers = append(app.Receivers, &NamedReceiver{
-			Receiver: rcv,
-			Name:     "pickle",
-		})
+		app.addReceiver("pickle", rcv)
 	}
 	/* PICKLE end */
 
 	/* CUSTOM RECEIVERS start */
 	for receiverName, receiverOptions := range conf.Receiver {
-		if rcv, err = receiver.New(receiverName, receiverOptions, core.Add); err != nil {
+		if rcv, err = receiver.New(receiverName, receiverOptions, tracing.Store(receiverName, core.Add)); err != nil {
 			return
 		}
 
-		app.Receivers = append(app.Receivers, &NamedReceiver{
-			Receiver: rcv,
-			Name:     receiverName,
-		})
+		if conf.Prometheus.Enabled {
+			rcv.InitPrometheus(app.PromRegisterer)
+		}
+
+		app.addReceiver(receiverName, rcv)
 	}
 	/* CUSTOM RECEIVERS end */
 
@@ -437,9 +723,25 @@ func (app *App) Start() (err error) {
 		carbonserver.SetQueryCacheSizeMB(conf.Carbonserver.QueryCacheSizeMB)
 		carbonserver.SetTrigramIndex(conf.Carbonserver.TrigramIndex)
 		carbonserver.SetTrieIndex(conf.Carbonserver.TrieIndex)
+		carbonserver.SetTrieIndexSnapshot(conf.Carbonserver.TrieIndexSnapshot)
+		carbonserver.SetStreamRender(conf.Carbonserver.StreamRender)
+		carbonserver.SetFetchWorkers(conf.Carbonserver.FetchWorkers)
+		carbonserver.SetFetchRequestParallelism(conf.Carbonserver.FetchRequestParallelism)
 		carbonserver.SetInternalStatsDir(conf.Carbonserver.InternalStatsDir)
 		carbonserver.SetPercentiles(conf.Carbonserver.Percentiles)
-		// carbonserver.SetQueryTimeout(conf.Carbonserver.QueryTimeout.Value())
+		carbonserver.SetQueryTimeout(conf.Carbonserver.QueryTimeout.Value())
+		carbonserver.SetQueryTimeoutPartial(conf.Carbonserver.QueryTimeoutPartial)
+		carbonserver.SetAPILimits(apiLimits(conf.Carbonserver.APILimits), conf.Carbonserver.APILimitsClientHeader)
+		carbonserver.SetSlowQueryThresholds(slowQueryThresholds(conf.Carbonserver))
+		carbonserver.SetTopQueriesCapacity(conf.Carbonserver.TopQueriesCapacity)
+		carbonserver.SetSchemaFn(app.metricSchema)
+		if conf.Tags.Enabled && tagsOptions(conf.Tags).LocalEnabled() {
+			carbonserver.SetTagsHandler(http.HandlerFunc(app.tagsHandler))
+		}
+		if conf.Tags.Enabled {
+			carbonserver.SetTaggedDeleteFn(app.deleteTagged)
+			carbonserver.SetTagLimitsHandler(http.HandlerFunc(core.ServeTagLimits))
+		}
 
 		if conf.Prometheus.Enabled {
 			carbonserver.InitPrometheus(app.PromRegisterer)
@@ -465,6 +767,10 @@ func (app *App) Start() (err error) {
 		carbonlink.SetReadTimeout(conf.Carbonlink.ReadTimeout.Value())
 		// carbonlink.SetQueryTimeout(conf.Carbonlink.QueryTimeout.Value())
 
+		if conf.Prometheus.Enabled {
+			carbonlink.InitPrometheus(app.PromRegisterer)
+		}
+
 		if err = carbonlink.Listen(linkAddr); err != nil {
 			return
 		}
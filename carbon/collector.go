@@ -2,9 +2,9 @@ package carbon
 
 import (
 	"fmt"
-	"net"
-	"net/url"
+	"net/http"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -24,8 +24,10 @@ type Collector struct {
 	helper.Stoppable
 	graphPrefix    string
 	metricInterval time.Duration
-	endpoint       string
-	data           chan *points.Points
+	exporters      []chan []*points.Points
+	json           *jsonExporter
+	batch          []*points.Points // metrics of current collect
+	droppedBatches uint32           // batches not queued to slow exporters
 	stats          []statFunc
 	logger         *zap.Logger
 }
@@ -41,112 +43,23 @@ func NewCollector(app *App) *Collector {
 	c := &Collector{
 		graphPrefix:    app.Config.Common.GraphPrefix,
 		metricInterval: app.Config.Common.MetricInterval.Value(),
-		data:           make(chan *points.Points, 4096),
-		endpoint:       app.Config.Common.MetricEndpoint,
 		stats:          make([]statFunc, 0),
 	}
 
 	c.Start()
 
 	logger := zapwriter.Logger("stat")
+	c.logger = logger
 
-	endpoint, err := url.Parse(c.endpoint)
-	if err != nil {
-		logger.Error("metric-endpoint parse error", zap.Error(err))
-		c.endpoint = MetricEndpointLocal
-	}
-
-	logger = logger.With(zap.String("endpoint", c.endpoint))
-
-	if c.endpoint == MetricEndpointLocal {
-		// sender worker
-		storeFunc := app.Cache.Add
-
-		c.Go(func(exit chan bool) {
-			for {
-				select {
-				case <-exit:
-					return
-				case p := <-c.data:
-					storeFunc(p)
-				}
-			}
-		})
-	} else {
-		chunkSize := 32768
-		if endpoint.Scheme == "udp" {
-			chunkSize = 1000 // nc limitation (1024 for udp) and mtu friendly
-		}
-
-		c.Go(func(exit chan bool) {
-			points.Glue(exit, c.data, chunkSize, time.Second, func(chunk []byte) {
-
-				var conn net.Conn
-				var err error
-				defaultTimeout := 5 * time.Second
-
-				// send data to endpoint
-			SendLoop:
-				for {
-
-					// check exit
-					select {
-					case <-exit:
-						break SendLoop
-					default:
-						// pass
-					}
-
-					// close old broken connection
-					if conn != nil {
-						conn.Close()
-						conn = nil
-					}
-
-					conn, err = net.DialTimeout(endpoint.Scheme, endpoint.Host, defaultTimeout)
-					if err != nil {
-						logger.Error("dial failed", zap.Error(err))
-						time.Sleep(time.Second)
-						continue SendLoop
-					}
-
-					err = conn.SetDeadline(time.Now().Add(defaultTimeout))
-					if err != nil {
-						logger.Error("conn.SetDeadline failed", zap.Error(err))
-						time.Sleep(time.Second)
-						continue SendLoop
-					}
-
-					_, err := conn.Write(chunk)
-					if err != nil {
-						logger.Error("conn.Write failed", zap.Error(err))
-						time.Sleep(time.Second)
-						continue SendLoop
-					}
-
-					break SendLoop
-				}
-
-				if conn != nil {
-					conn.Close()
-					conn = nil
-				}
-			})
-		})
-
+	for _, conf := range metricExporters(app.Config) {
+		c.addExporter(app, conf)
 	}
 
 	sendCallback := func(moduleName string) func(metric string, value float64) {
 		return func(metric string, value float64) {
 			key := fmt.Sprintf("%s.%s.%s", c.graphPrefix, moduleName, metric)
 			logger.Info("collect", zap.String("metric", key), zap.Float64("value", value))
-			select {
-			case c.data <- points.NowPoint(key, value):
-				// pass
-			default:
-				logger.Warn("send queue is full. metric dropped",
-					zap.String("key", key), zap.Float64("value", value))
-			}
+			c.batch = append(c.batch, points.NowPoint(key, value))
 		}
 	}
 
@@ -160,6 +73,8 @@ func NewCollector(app *App) *Collector {
 		RuntimeStat(sendCallback("runtime"))
 	})
 
+	c.stats = append(c.stats, moduleCallback("collector", c))
+
 	if app.Cache != nil {
 		c.stats = append(c.stats, moduleCallback("cache", app.Cache))
 	}
@@ -204,8 +119,74 @@ func NewCollector(app *App) *Collector {
 	return c
 }
 
+func (c *Collector) addExporter(app *App, conf metricExporterConfig) {
+	logger := c.logger.With(zap.String("exporter", conf.Type))
+	if conf.URL != "" {
+		logger = logger.With(zap.String("endpoint", conf.URL))
+	}
+
+	var e exporter
+
+	switch conf.Type {
+	case ExporterLocal:
+		e = &localExporter{store: app.Cache.Add}
+	case ExporterPlain, ExporterPickle, ExporterProtobuf, ExporterStatsD:
+		e = newRelayExporter(conf.Type, conf.URL, logger)
+	case ExporterJSON:
+		if c.json == nil {
+			c.json = &jsonExporter{}
+		}
+		e = c.json
+	case ExporterPushgateway:
+		e = newPushgatewayExporter(conf.URL, conf.Job, logger)
+	default:
+		logger.Error("unknown metric exporter")
+		return
+	}
+
+	queue := make(chan []*points.Points, 16)
+	c.exporters = append(c.exporters, queue)
+
+	c.Go(func(exit chan bool) {
+		defer e.close()
+		for {
+			select {
+			case <-exit:
+				return
+			case batch := <-queue:
+				e.export(batch, exit)
+			}
+		}
+	})
+}
+
 func (c *Collector) collect() {
+	c.batch = nil
 	for _, stat := range c.stats {
 		stat()
 	}
+
+	for _, queue := range c.exporters {
+		select {
+		case queue <- c.batch:
+			// pass
+		default:
+			atomic.AddUint32(&c.droppedBatches, 1)
+			c.logger.Warn("send queue is full. metrics dropped", zap.Int("count", len(c.batch)))
+		}
+	}
+}
+
+// Stat sends internal stats of collector
+func (c *Collector) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("droppedBatches", &c.droppedBatches, send)
+}
+
+// ServeStats shows values of the last collect if json metric exporter is enabled
+func (c *Collector) ServeStats(w http.ResponseWriter, r *http.Request) {
+	if c.json == nil {
+		http.Error(w, "json metric exporter is disabled", http.StatusNotFound)
+		return
+	}
+	c.json.ServeHTTP(w, r)
 }
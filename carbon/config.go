@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/lomik/go-carbon/helper/tracing"
 	"github.com/lomik/go-carbon/persister"
 	"github.com/lomik/go-carbon/receiver/tcp"
 	"github.com/lomik/go-carbon/receiver/udp"
@@ -52,6 +53,12 @@ type commonConfig struct {
 	MaxCPU         int       `toml:"max-cpu"`
 }
 
+type metricExporterConfig struct {
+	Type string `toml:"type"`
+	URL  string `toml:"url"`
+	Job  string `toml:"job"` // pushgateway only
+}
+
 type whisperConfig struct {
 	DataDir                 string `toml:"data-dir"`
 	SchemasFilename         string `toml:"schemas-file"`
@@ -72,7 +79,14 @@ type whisperConfig struct {
 
 type cacheConfig struct {
 	MaxSize       uint32 `toml:"max-size"`
+	MaxMemory     uint64 `toml:"max-memory"`
 	WriteStrategy string `toml:"write-strategy"`
+
+	MaxTimeInCache *Duration `toml:"max-time-in-cache"`
+
+	Backpressure              bool   `toml:"backpressure"`
+	BackpressureHighWatermark uint32 `toml:"backpressure-high-watermark"`
+	BackpressureLowWatermark  uint32 `toml:"backpressure-low-watermark"`
 }
 
 type carbonlinkConfig struct {
@@ -90,6 +104,11 @@ type receiverConfig struct {
 	DSN string `toml:"dsn"`
 }
 
+type tagDBEndpointConfig struct {
+	URL  string `toml:"url"`
+	Mode string `toml:"mode"`
+}
+
 type tagsConfig struct {
 	Enabled             bool      `toml:"enabled"`
 	TagDB               string    `toml:"tagdb-url"`
@@ -97,6 +116,15 @@ type tagsConfig struct {
 	TagDBChunkSize      int       `toml:"tagdb-chunk-size"`
 	TagDBUpdateInterval uint64    `toml:"tagdb-update-interval"`
 	LocalDir            string    `toml:"local-dir"`
+
+	TagDBEndpoints []tagDBEndpointConfig `toml:"tagdb-endpoint"`
+
+	MaxTagValues      int            `toml:"max-tag-values"`
+	MaxTagValuesByTag map[string]int `toml:"max-tag-values-by-tag"`
+	MaxSeriesPerName  int            `toml:"max-series-per-name"`
+	LimitAction       string         `toml:"limit-action"`
+	LimitPlaceholder  string         `toml:"limit-placeholder"`
+	LimitExpire       *Duration      `toml:"limit-expire"`
 }
 
 type carbonserverConfig struct {
@@ -120,7 +148,33 @@ type carbonserverConfig struct {
 	MaxMetricsGlobbed  int `toml:"max-metrics-globbed"`
 	MaxMetricsRendered int `toml:"max-metrics-rendered"`
 
-	TrieIndex bool `toml:"trie-index"`
+	TrieIndex         bool   `toml:"trie-index"`
+	TrieIndexSnapshot string `toml:"trie-index-snapshot"`
+
+	StreamRender bool `toml:"stream-render"`
+
+	FetchWorkers            int `toml:"fetch-workers"`
+	FetchRequestParallelism int `toml:"fetch-request-parallelism"`
+
+	QueryTimeout        *Duration `toml:"query-timeout"`
+	QueryTimeoutPartial bool      `toml:"query-timeout-partial"`
+
+	APILimitsClientHeader string                                `toml:"api-limits-client-header"`
+	APILimits             map[string]carbonserverAPILimitConfig `toml:"api-limits"`
+
+	SlowQueryDuration  *Duration `toml:"slow-query-duration"`
+	SlowQueryFiles     int64     `toml:"slow-query-files"`
+	SlowQueryTrieNodes int64     `toml:"slow-query-trie-nodes"`
+	SlowQueryPoints    int64     `toml:"slow-query-points"`
+	SlowQueryBytes     int64     `toml:"slow-query-bytes"`
+	TopQueriesCapacity int       `toml:"top-queries-capacity"`
+}
+
+type carbonserverAPILimitConfig struct {
+	Rate             float64 `toml:"rate"`
+	Burst            int     `toml:"burst"`
+	MaxInflight      int     `toml:"max-inflight"`
+	MaxInflightTotal int     `toml:"max-inflight-total"`
 }
 
 type pprofConfig struct {
@@ -140,6 +194,16 @@ type prometheusConfig struct {
 	Labels   map[string]string `toml:"labels"`
 }
 
+type tracingConfig struct {
+	Enabled          bool    `toml:"enabled"`
+	QuerySampleRate  float64 `toml:"query-sample-rate"`
+	IngestSampleRate float64 `toml:"ingest-sample-rate"`
+	Exporter         string  `toml:"exporter"`
+	Endpoint         string  `toml:"endpoint"`
+	Path             string  `toml:"path"`
+	ServiceName      string  `toml:"service-name"`
+}
+
 // Config ...
 type Config struct {
 	Common       commonConfig                        `toml:"common"`
@@ -157,6 +221,9 @@ type Config struct {
 	Pprof        pprofConfig                         `toml:"pprof"`
 	Logging      []zapwriter.Config                  `toml:"logging"`
 	Prometheus   prometheusConfig                    `toml:"prometheus"`
+	Tracing      tracingConfig                       `toml:"tracing"`
+
+	MetricExporters []metricExporterConfig `toml:"metric-exporter"`
 }
 
 func NewLoggingConfig() zapwriter.Config {
@@ -190,7 +257,14 @@ func NewConfig() *Config {
 		},
 		Cache: cacheConfig{
 			MaxSize:       1000000,
+			MaxMemory:     0,
 			WriteStrategy: "max",
+			MaxTimeInCache: &Duration{
+				Duration: time.Hour,
+			},
+			Backpressure:              false,
+			BackpressureHighWatermark: 90,
+			BackpressureLowWatermark:  70,
 		},
 		Udp:    udp.NewOptions(),
 		Tcp:    tcp.NewOptions(),
@@ -220,6 +294,14 @@ func NewConfig() *Config {
 			TrigramIndex:       true,
 			MaxMetricsGlobbed:  30000,
 			MaxMetricsRendered: 1000,
+
+			FetchRequestParallelism: 4,
+			QueryTimeout: &Duration{
+				Duration: 0,
+			},
+			SlowQueryDuration: &Duration{
+				Duration: 0,
+			},
 		},
 		Carbonlink: carbonlinkConfig{
 			Listen:  "127.0.0.1:7002",
@@ -241,6 +323,11 @@ func NewConfig() *Config {
 			TagDBChunkSize:      32,
 			TagDBUpdateInterval: 100,
 			LocalDir:            "/var/lib/graphite/tagging/",
+			LimitAction:         "drop",
+			LimitPlaceholder:    "_over_limit_",
+			LimitExpire: &Duration{
+				Duration: 24 * time.Hour,
+			},
 		},
 		Pprof: pprofConfig{
 			Listen:  "127.0.0.1:7007",
@@ -254,6 +341,15 @@ func NewConfig() *Config {
 			Endpoint: "/metrics",
 			Labels:   make(map[string]string),
 		},
+		Tracing: tracingConfig{
+			Enabled:          false,
+			QuerySampleRate:  0.01,
+			IngestSampleRate: 0.0001,
+			Exporter:         tracing.ExporterOTLP,
+			Endpoint:         tracing.DefaultOTLPEndpoint,
+			Path:             "/var/log/go-carbon/traces.json",
+			ServiceName:      tracing.DefaultServiceName,
+		},
 		Logging: nil,
 	}
 
@@ -0,0 +1,354 @@
+package carbon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	pickle "github.com/lomik/graphite-pickle"
+
+	"github.com/lomik/go-carbon/helper/carbonpb"
+	"github.com/lomik/go-carbon/points"
+)
+
+// Types of internal metrics exporters
+const (
+	ExporterLocal       = "local"
+	ExporterPlain       = "plain"
+	ExporterPickle      = "pickle"
+	ExporterProtobuf    = "protobuf"
+	ExporterJSON        = "json"
+	ExporterPushgateway = "pushgateway"
+	ExporterStatsD      = "statsd"
+)
+
+// exporter sends internal metrics collected on one tick of collector. Every exporter
+// has own worker, so slow exporter doesn't delay others
+type exporter interface {
+	// export could be interrupted by exit
+	export(batch []*points.Points, exit chan bool)
+	close()
+}
+
+func checkMetricExporter(conf metricExporterConfig) error {
+	switch conf.Type {
+	case ExporterPlain, ExporterPickle, ExporterProtobuf:
+		u, err := url.Parse(conf.URL)
+		if err != nil {
+			return fmt.Errorf("metric-exporter url parse error: %s", err.Error())
+		}
+		if u.Scheme != "tcp" && (u.Scheme != "udp" || conf.Type != ExporterPlain) {
+			return fmt.Errorf("metric-exporter %#v supports only tcp protocol (and udp for plain). %#v is unsupported", conf.Type, u.Scheme)
+		}
+	case ExporterStatsD:
+		u, err := url.Parse(conf.URL)
+		if err != nil {
+			return fmt.Errorf("metric-exporter url parse error: %s", err.Error())
+		}
+		if u.Scheme != "udp" {
+			return fmt.Errorf("metric-exporter statsd url should be udp, got %#v", conf.URL)
+		}
+	case ExporterPushgateway:
+		u, err := url.Parse(conf.URL)
+		if err != nil {
+			return fmt.Errorf("metric-exporter url parse error: %s", err.Error())
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("metric-exporter pushgateway url should be http or https, got %#v", conf.URL)
+		}
+	case ExporterLocal, ExporterJSON:
+	default:
+		return fmt.Errorf("go-carbon support only \"local\", \"plain\", \"pickle\", \"protobuf\", \"json\", \"pushgateway\" or \"statsd\" metric-exporter, got %#v", conf.Type)
+	}
+	return nil
+}
+
+// metricExporters returns metric-endpoint of common section and all metric-exporter
+func metricExporters(cfg *Config) []metricExporterConfig {
+	res := make([]metricExporterConfig, 0, len(cfg.MetricExporters)+1)
+	if cfg.Common.MetricEndpoint == MetricEndpointLocal {
+		res = append(res, metricExporterConfig{Type: ExporterLocal})
+	} else {
+		res = append(res, metricExporterConfig{Type: ExporterPlain, URL: cfg.Common.MetricEndpoint})
+	}
+	return append(res, cfg.MetricExporters...)
+}
+
+type localExporter struct {
+	store func(*points.Points)
+}
+
+func (e *localExporter) export(batch []*points.Points, exit chan bool) {
+	for _, p := range batch {
+		e.store(p)
+	}
+}
+
+func (e *localExporter) close() {}
+
+// relayExporter sends metrics to carbon relay over persistent connection. StatsD
+// gauges are sent by the same way over udp
+type relayExporter struct {
+	format    string
+	network   string
+	address   string
+	chunkSize int // max size of plain chunk in bytes or number of metrics in message
+	timeout   time.Duration
+	logger    *zap.Logger
+
+	conn net.Conn
+}
+
+func newRelayExporter(format, endpoint string, logger *zap.Logger) *relayExporter {
+	u, _ := url.Parse(endpoint) // already checked in app.configure
+
+	e := &relayExporter{
+		format:    format,
+		network:   u.Scheme,
+		address:   u.Host,
+		chunkSize: 32768,
+		timeout:   5 * time.Second,
+		logger:    logger,
+	}
+	if format != ExporterPlain && format != ExporterStatsD {
+		e.chunkSize = 1000
+	} else if u.Scheme == "udp" {
+		e.chunkSize = 1000 // nc limitation (1024 for udp) and mtu friendly
+	}
+	return e
+}
+
+// chunks encodes batch to messages of relay protocol
+func (e *relayExporter) chunks(batch []*points.Points) ([][]byte, error) {
+	var res [][]byte
+
+	if e.format == ExporterPlain || e.format == ExporterStatsD {
+		var buf bytes.Buffer
+		for _, p := range batch {
+			var line bytes.Buffer
+			if e.format == ExporterStatsD {
+				writeStatsDGauge(&line, p)
+			} else {
+				p.WriteTo(&line)
+			}
+			if buf.Len() > 0 && buf.Len()+line.Len() > e.chunkSize {
+				res = append(res, append([]byte{}, buf.Bytes()...))
+				buf.Reset()
+			}
+			buf.Write(line.Bytes())
+		}
+		if buf.Len() > 0 {
+			res = append(res, buf.Bytes())
+		}
+		return res, nil
+	}
+
+	for len(batch) > 0 {
+		chunk := batch
+		if len(chunk) > e.chunkSize {
+			chunk = chunk[:e.chunkSize]
+		}
+		batch = batch[len(chunk):]
+
+		var msg []byte
+		var err error
+		if e.format == ExporterPickle {
+			msgs := make([]pickle.Message, 0, len(chunk))
+			for _, p := range chunk {
+				m := pickle.Message{Name: p.Metric}
+				for _, d := range p.Data {
+					m.Points = append(m.Points, pickle.DataPoint{Timestamp: d.Timestamp, Value: d.Value})
+				}
+				msgs = append(msgs, m)
+			}
+			msg, err = pickle.MarshalMessages(msgs)
+		} else {
+			payload := &carbonpb.Payload{Metrics: make([]*carbonpb.Metric, 0, len(chunk))}
+			for _, p := range chunk {
+				m := &carbonpb.Metric{Metric: p.Metric}
+				for _, d := range p.Data {
+					m.Points = append(m.Points, carbonpb.Point{Timestamp: uint32(d.Timestamp), Value: d.Value})
+				}
+				payload.Metrics = append(payload.Metrics, m)
+			}
+			msg, err = payload.Marshal()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// 4 bytes of message length, same as tcp receiver expects
+		framed := make([]byte, 4+len(msg))
+		binary.BigEndian.PutUint32(framed, uint32(len(msg)))
+		copy(framed[4:], msg)
+		res = append(res, framed)
+	}
+	return res, nil
+}
+
+// writeStatsDGauge writes the last value of metric as StatsD gauge. Sign of value means
+// change of gauge in StatsD, so negative value is sent after reset to zero
+func writeStatsDGauge(w *bytes.Buffer, p *points.Points) {
+	value := p.Data[len(p.Data)-1].Value
+	if value < 0 {
+		fmt.Fprintf(w, "%s:0|g\n", p.Metric)
+	}
+	fmt.Fprintf(w, "%s:%s|g\n", p.Metric, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (e *relayExporter) export(batch []*points.Points, exit chan bool) {
+	chunks, err := e.chunks(batch)
+	if err != nil {
+		e.logger.Error("encode failed", zap.Error(err))
+		return
+	}
+	for _, chunk := range chunks {
+		if !e.send(chunk, exit) {
+			return
+		}
+	}
+}
+
+// send writes chunk, reconnecting until success or exit
+func (e *relayExporter) send(chunk []byte, exit chan bool) bool {
+	for {
+		select {
+		case <-exit:
+			return false
+		default:
+			// pass
+		}
+
+		if e.conn == nil {
+			conn, err := net.DialTimeout(e.network, e.address, e.timeout)
+			if err != nil {
+				e.logger.Error("dial failed", zap.Error(err))
+				time.Sleep(time.Second)
+				continue
+			}
+			e.conn = conn
+		}
+
+		err := e.conn.SetDeadline(time.Now().Add(e.timeout))
+		if err == nil {
+			_, err = e.conn.Write(chunk)
+		}
+		if err != nil {
+			e.logger.Error("conn.Write failed", zap.Error(err))
+			// close old broken connection
+			e.close()
+			time.Sleep(time.Second)
+			continue
+		}
+		return true
+	}
+}
+
+func (e *relayExporter) close() {
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+}
+
+// jsonExporter keeps values of the last collect for /debug/stats
+type jsonExporter struct {
+	sync.Mutex
+	values map[string]float64
+}
+
+func (e *jsonExporter) close() {}
+
+func (e *jsonExporter) export(batch []*points.Points, exit chan bool) {
+	values := make(map[string]float64, len(batch))
+	for _, p := range batch {
+		values[p.Metric] = p.Data[len(p.Data)-1].Value
+	}
+	e.Lock()
+	e.values = values
+	e.Unlock()
+}
+
+func (e *jsonExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	values := e.values
+	e.Unlock()
+
+	if values == nil {
+		values = map[string]float64{}
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// pushgatewayExporter replaces metrics of job in Prometheus pushgateway
+type pushgatewayExporter struct {
+	url    string
+	client *http.Client
+	logger *zap.Logger
+}
+
+func newPushgatewayExporter(endpoint, job string, logger *zap.Logger) *pushgatewayExporter {
+	if job == "" {
+		job = "go-carbon"
+	}
+	return &pushgatewayExporter{
+		url:    strings.TrimRight(endpoint, "/") + "/metrics/job/" + url.PathEscape(job),
+		client: &http.Client{Timeout: 5 * time.Second},
+		logger: logger,
+	}
+}
+
+// promName converts graphite metric name to Prometheus metric name
+func promName(metric string) string {
+	b := []byte(metric)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func (e *pushgatewayExporter) close() {}
+
+func (e *pushgatewayExporter) export(batch []*points.Points, exit chan bool) {
+	var body bytes.Buffer
+	for _, p := range batch {
+		fmt.Fprintf(&body, "%s %v\n", promName(p.Metric), p.Data[len(p.Data)-1].Value)
+	}
+
+	req, err := http.NewRequest("PUT", e.url, &body)
+	if err != nil {
+		e.logger.Error("push failed", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.logger.Error("push failed", zap.Error(err))
+		return
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		e.logger.Error("push failed", zap.Int("status-code", resp.StatusCode))
+	}
+}
@@ -0,0 +1,166 @@
+package carbon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver/parse"
+)
+
+func TestRelayExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	batch := []*points.Points{
+		points.OnePoint("carbon.agents.host.cache.size", 42, 1000),
+		points.OnePoint("carbon.agents.host.cache.metrics", 15, 1000),
+	}
+
+	for _, format := range []string{ExporterPlain, ExporterPickle, ExporterProtobuf} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(err)
+
+		received := make(chan []*points.Points, 10)
+		connections := 0
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				connections++
+				go func() {
+					defer conn.Close()
+					r := bufio.NewReader(conn)
+					for {
+						var res []*points.Points
+						if format == ExporterPlain {
+							line, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							p, err := points.ParseText(line)
+							assert.NoError(err)
+							res = []*points.Points{p}
+						} else {
+							var size uint32
+							if binary.Read(r, binary.BigEndian, &size) != nil {
+								return
+							}
+							msg := make([]byte, size)
+							if _, err := io.ReadFull(r, msg); err != nil {
+								return
+							}
+							if format == ExporterPickle {
+								res, err = parse.Pickle(msg)
+							} else {
+								res, err = parse.Protobuf(msg)
+							}
+							assert.NoError(err)
+						}
+						received <- res
+					}
+				}()
+			}
+		}()
+
+		e := newRelayExporter(format, "tcp://"+ln.Addr().String(), zap.NewNop())
+		exit := make(chan bool)
+		e.export(batch, exit)
+		e.export(batch, exit)
+
+		var got []*points.Points
+		for len(got) < 4 {
+			got = append(got, <-received...)
+		}
+		for i, p := range got {
+			assert.True(p.Eq(batch[i%2]), format)
+		}
+		// connection is reused
+		assert.Equal(1, connections, format)
+
+		e.close()
+		ln.Close()
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &jsonExporter{}
+	e.export([]*points.Points{points.OnePoint("carbon.agents.host.cache.size", 42, 1000)}, nil)
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/stats", nil))
+	assert.Equal(`{"carbon.agents.host.cache.size":42}`, rr.Body.String())
+}
+
+func TestPushgatewayExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	var path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		path, body = r.Method+" "+r.URL.Path, string(b)
+	}))
+	defer srv.Close()
+
+	e := newPushgatewayExporter(srv.URL, "", zap.NewNop())
+	e.export([]*points.Points{
+		points.OnePoint("carbon.agents.host-1.cache.size", 42, 1000),
+		points.OnePoint("1.metric", 0.5, 1000),
+	}, nil)
+
+	assert.Equal("PUT /metrics/job/go-carbon", path)
+	assert.Equal("carbon_agents_host_1_cache_size 42\n__metric 0.5\n", body)
+}
+
+func TestStatsDExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(checkMetricExporter(metricExporterConfig{Type: ExporterStatsD, URL: "tcp://127.0.0.1:8125"}))
+	assert.NoError(checkMetricExporter(metricExporterConfig{Type: ExporterStatsD, URL: "udp://127.0.0.1:8125"}))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	e := newRelayExporter(ExporterStatsD, "udp://"+conn.LocalAddr().String(), zap.NewNop())
+	defer e.close()
+	e.export([]*points.Points{
+		points.OnePoint("carbon.agents.host.cache.size", 42, 1000),
+		points.OnePoint("carbon.agents.host.cache.rate", -0.5, 1000),
+	}, make(chan bool))
+
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(err)
+	assert.Equal("carbon.agents.host.cache.size:42|g\ncarbon.agents.host.cache.rate:0|g\ncarbon.agents.host.cache.rate:-0.5|g\n", string(buf[:n]))
+}
+
+func TestCollectorDroppedBatches(t *testing.T) {
+	c := &Collector{
+		exporters: []chan []*points.Points{make(chan []*points.Points, 1)},
+		logger:    zap.NewNop(),
+	}
+	c.stats = append(c.stats, func() { c.batch = append(c.batch, points.NowPoint("metric", 1)) })
+
+	c.collect()
+	c.collect()
+	c.collect()
+
+	stat := make(map[string]float64)
+	c.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(t, float64(2), stat["droppedBatches"])
+}
@@ -0,0 +1,83 @@
+package carbon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestPrometheusReload(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		configFile := TestConfig(root)
+
+		cfg := NewConfig()
+		_, err := toml.DecodeFile(configFile, cfg)
+		assert.NoError(err)
+		cfg.Udp.Listen = "127.0.0.1:0"
+		cfg.Tcp.Listen = "127.0.0.1:0"
+		cfg.Pickle.Listen = "127.0.0.1:0"
+		cfg.Carbonserver.Enabled = false
+		cfg.Prometheus.Enabled = true
+		cfg.Tags.Enabled = true
+		cfg.Tags.TagDB = "local"
+		cfg.Tags.LocalDir = root + "/tagging"
+		cfg.Grpc.Enabled = true
+		cfg.Grpc.Listen = "127.0.0.1:0"
+		cfg.Carbonlink.Enabled = true
+		cfg.Carbonlink.Listen = "127.0.0.1:0"
+
+		buf := new(bytes.Buffer)
+		assert.NoError(toml.NewEncoder(buf).Encode(cfg))
+		assert.NoError(ioutil.WriteFile(configFile, buf.Bytes(), 0644))
+
+		reg := prometheus.NewRegistry()
+		app := New(configFile)
+		app.PromRegisterer = reg
+
+		assert.NoError(app.ParseConfig())
+		if !assert.NoError(app.Start()) {
+			return
+		}
+		defer app.Stop()
+
+		// persister and tags are re-created and should re-register own metrics
+		assert.NoError(app.ReloadConfig())
+		assert.NoError(app.ReloadConfig())
+
+		app.Cache.Add(points.OnePoint("hello.world", 42, 10))
+
+		families, err := reg.Gather()
+		assert.NoError(err)
+
+		values := make(map[string]float64)
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				if m.GetGauge() != nil {
+					values[f.GetName()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+
+		assert.Equal(float64(1), values["cache_size"])
+		assert.Equal(float64(1), values["cache_metrics"])
+		assert.Contains(values, "persister_workers")
+		assert.Contains(values, "tags_queue_lag_seconds")
+
+		names := make(map[string]bool)
+		for _, f := range families {
+			names[f.GetName()] = true
+		}
+		assert.True(names["grpc_cache_requests_total"])
+		assert.True(names["tags_queue_puts_total"])
+		assert.True(names["persister_update_duration_seconds_exp"], "%v", names)
+	})
+}
@@ -0,0 +1,180 @@
+package carbonserver
+
+import (
+	"errors"
+	"math"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// fetchOptions are per-target fetch settings passed with render request
+type fetchOptions struct {
+	consolidation consolidation
+
+	// resolution forces archive with the smallest step >= resolution. 0 - archive is
+	// selected by from time
+	resolution int32
+	// stitch returns data of the most precise archive available for every part of
+	// the time range, upsampled to the step of the first archive
+	stitch bool
+
+	// format of response, used to account query cache hit ratio
+	format responseFormat
+}
+
+// timeSeries is implemented by *whisper.TimeSeries and series prepared by carbonserver
+type timeSeries interface {
+	FromTime() int
+	UntilTime() int
+	Step() int
+	Values() []float64
+}
+
+type archiveSeries struct {
+	fromTime  int
+	untilTime int
+	step      int
+	values    []float64
+}
+
+func (s *archiveSeries) FromTime() int     { return s.fromTime }
+func (s *archiveSeries) UntilTime() int    { return s.untilTime }
+func (s *archiveSeries) Step() int         { return s.step }
+func (s *archiveSeries) Values() []float64 { return s.values }
+func (s *archiveSeries) valueAt(t int) float64 {
+	if t < s.fromTime {
+		return math.NaN()
+	}
+	index := (t - s.fromTime) / s.step
+	if index >= len(s.values) {
+		return math.NaN()
+	}
+	return s.values[index]
+}
+
+// newArchiveSeries makes empty series for time range aligned same way as whisper does
+func newArchiveSeries(fromTime, untilTime, step int) *archiveSeries {
+	s := &archiveSeries{
+		fromTime:  fromTime - mod(fromTime, step) + step,
+		untilTime: untilTime - mod(untilTime, step) + step,
+		step:      step,
+	}
+	s.values = make([]float64, (s.untilTime-s.fromTime)/step)
+	for i := range s.values {
+		s.values[i] = math.NaN()
+	}
+	return s
+}
+
+func mod(a, b int) int {
+	return a - (b * int(math.Floor(float64(a)/float64(b))))
+}
+
+// selectArchiveByResolution returns index of archive with the smallest step >= resolution
+// or the least precise archive
+func selectArchiveByResolution(retentions []whisper.Retention, resolution int32) int {
+	for i, retention := range retentions {
+		if int32(retention.SecondsPerPoint()) >= resolution {
+			return i
+		}
+	}
+	return len(retentions) - 1
+}
+
+// fetchArchive fetches points of specified archive. whisper.Fetch selects archive by
+// from time only, so time range is extended for less precise archives and truncated
+// for more precise archives. Result is aligned to archive step and covers the whole
+// requested range, points not stored in the archive are absent.
+func fetchArchive(w *whisper.Whisper, retentions []whisper.Retention, archive int, now, fromTime, untilTime int) (*archiveSeries, error) {
+	oldest := now - retentions[len(retentions)-1].MaxRetention()
+	if fromTime < oldest {
+		fromTime = oldest
+	}
+	if untilTime > now {
+		untilTime = now
+	}
+	if fromTime > untilTime {
+		return nil, errors.New("time range not found")
+	}
+
+	res := newArchiveSeries(fromTime, untilTime, retentions[archive].SecondsPerPoint())
+
+	fetchFrom := fromTime
+	if archive > 0 && now-fetchFrom <= retentions[archive-1].MaxRetention() {
+		fetchFrom = now - retentions[archive-1].MaxRetention() - 1
+	}
+	if now-fetchFrom > retentions[archive].MaxRetention() {
+		fetchFrom = now - retentions[archive].MaxRetention()
+	}
+	if fetchFrom > untilTime {
+		// archive doesn't contain requested range
+		return res, nil
+	}
+
+	points, err := w.Fetch(fetchFrom, untilTime)
+	if err != nil {
+		return nil, err
+	}
+	if points == nil {
+		return nil, errors.New("time range not found")
+	}
+
+	src := &archiveSeries{
+		fromTime:  points.FromTime(),
+		untilTime: points.UntilTime(),
+		step:      points.Step(),
+		values:    points.Values(),
+	}
+	for i := range res.values {
+		res.values[i] = src.valueAt(res.fromTime + i*res.step)
+	}
+
+	return res, nil
+}
+
+// fetchStitched fetches every part of the time range from the most precise archive
+// which contains it. Values of less precise archives are repeated to match step of
+// the first archive.
+func fetchStitched(w *whisper.Whisper, retentions []whisper.Retention, now, fromTime, untilTime int) (*archiveSeries, error) {
+	if untilTime > now {
+		untilTime = now
+	}
+	oldest := now - retentions[len(retentions)-1].MaxRetention()
+	if fromTime < oldest {
+		fromTime = oldest
+	}
+	if fromTime > untilTime {
+		return nil, errors.New("time range not found")
+	}
+
+	res := newArchiveSeries(fromTime, untilTime, retentions[0].SecondsPerPoint())
+
+	// from least precise to most precise archive, so precise points win on boundaries
+	for i := len(retentions) - 1; i >= 0; i-- {
+		segmentFrom := fromTime
+		if now-segmentFrom > retentions[i].MaxRetention() {
+			segmentFrom = now - retentions[i].MaxRetention()
+		}
+		segmentUntil := untilTime
+		if i > 0 && segmentUntil > now-retentions[i-1].MaxRetention() {
+			segmentUntil = now - retentions[i-1].MaxRetention()
+		}
+		if segmentFrom > segmentUntil || (i > 0 && segmentFrom == segmentUntil) {
+			// covered by more precise archives or out of requested range
+			continue
+		}
+
+		segment, err := fetchArchive(w, retentions, i, now, segmentFrom, segmentUntil)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := range res.values {
+			if v := segment.valueAt(res.fromTime + j*res.step); !math.IsNaN(v) {
+				res.values[j] = v
+			}
+		}
+	}
+
+	return res, nil
+}
@@ -38,6 +38,8 @@ import (
 	"time"
 
 	prom "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/NYTimes/gziphandler"
@@ -47,6 +49,7 @@ import (
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"github.com/lomik/go-carbon/helper"
 	"github.com/lomik/go-carbon/helper/stat"
+	"github.com/lomik/go-carbon/helper/tracing"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/zapwriter"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -86,6 +89,11 @@ type metricStruct struct {
 	QueryCacheMiss       uint64
 	FindCacheHit         uint64
 	FindCacheMiss        uint64
+	CancelledRequests    uint64
+	TimeoutRequests      uint64
+	FetchesCancelled     uint64
+	SlowQueries          uint64
+	TaggedSeriesDeleted  uint64
 }
 
 type requestsTimes struct {
@@ -161,6 +169,10 @@ func TraceContextToZap(ctx context.Context, logger *zap.Logger) *zap.Logger {
 		}
 	}
 
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		logger = logger.With(zap.String("trace_id", sc.TraceID().String()))
+	}
+
 	return logger
 }
 
@@ -174,16 +186,21 @@ func TraceHandler(h http.HandlerFunc, globalStatusCodes []uint64, handlerStatusC
 			}
 		}
 
+		endpoint := path.Clean(req.URL.Path)
+		req, span := tracing.StartHTTPSpan(req.WithContext(ctx), "carbonserver"+endpoint)
+
 		lrw := newResponseWriterWithStatus(rw)
 
-		h.ServeHTTP(lrw, req.WithContext(ctx))
+		h.ServeHTTP(lrw, req)
+
+		span.SetAttributes(attribute.Int("http.status_code", lrw.statusCode))
+		span.End()
 
 		if lrw.statusCodeMajor() < len(globalStatusCodes) {
 			atomic.AddUint64(&globalStatusCodes[lrw.statusCodeMajor()], 1)
 			atomic.AddUint64(&handlerStatusCodes[lrw.statusCodeMajor()], 1)
 		}
 
-		endpoint := path.Clean(req.URL.Path)
 		promRequest(endpoint, lrw.statusCode)
 	})
 }
@@ -256,6 +273,9 @@ type CarbonserverListener struct {
 	maxMetricsGlobbed  int
 	maxMetricsRendered int
 
+	// series cache requests by response format
+	queryCacheFormatStats [protoV3Format + 1]queryCacheFormatStat
+
 	queryCacheEnabled bool
 	queryCacheSizeMB  int
 	queryCache        queryCache
@@ -263,6 +283,32 @@ type CarbonserverListener struct {
 	findCache         queryCache
 	trigramIndex      bool
 	trieIndex         bool
+	trieSnapshot      string
+	streamRender      bool
+
+	fetchWorkers            int
+	fetchRequestParallelism int
+	fetchPool               *fetchPool
+
+	queryTimeout        time.Duration
+	queryTimeoutPartial bool
+
+	apiLimiters           map[string]*apiLimiter
+	apiLimitsClientHeader string
+
+	slowQueryLogger     *zap.Logger
+	slowQueryThresholds QueryCostThresholds
+	topQueries          *topQueries
+
+	// tagsHandler serves /tags/ API of local TagDB
+	tagsHandler http.Handler
+	// tagLimitsHandler serves /admin/taglimits
+	tagLimitsHandler http.Handler
+	// taggedDeleteFn is called for tagged series removed since the previous file scan
+	taggedDeleteFn func(series string)
+	taggedSeries   map[string]struct{}
+	// schemaFn returns storage schema of metric for find requests with details
+	schemaFn func(metric string) (MetricSchema, bool)
 
 	fileIdx      atomic.Value
 	fileIdxMutex sync.Mutex
@@ -301,6 +347,14 @@ type prometheus struct {
 	diskWaitDurations prom.Histogram
 	diskWaitDuration  func(time.Duration)
 
+	fetchQueueWaits  prom.Histogram
+	fetchQueueWait   func(time.Duration)
+	fetchIODurations prom.Histogram
+	fetchIODuration  func(time.Duration)
+
+	limitedRequests *prom.CounterVec
+	limitedRequest  func(string, string, string)
+
 	returnedMetrics prom.Counter
 	returnedMetric  func()
 	returnedPoints  prom.Counter
@@ -364,6 +418,29 @@ func (c *CarbonserverListener) InitPrometheus(reg prom.Registerer) {
 			},
 		),
 
+		fetchQueueWaits: prom.NewHistogram(
+			prom.HistogramOpts{
+				Name:    "fetch_queue_wait_seconds_exp",
+				Help:    "Time spent by fetches in worker pool queue (exponential buckets)",
+				Buckets: prom.ExponentialBuckets(time.Millisecond.Seconds(), 2.0, 20),
+			},
+		),
+		fetchIODurations: prom.NewHistogram(
+			prom.HistogramOpts{
+				Name:    "fetch_io_seconds_exp",
+				Help:    "Duration of single metric fetch by worker pool (exponential buckets)",
+				Buckets: prom.ExponentialBuckets(time.Millisecond.Seconds(), 2.0, 20),
+			},
+		),
+
+		limitedRequests: prom.NewCounterVec(
+			prom.CounterOpts{
+				Name: "limited_requests_total",
+				Help: "Requests rejected by api limits, partitioned by handler, client and reason",
+			},
+			[]string{"handler", "client", "reason"},
+		),
+
 		returnedMetrics: prom.NewCounter(prom.CounterOpts{
 			Name: "returned_metrics_total",
 			Help: "Number of metrics returned",
@@ -379,7 +456,7 @@ func (c *CarbonserverListener) InitPrometheus(reg prom.Registerer) {
 	}
 
 	c.prometheus.cacheRequest = func(kind string, hit bool) {
-		c.prometheus.cacheRequests.WithLabelValues(kind, strconv.FormatBool(hit))
+		c.prometheus.cacheRequests.WithLabelValues(kind, strconv.FormatBool(hit)).Inc()
 	}
 
 	c.prometheus.duration = func(t time.Duration) {
@@ -394,10 +471,30 @@ func (c *CarbonserverListener) InitPrometheus(reg prom.Registerer) {
 		c.prometheus.diskRequests.Inc()
 	}
 
+	c.prometheus.cancelledRequest = func() {
+		c.prometheus.cancelledRequests.Inc()
+	}
+
+	c.prometheus.timeoutRequest = func() {
+		c.prometheus.timeoutRequests.Inc()
+	}
+
 	c.prometheus.diskWaitDuration = func(t time.Duration) {
 		c.prometheus.diskWaitDurations.Observe(t.Seconds())
 	}
 
+	c.prometheus.fetchQueueWait = func(t time.Duration) {
+		c.prometheus.fetchQueueWaits.Observe(t.Seconds())
+	}
+
+	c.prometheus.fetchIODuration = func(t time.Duration) {
+		c.prometheus.fetchIODurations.Observe(t.Seconds())
+	}
+
+	c.prometheus.limitedRequest = func(endpoint, client, reason string) {
+		c.prometheus.limitedRequests.WithLabelValues(endpoint, client, reason).Inc()
+	}
+
 	c.prometheus.returnedMetric = func() {
 		c.prometheus.returnedMetrics.Inc()
 	}
@@ -413,6 +510,9 @@ func (c *CarbonserverListener) InitPrometheus(reg prom.Registerer) {
 	reg.MustRegister(c.prometheus.durations)
 	reg.MustRegister(c.prometheus.diskRequests)
 	reg.MustRegister(c.prometheus.diskWaitDurations)
+	reg.MustRegister(c.prometheus.fetchQueueWaits)
+	reg.MustRegister(c.prometheus.fetchIODurations)
+	reg.MustRegister(c.prometheus.limitedRequests)
 	reg.MustRegister(c.prometheus.returnedMetrics)
 	reg.MustRegister(c.prometheus.returnedPoints)
 }
@@ -455,6 +555,7 @@ func NewCarbonserverListener(cacheGetFunc func(key string) []points.Point) *Carb
 		cacheGet:          cacheGetFunc,
 		logger:            zapwriter.Logger("carbonserver"),
 		accessLogger:      zapwriter.Logger("access"),
+		slowQueryLogger:   zapwriter.Logger("slow_query"),
 		findCache:         queryCache{ec: expirecache.New(0)},
 		trigramIndex:      true,
 		percentiles:       []int{100, 99, 98, 95, 75, 50},
@@ -467,6 +568,9 @@ func NewCarbonserverListener(cacheGetFunc func(key string) []points.Point) *Carb
 			cancelledRequest: func() {},
 			timeoutRequest:   func() {},
 			diskWaitDuration: func(time.Duration) {},
+			fetchQueueWait:   func(time.Duration) {},
+			fetchIODuration:  func(time.Duration) {},
+			limitedRequest:   func(string, string, string) {},
 			returnedMetric:   func() {},
 			returnedPoint:    func(int) {},
 		},
@@ -500,6 +604,12 @@ func (listener *CarbonserverListener) SetScanFrequency(scanFrequency time.Durati
 func (listener *CarbonserverListener) SetReadTimeout(readTimeout time.Duration) {
 	listener.readTimeout = readTimeout
 }
+func (listener *CarbonserverListener) SetQueryTimeout(queryTimeout time.Duration) {
+	listener.queryTimeout = queryTimeout
+}
+func (listener *CarbonserverListener) SetQueryTimeoutPartial(partial bool) {
+	listener.queryTimeoutPartial = partial
+}
 func (listener *CarbonserverListener) SetIdleTimeout(idleTimeout time.Duration) {
 	listener.idleTimeout = idleTimeout
 }
@@ -530,6 +640,30 @@ func (listener *CarbonserverListener) SetTrigramIndex(enabled bool) {
 func (listener *CarbonserverListener) SetTrieIndex(enabled bool) {
 	listener.trieIndex = enabled
 }
+func (listener *CarbonserverListener) SetTrieIndexSnapshot(filename string) {
+	listener.trieSnapshot = filename
+}
+func (listener *CarbonserverListener) SetStreamRender(enabled bool) {
+	listener.streamRender = enabled
+}
+func (listener *CarbonserverListener) SetTagsHandler(h http.Handler) {
+	listener.tagsHandler = h
+}
+func (listener *CarbonserverListener) SetTagLimitsHandler(h http.Handler) {
+	listener.tagLimitsHandler = h
+}
+func (listener *CarbonserverListener) SetTaggedDeleteFn(fn func(series string)) {
+	listener.taggedDeleteFn = fn
+}
+func (listener *CarbonserverListener) SetSchemaFn(fn func(metric string) (MetricSchema, bool)) {
+	listener.schemaFn = fn
+}
+func (listener *CarbonserverListener) SetFetchWorkers(workers int) {
+	listener.fetchWorkers = workers
+}
+func (listener *CarbonserverListener) SetFetchRequestParallelism(parallelism int) {
+	listener.fetchRequestParallelism = parallelism
+}
 func (listener *CarbonserverListener) SetInternalStatsDir(dbPath string) {
 	listener.internalStatsDir = dbPath
 }
@@ -603,6 +737,31 @@ func (listener *CarbonserverListener) fileListUpdater(dir string, tick <-chan ti
 	}
 }
 
+// taggedSeriesName returns series of tagged whisper file. Names of files created with
+// hash-only tagged filenames can't be restored.
+func taggedSeriesName(trimmedName string) (string, bool) {
+	if !strings.HasPrefix(trimmedName, "/_tagged/") {
+		return "", false
+	}
+	name := strings.TrimSuffix(filepath.Base(trimmedName), ".wsp")
+	if strings.IndexByte(name, ';') < 0 {
+		return "", false
+	}
+	return strings.Replace(name, "_DOT_", ".", -1), true
+}
+
+// deleteVanishedTagged removes tagged series from TagDB if their files were removed
+// since the previous scan
+func (listener *CarbonserverListener) deleteVanishedTagged(tagged map[string]struct{}) {
+	for series := range listener.taggedSeries {
+		if _, ok := tagged[series]; !ok {
+			atomic.AddUint64(&listener.metrics.TaggedSeriesDeleted, 1)
+			listener.taggedDeleteFn(series)
+		}
+	}
+	listener.taggedSeries = tagged
+}
+
 func (listener *CarbonserverListener) updateFileList(dir string) {
 	logger := listener.logger.With(zap.String("handler", "fileListUpdated"))
 	defer func() {
@@ -619,9 +778,15 @@ func (listener *CarbonserverListener) updateFileList(dir string) {
 	details := make(map[string]*protov3.MetricDetails)
 
 	metricsKnown := uint64(0)
+	walkFailed := false
+	var tagged map[string]struct{}
+	if listener.taggedDeleteFn != nil {
+		tagged = make(map[string]struct{})
+	}
 	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			logger.Info("error processing", zap.String("path", p), zap.Error(err))
+			walkFailed = true
 			return nil
 		}
 
@@ -631,6 +796,11 @@ func (listener *CarbonserverListener) updateFileList(dir string) {
 			files = append(files, trimmedName)
 			if hasSuffix {
 				metricsKnown++
+				if tagged != nil {
+					if series, ok := taggedSeriesName(trimmedName); ok {
+						tagged[series] = struct{}{}
+					}
+				}
 				if listener.internalStatsDir != "" {
 					i := stat.GetStat(info)
 					trimmedName = strings.Replace(trimmedName[1:len(trimmedName)-4], "/", ".", -1)
@@ -652,6 +822,10 @@ func (listener *CarbonserverListener) updateFileList(dir string) {
 		)
 	}
 
+	if tagged != nil && err == nil && !walkFailed {
+		listener.deleteVanishedTagged(tagged)
+	}
+
 	var stat syscall.Statfs_t
 	err = syscall.Statfs(dir, &stat)
 	if err != nil {
@@ -705,6 +879,13 @@ func (listener *CarbonserverListener) updateFileList(dir string) {
 			nfidx.trieIdx.setTrigrams()
 			infos = append(infos, zap.Duration("set_trigram_time", time.Now().Sub(start)))
 		}
+		if listener.trieSnapshot != "" {
+			start := time.Now()
+			if err := writeTrieSnapshot(listener.trieSnapshot, nfidx.trieIdx); err != nil {
+				infos = append(infos, zap.NamedError("trie_snapshot_error", err))
+			}
+			infos = append(infos, zap.Duration("trie_snapshot_write_time", time.Now().Sub(start)))
+		}
 	} else {
 		nfidx.files = files
 		nfidx.idx = trigram.NewIndex(files)
@@ -749,6 +930,42 @@ func (listener *CarbonserverListener) updateFileList(dir string) {
 	logger.Info("file list updated", infos...)
 }
 
+// loadTrieSnapshot makes index from the previous run available before the first file list scan
+func (listener *CarbonserverListener) loadTrieSnapshot() {
+	logger := listener.logger.With(zap.String("trie_snapshot", listener.trieSnapshot))
+
+	t0 := time.Now()
+	trieIdx, err := loadTrieSnapshot(listener.trieSnapshot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("trie snapshot not found")
+		} else {
+			logger.Error("failed to load trie snapshot", zap.Error(err))
+		}
+		return
+	}
+
+	if !listener.trigramIndex {
+		trieIdx.trigrams = map[*trieNode][]uint32{}
+	}
+
+	atomic.StoreUint64(&listener.metrics.MetricsKnown, uint64(trieIdx.fileCount))
+	listener.UpdateFileIndex(&fileIndex{
+		trieIdx:     trieIdx,
+		details:     make(map[string]*protov3.MetricDetails),
+		accessTimes: make(map[string]int64),
+	})
+
+	logger.Info("trie snapshot loaded",
+		zap.Int("files", trieIdx.fileCount),
+		zap.Int("trie_depth", trieIdx.depth),
+		zap.Duration("runtime", time.Since(t0)),
+	)
+}
+
+// expandGlobsCheckInterval is number of stat calls between context checks in expandGlobs
+const expandGlobsCheckInterval = 256
+
 func (listener *CarbonserverListener) expandGlobs(ctx context.Context, query string, resultCh chan<- *ExpandedGlobResponse) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -756,6 +973,10 @@ func (listener *CarbonserverListener) expandGlobs(ctx context.Context, query str
 		}
 	}()
 
+	ctx, span := tracing.StartSpan(ctx, "expandGlobs")
+	span.SetAttributes(attribute.String("query", query))
+	defer span.End()
+
 	logger := TraceContextToZap(ctx, listener.logger)
 	matchedCount := 0
 	defer func(start time.Time) {
@@ -776,7 +997,7 @@ func (listener *CarbonserverListener) expandGlobs(ctx context.Context, query str
 	}(time.Now())
 
 	if listener.trieIndex && listener.CurrentFileIndex() != nil {
-		files, leafs, err := listener.expandGlobsTrie(query)
+		files, leafs, err := listener.expandGlobsTrie(ctx, query)
 		resultCh <- &ExpandedGlobResponse{query, files, leafs, err}
 		return
 	}
@@ -826,6 +1047,11 @@ func (listener *CarbonserverListener) expandGlobs(ctx context.Context, query str
 		docs := make(map[trigram.DocID]struct{})
 
 		for _, g := range globs {
+			if err := ctx.Err(); err != nil {
+				resultCh <- &ExpandedGlobResponse{query, nil, nil, err}
+				return
+			}
+
 			gpath := "/" + g
 			ts := extractTrigrams(g)
 
@@ -857,6 +1083,11 @@ func (listener *CarbonserverListener) expandGlobs(ctx context.Context, query str
 	if useGlob || fallbackToFS {
 		// no index or we were asked to hit the filesystem
 		for _, g := range globs {
+			if err := ctx.Err(); err != nil {
+				resultCh <- &ExpandedGlobResponse{query, nil, nil, err}
+				return
+			}
+
 			nfiles, err := filepath.Glob(listener.whisperData + "/" + g)
 			if err == nil {
 				files = append(files, nfiles...)
@@ -866,6 +1097,13 @@ func (listener *CarbonserverListener) expandGlobs(ctx context.Context, query str
 
 	leafs := make([]bool, len(files))
 	for i, p := range files {
+		if i%expandGlobsCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				resultCh <- &ExpandedGlobResponse{query, nil, nil, err}
+				return
+			}
+		}
+
 		s, err := os.Stat(p)
 		if err != nil {
 			continue
@@ -971,10 +1209,28 @@ func (listener *CarbonserverListener) Stat(send helper.StatCallback) {
 
 	sender("query_cache_hit", &listener.metrics.QueryCacheHit, send)
 	sender("query_cache_miss", &listener.metrics.QueryCacheMiss, send)
+	for f := range listener.queryCacheFormatStats {
+		format := responseFormat(f)
+		sender(fmt.Sprintf("query_cache.%s.hit", format), &listener.queryCacheFormatStats[f].hit, send)
+		sender(fmt.Sprintf("query_cache.%s.miss", format), &listener.queryCacheFormatStats[f].miss, send)
+	}
 
 	sender("find_cache_hit", &listener.metrics.FindCacheHit, send)
 	sender("find_cache_miss", &listener.metrics.FindCacheMiss, send)
 
+	sender("cancelled_requests", &listener.metrics.CancelledRequests, send)
+	sender("timeout_requests", &listener.metrics.TimeoutRequests, send)
+	sender("fetches_cancelled", &listener.metrics.FetchesCancelled, send)
+	sender("slow_queries", &listener.metrics.SlowQueries, send)
+	sender("tagged_series_deleted", &listener.metrics.TaggedSeriesDeleted, send)
+
+	now := time.Now()
+	for _, endpoint := range LimitedEndpoints {
+		if limiter, ok := listener.apiLimiters[endpoint]; ok {
+			limiter.stat(endpoint, now, send)
+		}
+	}
+
 	sender("alloc", &alloc, send)
 	sender("total_alloc", &totalAlloc, send)
 	sender("num_gc", &numGC, send)
@@ -1020,6 +1276,9 @@ func (listener *CarbonserverListener) Stop() error {
 		listener.db.Close()
 	}
 	listener.tcpListener.Close()
+	if listener.fetchPool != nil {
+		listener.fetchPool.stop()
+	}
 	return nil
 }
 
@@ -1094,6 +1353,9 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 	)
 
 	listener.exitChan = make(chan struct{})
+	if listener.trieIndex && listener.trieSnapshot != "" {
+		listener.loadTrieSnapshot()
+	}
 	if (listener.trigramIndex || listener.trieIndex) && listener.scanFrequency != 0 {
 		listener.forceScanChan = make(chan struct{})
 		go listener.fileListUpdater(listener.whisperData, time.Tick(listener.scanFrequency), listener.forceScanChan, listener.exitChan)
@@ -1102,6 +1364,10 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 
 	listener.queryCache = queryCache{ec: expirecache.New(uint64(listener.queryCacheSizeMB))}
 
+	if listener.fetchWorkers > 0 {
+		listener.fetchPool = newFetchPool(listener.fetchWorkers)
+	}
+
 	// +1 to track every over the number of buckets we track
 	listener.timeBuckets = make([]uint64, listener.buckets+1)
 
@@ -1120,12 +1386,12 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 			),
 		)
 	}
-	carbonserverMux.HandleFunc("/_internal/capabilities/", wrapHandler(listener.capabilityHandler, statusCodes["capabilities"]))
-	carbonserverMux.HandleFunc("/metrics/find/", wrapHandler(listener.findHandler, statusCodes["find"]))
-	carbonserverMux.HandleFunc("/metrics/list/", wrapHandler(listener.listHandler, statusCodes["list"]))
-	carbonserverMux.HandleFunc("/metrics/details/", wrapHandler(listener.detailsHandler, statusCodes["details"]))
-	carbonserverMux.HandleFunc("/render/", wrapHandler(listener.renderHandler, statusCodes["render"]))
-	carbonserverMux.HandleFunc("/info/", wrapHandler(listener.infoHandler, statusCodes["info"]))
+	carbonserverMux.HandleFunc("/_internal/capabilities/", wrapHandler(listener.limitHandler("capabilities", listener.capabilityHandler), statusCodes["capabilities"]))
+	carbonserverMux.HandleFunc("/metrics/find/", wrapHandler(listener.limitHandler("find", listener.findHandler), statusCodes["find"]))
+	carbonserverMux.HandleFunc("/metrics/list/", wrapHandler(listener.limitHandler("list", listener.listHandler), statusCodes["list"]))
+	carbonserverMux.HandleFunc("/metrics/details/", wrapHandler(listener.limitHandler("details", listener.detailsHandler), statusCodes["details"]))
+	carbonserverMux.HandleFunc("/render/", wrapHandler(listener.limitHandler("render", listener.renderHandler), statusCodes["render"]))
+	carbonserverMux.HandleFunc("/info/", wrapHandler(listener.limitHandler("info", listener.infoHandler), statusCodes["info"]))
 
 	carbonserverMux.HandleFunc("/forcescan", func(w http.ResponseWriter, r *http.Request) {
 		select {
@@ -1136,6 +1402,17 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 		}
 	})
 
+	carbonserverMux.HandleFunc("/admin/topqueries", listener.topQueriesHandler)
+
+	if listener.tagLimitsHandler != nil {
+		carbonserverMux.Handle("/admin/taglimits", listener.tagLimitsHandler)
+	}
+
+	if listener.tagsHandler != nil {
+		carbonserverMux.Handle("/tags", listener.tagsHandler)
+		carbonserverMux.Handle("/tags/", listener.tagsHandler)
+	}
+
 	carbonserverMux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "User-agent: *\nDisallow: /")
 	})
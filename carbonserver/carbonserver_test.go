@@ -1,19 +1,28 @@
 package carbonserver
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/dgryski/go-expirecache"
 	"github.com/dgryski/go-trigram"
 	"github.com/go-graphite/go-whisper"
 	pb "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/gogo/protobuf/proto"
 	"github.com/lomik/go-carbon/cache"
 	"github.com/lomik/go-carbon/points"
 	"go.uber.org/zap"
@@ -113,7 +122,7 @@ func generalFetchSingleMetricRemove(testData *FetchTest) {
 }
 
 func generalFetchSingleMetricHelper(testData *FetchTest, cache *cache.Cache, carbonserver *CarbonserverListener) (*pb.FetchResponse, error) {
-	data, err := carbonserver.fetchSingleMetricV2(testData.name, int32(testData.from), int32(testData.until))
+	data, err := carbonserver.fetchSingleMetricV2(context.Background(), testData.name, int32(testData.from), int32(testData.until), fetchOptions{})
 	return data, err
 }
 
@@ -479,3 +488,873 @@ func BenchmarkFetchSingleMetricDataCacheLong(b *testing.B) {
 
 	benchmarkFetchSingleMetricCommon(b, test)
 }
+
+func TestConsolidate(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name     string
+		values   []float64
+		function string
+		xff      float32
+		cons     consolidation
+		expected []float64
+		stepTime int64
+		stopTime int64
+	}{
+		{
+			name:     "disabled",
+			values:   []float64{1, 2, 3, 4},
+			function: "average",
+			cons:     consolidation{},
+			expected: []float64{1, 2, 3, 4},
+			stepTime: 60,
+			stopTime: 240,
+		},
+		{
+			name:     "enough points",
+			values:   []float64{1, 2, 3, 4},
+			function: "average",
+			cons:     consolidation{maxDataPoints: 4},
+			expected: []float64{1, 2, 3, 4},
+			stepTime: 60,
+			stopTime: 240,
+		},
+		{
+			name:     "file aggregation method",
+			values:   []float64{1, 2, 3, 4, 5},
+			function: "sum",
+			cons:     consolidation{maxDataPoints: 2},
+			expected: []float64{6, 9},
+			stepTime: 180,
+			stopTime: 360,
+		},
+		{
+			name:     "override",
+			values:   []float64{1, 2, 3, 4, 5, 6},
+			function: "sum",
+			cons:     consolidation{maxDataPoints: 3, function: "max"},
+			expected: []float64{2, 4, 6},
+			stepTime: 120,
+			stopTime: 360,
+		},
+		{
+			name:     "absent values",
+			values:   []float64{1, nan, nan, nan, 3, 5},
+			function: "average",
+			cons:     consolidation{maxDataPoints: 3},
+			expected: []float64{1, nan, 4},
+			stepTime: 120,
+			stopTime: 360,
+		},
+		{
+			name:     "xFilesFactor",
+			values:   []float64{1, nan, 2, 4, nan, nan},
+			function: "last",
+			xff:      0.5,
+			cons:     consolidation{maxDataPoints: 3},
+			expected: []float64{1, 4, nan},
+			stepTime: 120,
+			stopTime: 360,
+		},
+		{
+			name:     "unknown aggregation method",
+			values:   []float64{1, 2, 3, 4},
+			function: "7",
+			cons:     consolidation{maxDataPoints: 1, function: ""},
+			expected: []float64{2.5},
+			stepTime: 240,
+			stopTime: 240,
+		},
+	}
+
+	for _, tt := range tests {
+		r := response{
+			StartTime:         0,
+			StopTime:          int64(len(tt.values)) * 60,
+			StepTime:          60,
+			Values:            tt.values,
+			ConsolidationFunc: tt.function,
+			XFilesFactor:      tt.xff,
+		}
+		r.consolidate(tt.cons)
+
+		if fmt.Sprint(r.Values) != fmt.Sprint(tt.expected) || r.StepTime != tt.stepTime || r.StopTime != tt.stopTime {
+			t.Errorf("%s: got %v step %d stop %d, want %v step %d stop %d",
+				tt.name, r.Values, r.StepTime, r.StopTime, tt.expected, tt.stepTime, tt.stopTime)
+		}
+	}
+}
+
+func TestConsolidateAggregationMethod(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	retentions, err := whisper.ParseRetentionDefs("1m:30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := int(time.Now().Unix())
+	now -= now % 60
+	for name, method := range map[string]whisper.AggregationMethod{"sum": whisper.Sum, "max": whisper.Max} {
+		wsp, err := whisper.Create(filepath.Join(path, name+".wsp"), retentions, method, 0.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p []*whisper.TimeSeriesPoint
+		for ts := now - 1200; ts < now; ts += 60 {
+			p = append(p, &whisper.TimeSeriesPoint{Time: ts, Value: float64(ts % 7)})
+		}
+		if err := wsp.UpdateMany(p); err != nil {
+			t.Fatal(err)
+		}
+		wsp.Close()
+	}
+
+	carbonserver := NewCarbonserverListener(cache.New().Get)
+	carbonserver.whisperData = path
+	carbonserver.logger = zap.NewNop()
+	carbonserver.metrics = &metricStruct{}
+
+	fetch := func(name string, maxDataPoints int64) *pb.FetchResponse {
+		data, err := carbonserver.fetchSingleMetricV2(context.Background(), name, int32(now-1200), int32(now), fetchOptions{
+			consolidation: consolidation{maxDataPoints: maxDataPoints},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for name, aggregate := range map[string]func([]float64) float64{"sum": consolidateSum, "max": consolidateMax} {
+		raw := fetch(name, 0)
+		data := fetch(name, 2)
+
+		valuesPerPoint := (len(raw.Values) + 1) / 2
+		expected := []float64{
+			aggregate(raw.Values[:valuesPerPoint]),
+			aggregate(raw.Values[valuesPerPoint:]),
+		}
+		if fmt.Sprint(data.Values) != fmt.Sprint(expected) {
+			t.Errorf("%s: got %v, want %v (raw %v)", name, data.Values, expected, raw.Values)
+		}
+	}
+
+	// maxDataPoints of protobuf requests is set per target, url parameter is fallback
+	carbonserver.accessLogger = zap.NewNop()
+	carbonserver.maxGlobs = 100
+	carbonserver.maxMetricsGlobbed = 100
+	carbonserver.maxMetricsRendered = 100
+	body, _ := (&protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{{
+		Name:           "max",
+		PathExpression: "max",
+		StartTime:      int64(now - 1200),
+		StopTime:       int64(now),
+	}, {
+		Name:           "sum",
+		PathExpression: "sum",
+		StartTime:      int64(now - 1200),
+		StopTime:       int64(now),
+		MaxDataPoints:  3,
+	}}}).Marshal()
+	req := httptest.NewRequest("POST", "/render/?format=carbonapi_v3_pb&maxDataPoints=2", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	carbonserver.renderHandler(rr, req)
+
+	var res protov3.MultiFetchResponse
+	if err := res.Unmarshal(rr.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]int)
+	for _, m := range res.Metrics {
+		values[m.Name] = len(m.Values)
+	}
+	if len(values) != 2 || values["max"] != 2 || values["sum"] != 3 {
+		t.Errorf("carbonapi_v3_pb: unexpected response %v", res.Metrics)
+	}
+}
+
+func TestFetchSingleMetricArchiveSelection(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	retentions, err := whisper.ParseRetentionDefs("1m:10m,5m:1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsp, err := whisper.Create(filepath.Join(path, "archives.wsp"), retentions, whisper.Average, 0.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 in the second archive only, 2 in the recent part of the first archive
+	now := int(time.Now().Unix())
+	var p []*whisper.TimeSeriesPoint
+	for ts := now - 3000; ts <= now; ts += 60 {
+		value := 1.0
+		if ts > now-720 {
+			value = 2.0
+		}
+		p = append(p, &whisper.TimeSeriesPoint{Time: ts, Value: value})
+	}
+	if err := wsp.UpdateMany(p); err != nil {
+		t.Fatal(err)
+	}
+	wsp.Close()
+
+	carbonserver := NewCarbonserverListener(cache.New().Get)
+	carbonserver.whisperData = path
+	carbonserver.logger = zap.NewNop()
+	carbonserver.metrics = &metricStruct{}
+
+	fetch := func(opts fetchOptions) *pb.FetchResponse {
+		data, err := carbonserver.fetchSingleMetricV2(context.Background(), "archives", int32(now-1800), int32(now), opts)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error %s", opts, err)
+		}
+		return data
+	}
+	known := func(data *pb.FetchResponse) (values []float64) {
+		for i, v := range data.Values {
+			if !data.IsAbsent[i] {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+
+	if data := fetch(fetchOptions{}); data.StepTime != 300 {
+		t.Errorf("default: unexpected step %d", data.StepTime)
+	}
+	if data := fetch(fetchOptions{resolution: 300}); data.StepTime != 300 {
+		t.Errorf("resolution=300: unexpected step %d", data.StepTime)
+	}
+
+	data := fetch(fetchOptions{resolution: 1})
+	values := known(data)
+	if data.StepTime != 60 || len(data.Values) != 30 || len(values) < 7 || len(values) > 10 {
+		t.Errorf("resolution=1: unexpected step %d or values %v", data.StepTime, data.Values)
+	}
+	for _, v := range values {
+		if v != 2.0 {
+			t.Errorf("resolution=1: unexpected values %v", data.Values)
+			break
+		}
+	}
+
+	// whisper rounds from time up to the archive step, so up to 5 first points are absent
+	data = fetch(fetchOptions{stitch: true})
+	values = known(data)
+	if data.StepTime != 60 || len(data.Values) != 30 || len(values) < 25 {
+		t.Errorf("stitch: unexpected step %d or values %v", data.StepTime, data.Values)
+	}
+	if values[0] != 1.0 || values[len(values)-1] != 2.0 {
+		t.Errorf("stitch: unexpected values %v", data.Values)
+	}
+}
+
+func TestStreamRender(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	retentions, err := whisper.ParseRetentionDefs("1m:30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := int(time.Now().Unix())
+	for i := 0; i < 3; i++ {
+		wsp, err := whisper.Create(filepath.Join(path, fmt.Sprintf("metric%d.wsp", i)), retentions, whisper.Average, 0.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ts := now - 600; ts < now; ts += 60 {
+			wsp.Update(float64(i*ts%7), ts)
+		}
+		wsp.Close()
+	}
+
+	carbonserver := NewCarbonserverListener(cache.New().Get)
+	carbonserver.whisperData = path
+	carbonserver.logger = zap.NewNop()
+	carbonserver.accessLogger = zap.NewNop()
+	carbonserver.trigramIndex = false
+	carbonserver.maxGlobs = 100
+	carbonserver.maxMetricsGlobbed = 100
+	carbonserver.maxMetricsRendered = 100
+
+	render := func(format string, stream bool, target string) *httptest.ResponseRecorder {
+		carbonserver.streamRender = stream
+		req := httptest.NewRequest("GET", fmt.Sprintf("/render/?target=%s&format=%s&from=%d&until=%d", target, format, now-1200, now), nil)
+		if format == "carbonapi_v3_pb" {
+			body, _ := (&protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{{
+				Name:           target,
+				PathExpression: target,
+				StartTime:      int64(now - 1200),
+				StopTime:       int64(now),
+			}}}).Marshal()
+			req = httptest.NewRequest("POST", "/render/?format=carbonapi_v3_pb", bytes.NewReader(body))
+		}
+		rr := httptest.NewRecorder()
+		carbonserver.renderHandler(rr, req)
+		return rr
+	}
+
+	for _, format := range []string{"json", "carbonapi_v3_pb"} {
+		expected := render(format, false, "metric*")
+		got := render(format, true, "metric*")
+		if expected.Code != http.StatusOK || got.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status %d, streamed %d", format, expected.Code, got.Code)
+			continue
+		}
+		if expected.Header().Get("Content-Type") != got.Header().Get("Content-Type") {
+			t.Errorf("%s: content type %q, streamed %q", format, expected.Header().Get("Content-Type"), got.Header().Get("Content-Type"))
+		}
+		if !bytes.Equal(expected.Body.Bytes(), got.Body.Bytes()) {
+			t.Errorf("%s: streamed response differs:\n%q\n%q", format, expected.Body.String(), got.Body.String())
+		}
+
+		if rr := render(format, true, "unknown"); rr.Code != http.StatusNotFound {
+			t.Errorf("%s: unexpected status %d for unknown metric", format, rr.Code)
+		}
+	}
+
+	var multi protov3.MultiFetchResponse
+	if err := multi.Unmarshal(render("carbonapi_v3_pb", true, "metric*").Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(multi.Metrics) != 3 || multi.Metrics[0].PathExpression != "metric*" {
+		t.Errorf("unexpected streamed response: %+v", multi)
+	}
+}
+
+func TestRenderContextDone(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	retentions, err := whisper.ParseRetentionDefs("1m:30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := int(time.Now().Unix())
+	wsp, err := whisper.Create(filepath.Join(path, "metric.wsp"), retentions, whisper.Average, 0.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsp.Update(1, now-60)
+	wsp.Close()
+
+	carbonserver := NewCarbonserverListener(cache.New().Get)
+	carbonserver.whisperData = path
+	carbonserver.logger = zap.NewNop()
+	carbonserver.accessLogger = zap.NewNop()
+	carbonserver.metrics = &metricStruct{}
+	carbonserver.trigramIndex = false
+	carbonserver.maxGlobs = 100
+	carbonserver.maxMetricsGlobbed = 100
+	carbonserver.maxMetricsRendered = 100
+
+	render := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/render/?target=metric&format=json&from=%d&until=%d", now-1200, now), nil)
+		rr := httptest.NewRecorder()
+		carbonserver.renderHandler(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	if rr := render(context.Background()); rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if rr := render(ctx); rr.Code != statusClientClosedRequest {
+		t.Errorf("cancelled: unexpected status %d", rr.Code)
+	}
+	if carbonserver.metrics.CancelledRequests != 1 {
+		t.Errorf("cancelled: unexpected counter %d", carbonserver.metrics.CancelledRequests)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if rr := render(ctx); rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("timeout: unexpected status %d", rr.Code)
+	}
+	if carbonserver.metrics.TimeoutRequests != 1 {
+		t.Errorf("timeout: unexpected counter %d", carbonserver.metrics.TimeoutRequests)
+	}
+}
+
+func TestFetchPool(t *testing.T) {
+	pool := newFetchPool(4)
+	defer pool.stop()
+
+	// parallelism of a single request is limited, waiting for own slot isn't queue wait
+	var running, maxRunning, maxWait int64
+	done := make([]bool, 20)
+	pool.run(len(done), 2, func(i int, wait time.Duration) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		for {
+			m := atomic.LoadInt64(&maxWait)
+			if int64(wait) <= m || atomic.CompareAndSwapInt64(&maxWait, m, int64(wait)) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		done[i] = true
+		atomic.AddInt64(&running, -1)
+	})
+	if maxRunning > 2 {
+		t.Errorf("parallelism limit exceeded: %d", maxRunning)
+	}
+	// the last tasks would wait for 45ms if fetches of the request were counted
+	if time.Duration(maxWait) > 20*time.Millisecond {
+		t.Errorf("queue wait includes fetches of the same request: %s", time.Duration(maxWait))
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("task %d wasn't called", i)
+		}
+	}
+
+	// small request isn't queued behind the large one
+	var largeDone int32
+	largeStarted := make(chan struct{})
+	go pool.run(100, 4, func(i int, wait time.Duration) {
+		if i == 0 {
+			close(largeStarted)
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&largeDone, 1)
+	})
+	<-largeStarted
+	pool.run(2, 4, func(int, time.Duration) {})
+	if n := atomic.LoadInt32(&largeDone); n >= 50 {
+		t.Errorf("small request waited for %d tasks of large request", n)
+	}
+}
+
+func TestAPILimits(t *testing.T) {
+	now := time.Now()
+	limiter := newAPILimiter(APILimit{Rate: 2, Burst: 2, MaxInflight: 3, MaxInflightTotal: 4})
+
+	// burst, then rate
+	for i := 0; i < 2; i++ {
+		if reason, _ := limiter.acquire("a", now); reason != "" {
+			t.Fatalf("request %d limited by %s", i, reason)
+		}
+	}
+	if reason, _ := limiter.acquire("a", now); reason != "rate" {
+		t.Errorf("expected rate limit, got %q", reason)
+	}
+	if reason, _ := limiter.acquire("a", now.Add(500*time.Millisecond)); reason != "" {
+		t.Errorf("token isn't refilled: %s", reason)
+	}
+	// 3 requests of "a" in flight
+	if reason, _ := limiter.acquire("a", now.Add(2*time.Second)); reason != "max_inflight" {
+		t.Errorf("expected max_inflight, got %q", reason)
+	}
+	if reason, _ := limiter.acquire("b", now.Add(2*time.Second)); reason != "" {
+		t.Errorf("other client limited by %s", reason)
+	}
+	if reason, _ := limiter.acquire("c", now.Add(2*time.Second)); reason != "max_inflight_total" {
+		t.Errorf("expected max_inflight_total, got %q", reason)
+	}
+
+	limiter.release("b")
+	limiter.release("a")
+	if reason, _ := limiter.acquire("c", now.Add(2*time.Second)); reason != "" {
+		t.Errorf("released request is still in flight: %s", reason)
+	}
+
+	stats := make(map[string]float64)
+	limiter.stat("render", now.Add(time.Hour), func(metric string, value float64) { stats[metric] = value })
+	expected := map[string]float64{
+		"api_limits.render.limited":   3,
+		"api_limits.render.clients.a": 2,
+		"api_limits.render.clients.c": 1,
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	// clients are capped, idle ones are pruned and labels are aggregated
+	limiter = newAPILimiter(APILimit{MaxInflight: 1})
+	for i := 0; i < limitMaxClients+1; i++ {
+		limiter.acquire(fmt.Sprintf("client%d", i), now)
+	}
+	if reason, client := limiter.acquire("late", now); reason != "max_inflight" || client != limitOtherClient {
+		t.Errorf("client over limitMaxClients is accounted as %q, reason %q", client, reason)
+	}
+	for i := 0; i < limitMaxClients; i++ {
+		limiter.release(fmt.Sprintf("client%d", i))
+	}
+	limiter.acquire("late", now.Add(limitPruneInterval))
+	if len(limiter.clients) != 2 {
+		t.Errorf("idle clients aren't pruned: %d left", len(limiter.clients))
+	}
+	for i := 0; i < limitMaxLabels; i++ {
+		limiter.label(fmt.Sprintf("client%d", i))
+	}
+	if label := limiter.label("client0"); label != "client0" {
+		t.Errorf("known label is replaced by %q", label)
+	}
+	if label := limiter.label("late"); label != limitOtherClient {
+		t.Errorf("label over limitMaxLabels is %q", label)
+	}
+
+	listener := NewCarbonserverListener(cache.New().Get)
+	listener.accessLogger = zap.NewNop()
+	listener.SetAPILimits(map[string]APILimit{"find": {MaxInflight: 1}}, "X-Forwarded-For")
+	block := make(chan struct{})
+	handler := listener.limitHandler("find", func(wr http.ResponseWriter, req *http.Request) { <-block })
+
+	req := httptest.NewRequest("GET", "/metrics/find/?query=*", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	if client := listener.limitClient(req); client != "10.0.0.1" {
+		t.Errorf("unexpected client %q", client)
+	}
+	go handler(httptest.NewRecorder(), req)
+	findLimiter := listener.apiLimiters["find"]
+	for i := 0; i < 1000; i++ {
+		findLimiter.mu.Lock()
+		inflight := findLimiter.inflight
+		findLimiter.mu.Unlock()
+		if inflight > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("unexpected status %d", rr.Code)
+	}
+	close(block)
+}
+
+func TestQueryCache(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	retentions, err := whisper.ParseRetentionDefs("1m:30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(path, "metric.wsp")
+	wsp, err := whisper.Create(file, retentions, whisper.Average, 0.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := int(time.Now().Unix())
+	base := now - now%60
+	var p []*whisper.TimeSeriesPoint
+	for ts := base - 1200; ts < base-300; ts += 60 {
+		p = append(p, &whisper.TimeSeriesPoint{Time: ts, Value: 1})
+	}
+	if err := wsp.UpdateMany(p); err != nil {
+		t.Fatal(err)
+	}
+	wsp.Close()
+	// files modified within queryCacheMinFileAge are not cached
+	modified := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	c := cache.New()
+	carbonserver := NewCarbonserverListener(c.Get)
+	carbonserver.whisperData = path
+	carbonserver.logger = zap.NewNop()
+	carbonserver.metrics = &metricStruct{}
+	carbonserver.queryCacheEnabled = true
+	carbonserver.queryCache = queryCache{ec: expirecache.New(0)}
+
+	opts := fetchOptions{format: protoV3Format}
+	first, err := carbonserver.fetchSingleMetricV3(context.Background(), "metric", "metric", int32(base-1200+1), int32(base+1), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second request is served from cache, but points of carbon cache are fresh
+	c.Add(points.OnePoint("metric", 2, int64(base-120)))
+	second, err := carbonserver.fetchSingleMetricV3(context.Background(), "metric", "metric", int32(base-1200+59), int32(base+30), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.StartTime != second.StartTime || first.StopTime != second.StopTime || len(first.Values) != len(second.Values) {
+		t.Fatalf("unexpected time range of cached series %d-%d, expected %d-%d", second.StartTime, second.StopTime, first.StartTime, first.StopTime)
+	}
+	for i, v := range second.Values {
+		ts := int(second.StartTime) + i*int(second.StepTime)
+		switch {
+		case ts == base-120:
+			if v != 2 {
+				t.Errorf("point of carbon cache is not merged: %v", second.Values)
+			}
+		case ts < base-300:
+			if v != 1 {
+				t.Errorf("unexpected cached value at %d: %v", ts, second.Values)
+			}
+		default:
+			if !math.IsNaN(v) {
+				t.Errorf("unexpected value at %d: %v", ts, second.Values)
+			}
+		}
+	}
+	stat := carbonserver.queryCacheFormatStats[protoV3Format]
+	if stat.hit != 1 || stat.miss != 1 || carbonserver.metrics.QueryCacheHit != 1 || carbonserver.metrics.QueryCacheMiss != 1 {
+		t.Errorf("unexpected query cache stats %+v, hit %d, miss %d", stat, carbonserver.metrics.QueryCacheHit, carbonserver.metrics.QueryCacheMiss)
+	}
+
+	// points persisted after the series was cached are visible
+	wsp, err = whisper.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wsp.Update(3, base-240); err != nil {
+		t.Fatal(err)
+	}
+	wsp.Close()
+	modified = modified.Add(time.Second)
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	third, err := carbonserver.fetchSingleMetricV3(context.Background(), "metric", "metric", int32(base-1200+59), int32(base+30), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := (base - 240 - int(third.StartTime)) / int(third.StepTime); third.Values[i] != 3 {
+		t.Errorf("persisted point is hidden by query cache: %v", third.Values)
+	}
+	if carbonserver.metrics.QueryCacheHit != 1 || carbonserver.metrics.QueryCacheMiss != 2 {
+		t.Errorf("unexpected query cache stats: hit %d, miss %d", carbonserver.metrics.QueryCacheHit, carbonserver.metrics.QueryCacheMiss)
+	}
+
+	// removed file is not served from cache
+	os.Remove(file)
+	if _, err := carbonserver.fetchSingleMetricV3(context.Background(), "metric", "metric", int32(base-1200+59), int32(base+30), opts); err == nil {
+		t.Errorf("expected error for removed file")
+	}
+}
+
+func TestFindDetails(t *testing.T) {
+	retentions, err := whisper.ParseRetentionDefs("1m:30m,5m:1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := newTrieServer([]string{"/a/b.wsp", "/a/c/d.wsp"}, false)
+	listener.metrics = &metricStruct{}
+	listener.CurrentFileIndex().details = map[string]*protov3.MetricDetails{
+		"a.b": {Size_: 4096, ModTime: 1600000000},
+	}
+	listener.SetSchemaFn(func(metric string) (MetricSchema, bool) {
+		return MetricSchema{Retentions: retentions, Aggregation: whisper.Sum, XFilesFactor: 0.5}, true
+	})
+
+	checkMatch := func(format string, m globMatchDetails) {
+		switch m.Path {
+		case "a.b":
+			if m.Info == nil || m.Info.ConsolidationFunc != "Sum" || m.Info.XFilesFactor != 0.5 || m.Info.MaxRetention != 3600 ||
+				len(m.Info.Retentions) != 2 || m.Info.Retentions[0].SecondsPerPoint != 60 || m.Info.Retentions[1].NumberOfPoints != 12 {
+				t.Errorf("%s: unexpected info %+v", format, m.Info)
+			}
+			if m.Details == nil || m.Details.Size_ != 4096 || m.Details.ModTime != 1600000000 {
+				t.Errorf("%s: unexpected details %+v", format, m.Details)
+			}
+		case "a.c":
+			if m.Info != nil || m.Details != nil {
+				t.Errorf("%s: directory has details %+v", format, m)
+			}
+		default:
+			t.Errorf("%s: unexpected match %+v", format, m)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	listener.findHandler(rr, httptest.NewRequest("GET", "/metrics/find/?format=json&details=1&query=a.*", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("json: unexpected status %d", rr.Code)
+	}
+	var res multiGlobResponseDetails
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Metrics) != 1 || len(res.Metrics[0].Matches) != 2 {
+		t.Fatalf("json: unexpected response %s", rr.Body)
+	}
+	for _, m := range res.Metrics[0].Matches {
+		checkMatch("json", m)
+	}
+
+	body, err := (&protov3.MultiGlobRequest{Metrics: []string{"a.*"}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	listener.findHandler(rr, httptest.NewRequest("GET", "/metrics/find/?format=carbonapi_v3_pb&details=1", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("protobuf: unexpected status %d", rr.Code)
+	}
+	// response is readable by clients which don't know fields of details
+	var pbRes protov3.MultiGlobResponse
+	if err := pbRes.Unmarshal(rr.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(pbRes.Metrics) != 1 || pbRes.Metrics[0].Name != "a.*" || len(pbRes.Metrics[0].Matches) != 2 {
+		t.Fatalf("protobuf: unexpected response %+v", pbRes)
+	}
+	matches, err := decodeGlobMatchDetails(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("protobuf: unexpected matches %+v", matches)
+	}
+	for _, m := range matches {
+		checkMatch("protobuf", m)
+	}
+
+	// leafs of all queries are limited by max-metrics-globbed
+	listener.maxMetricsGlobbed = 1
+	listener.slowQueryLogger = zap.NewNop()
+	rr = httptest.NewRecorder()
+	listener.findHandler(rr, httptest.NewRequest("GET", "/metrics/find/?format=json&details=1&query=a.b&query=a.*", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("limit: unexpected status %d, body %s", rr.Code, rr.Body)
+	}
+}
+
+// decodeGlobMatchDetails reads matches of all globs of carbonapi_v3_pb find response
+// with details
+func decodeGlobMatchDetails(data []byte) ([]globMatchDetails, error) {
+	// fields splits message to length-delimited fields, varints are skipped
+	fields := func(data []byte) (map[uint64][][]byte, error) {
+		res := make(map[uint64][][]byte)
+		for len(data) > 0 {
+			key, n := proto.DecodeVarint(data)
+			if n == 0 {
+				return nil, fmt.Errorf("bad key")
+			}
+			data = data[n:]
+			switch key & 7 {
+			case proto.WireVarint:
+				if _, n = proto.DecodeVarint(data); n == 0 {
+					return nil, fmt.Errorf("bad varint of field %d", key>>3)
+				}
+				data = data[n:]
+			case proto.WireBytes:
+				l, n := proto.DecodeVarint(data)
+				if n == 0 || uint64(len(data)-n) < l {
+					return nil, fmt.Errorf("bad length of field %d", key>>3)
+				}
+				res[key>>3] = append(res[key>>3], data[n:n+int(l)])
+				data = data[n+int(l):]
+			default:
+				return nil, fmt.Errorf("unexpected wire type of field %d", key>>3)
+			}
+		}
+		return res, nil
+	}
+
+	var matches []globMatchDetails
+	metrics, err := fields(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, glob := range metrics[1] {
+		globFields, err := fields(glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range globFields[2] {
+			var m globMatchDetails
+			if err := m.GlobMatch.Unmarshal(match); err != nil {
+				return nil, err
+			}
+			matchFields, err := fields(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range matchFields[globMatchInfoField] {
+				m.Info = &protov3.MetricsInfoResponse{}
+				if err := m.Info.Unmarshal(info); err != nil {
+					return nil, err
+				}
+			}
+			for _, details := range matchFields[globMatchDetailsField] {
+				m.Details = &protov3.MetricDetails{}
+				if err := m.Details.Unmarshal(details); err != nil {
+					return nil, err
+				}
+			}
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
+
+func TestDeleteVanishedTagged(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	files := []string{
+		"_tagged/aaa/bbb/cpu_DOT_load;host=a.wsp",
+		"_tagged/ccc/ddd/cpu_DOT_load;host=b.wsp",
+		// hash-only filename
+		"_tagged/eee/fff/eeefff0123.wsp",
+		"cpu/load.wsp",
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Join(path, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var deleted []string
+	listener := NewCarbonserverListener(cache.New().Get)
+	listener.whisperData = path
+	listener.logger = zap.NewNop()
+	listener.SetTaggedDeleteFn(func(series string) { deleted = append(deleted, series) })
+
+	listener.updateFileList(path)
+	if len(deleted) != 0 {
+		t.Fatalf("series are deleted on the first scan: %v", deleted)
+	}
+
+	for _, f := range files[1:] {
+		os.Remove(filepath.Join(path, f))
+	}
+	listener.updateFileList(path)
+	if !reflect.DeepEqual(deleted, []string{"cpu.load;host=b"}) {
+		t.Errorf("unexpected deleted series %v", deleted)
+	}
+}
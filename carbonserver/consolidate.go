@@ -0,0 +1,115 @@
+package carbonserver
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// consolidation defines server side consolidation of fetched values (maxDataPoints)
+type consolidation struct {
+	maxDataPoints int64
+	// function overrides aggregation method of whisper file. Empty - use file's method
+	function string
+}
+
+var consolidationFunctions = map[string]func(values []float64) float64{
+	"average": consolidateAverage,
+	"avg":     consolidateAverage,
+	"sum":     consolidateSum,
+	"min":     consolidateMin,
+	"max":     consolidateMax,
+	"first":   consolidateFirst,
+	"last":    consolidateLast,
+}
+
+func checkConsolidateBy(function string) error {
+	if function == "" {
+		return nil
+	}
+	if _, ok := consolidationFunctions[strings.ToLower(function)]; !ok {
+		return fmt.Errorf("unknown consolidation function %q", function)
+	}
+	return nil
+}
+
+func consolidateAverage(values []float64) float64 {
+	return consolidateSum(values) / float64(len(values))
+}
+
+func consolidateSum(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func consolidateMin(values []float64) float64 {
+	min := values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func consolidateMax(values []float64) float64 {
+	max := values[0]
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+func consolidateFirst(values []float64) float64 { return values[0] }
+func consolidateLast(values []float64) float64  { return values[len(values)-1] }
+
+// consolidate aggregates every ceil(len(values)/maxDataPoints) values into one, like
+// graphite-web does. Buckets with ratio of known values less than xFilesFactor are absent
+func (r *response) consolidate(c consolidation) {
+	if c.maxDataPoints <= 0 || int64(len(r.Values)) <= c.maxDataPoints {
+		return
+	}
+
+	function := c.function
+	if function == "" {
+		function = r.ConsolidationFunc
+	}
+	// aggregation method of whisper file is capitalized: "Average", "Sum", "Max", ...
+	aggregate, ok := consolidationFunctions[strings.ToLower(function)]
+	if !ok {
+		aggregate = consolidateAverage
+	}
+
+	valuesPerPoint := (int64(len(r.Values)) + c.maxDataPoints - 1) / c.maxDataPoints
+	consolidated := make([]float64, 0, c.maxDataPoints)
+	known := make([]float64, 0, valuesPerPoint)
+
+	for start := int64(0); start < int64(len(r.Values)); start += valuesPerPoint {
+		end := start + valuesPerPoint
+		if end > int64(len(r.Values)) {
+			end = int64(len(r.Values))
+		}
+
+		known = known[:0]
+		for _, v := range r.Values[start:end] {
+			if !math.IsNaN(v) {
+				known = append(known, v)
+			}
+		}
+
+		if len(known) == 0 || float32(len(known))/float32(valuesPerPoint) < r.XFilesFactor {
+			consolidated = append(consolidated, math.NaN())
+			continue
+		}
+		consolidated = append(consolidated, aggregate(known))
+	}
+
+	r.Values = consolidated
+	r.StepTime *= valuesPerPoint
+	r.StopTime = r.StartTime + int64(len(consolidated))*r.StepTime
+}
@@ -0,0 +1,166 @@
+package carbonserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetchPool is a fixed set of workers shared by all render requests. Every request
+// has its own queue with limited parallelism and workers take tasks from request
+// queues in round robin order, so a huge request can't starve small ones.
+type fetchPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// ready contains queues which have pending tasks and are below parallelism limit
+	ready   []*fetchQueue
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+type fetchQueue struct {
+	parallelism int
+	running     int
+	tasks       []fetchTask
+}
+
+// fetchTask is enqueued when its request has a free slot of parallelism, so wait in
+// queue doesn't include fetches of the same request
+type fetchTask struct {
+	enqueued time.Time
+	run      func(wait time.Duration)
+}
+
+func newFetchPool(workers int) *fetchPool {
+	p := &fetchPool{}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+
+	return p
+}
+
+func (p *fetchPool) worker() {
+	defer p.wg.Done()
+
+	p.mu.Lock()
+	for {
+		for len(p.ready) == 0 {
+			if p.stopped {
+				p.mu.Unlock()
+				return
+			}
+			p.cond.Wait()
+		}
+
+		q := p.ready[0]
+		p.ready = p.ready[1:]
+		task := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.running++
+		// back to the end of the line, other requests go first
+		if len(q.tasks) > 0 && q.running < q.parallelism {
+			p.ready = append(p.ready, q)
+		}
+		p.mu.Unlock()
+
+		task.run(time.Since(task.enqueued))
+
+		p.mu.Lock()
+		q.running--
+		// free slot is taken by the first of tasks which waited for it
+		if i := q.parallelism - q.running - 1; i < len(q.tasks) {
+			q.tasks[i].enqueued = time.Now()
+		}
+		// queue was saturated and removed from ready list
+		if len(q.tasks) > 0 && q.running == q.parallelism-1 {
+			p.ready = append(p.ready, q)
+			p.cond.Signal()
+		}
+	}
+}
+
+// run calls fn(0) ... fn(n-1) using at most parallelism workers and waits for all
+// calls to complete. fn gets time spent by call in queue of pool. fn is called in
+// place if pool is stopped.
+func (p *fetchPool) run(n, parallelism int, fn func(i int, wait time.Duration)) {
+	if n == 0 {
+		return
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	q := &fetchQueue{
+		parallelism: parallelism,
+		tasks:       make([]fetchTask, n),
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		i := i
+		q.tasks[i].run = func(wait time.Duration) {
+			defer wg.Done()
+			fn(i, wait)
+		}
+		if i < parallelism {
+			q.tasks[i].enqueued = now
+		}
+	}
+
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		for _, task := range q.tasks {
+			task.run(0)
+		}
+		return
+	}
+	p.ready = append(p.ready, q)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	wg.Wait()
+}
+
+// stop waits for queued tasks and stops workers
+func (p *fetchPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// fetchParallel calls fn for every index using fetch worker pool. Without the pool
+// (fetch-workers = 0) files are fetched one by one in the request goroutine. Calls
+// are skipped after ctx is done.
+func (listener *CarbonserverListener) fetchParallel(ctx context.Context, n int, fn func(i int)) {
+	if listener.fetchPool == nil {
+		for i := 0; i < n; i++ {
+			if ctx.Err() != nil {
+				atomic.AddUint64(&listener.metrics.FetchesCancelled, uint64(n-i))
+				return
+			}
+			fn(i)
+		}
+		return
+	}
+
+	listener.fetchPool.run(n, listener.fetchRequestParallelism, func(i int, wait time.Duration) {
+		if ctx.Err() != nil {
+			atomic.AddUint64(&listener.metrics.FetchesCancelled, 1)
+			return
+		}
+		started := time.Now()
+		listener.prometheus.fetchQueueWait(wait)
+		fn(i)
+		listener.prometheus.fetchIODuration(time.Since(started))
+	})
+}
@@ -21,40 +21,60 @@ type Metadata struct {
 type metricFromDisk struct {
 	DiskStartTime time.Time
 	CacheData     []points.Point
-	Timeseries    *whisper.TimeSeries
+	Timeseries    timeSeries
 	Metadata      Metadata
 }
 
-func (listener *CarbonserverListener) fetchFromDisk(metric string, fromTime, untilTime int32) (*metricFromDisk, error) {
+func (listener *CarbonserverListener) fetchFromDisk(metric string, fromTime, untilTime int32, opts fetchOptions) (*metricFromDisk, error) {
 	var step int32
 
-	// We need to obtain the metadata from whisper file anyway.
 	path := listener.whisperData + "/" + strings.Replace(metric, ".", "/", -1) + ".wsp"
-	w, err := whisper.OpenWithOptions(path, &whisper.Options{
-		FLock: listener.flock,
-	})
-	if err != nil {
-		// the FE/carbonzipper often requests metrics we don't have
-		// We shouldn't really see this any more -- expandGlobs() should filter them out
-		atomic.AddUint64(&listener.metrics.NotFound, 1)
-		listener.logger.Error("open error", zap.String("path", path), zap.Error(err))
-		return nil, err
-	}
-
 	logger := listener.logger.With(
 		zap.String("path", path),
 		zap.Int("fromTime", int(fromTime)),
 		zap.Int("untilTime", int(untilTime)),
 	)
 
-	retentions := w.Retentions()
+	// We need to obtain the metadata from whisper file anyway, header is cached to
+	// skip opening of the file on query cache hit.
+	var w *whisper.Whisper
+	var version string
+	if listener.queryCacheEnabled {
+		var err error
+		if version, err = whisperFileVersion(path, time.Now()); err != nil {
+			atomic.AddUint64(&listener.metrics.NotFound, 1)
+			listener.logger.Error("stat error", zap.String("path", path), zap.Error(err))
+			return nil, err
+		}
+	}
+	header := listener.cachedSeriesHeader(metric, version)
+	if header == nil {
+		var err error
+		if w, err = listener.openWhisper(path); err != nil {
+			return nil, err
+		}
+		header = newSeriesHeader(w)
+		listener.cacheSeriesHeader(metric, version, header)
+	}
+
+	retentions := header.retentions
 	now := int32(time.Now().Unix())
 	diff := now - fromTime
 	bestStep := int32(retentions[0].SecondsPerPoint())
-	for _, retention := range retentions {
-		if int32(retention.MaxRetention()) >= diff {
-			step = int32(retention.SecondsPerPoint())
-			break
+	archive := -1
+	switch {
+	case opts.stitch:
+		// result is upsampled to the step of the first archive
+		step = bestStep
+	case opts.resolution > 0:
+		archive = selectArchiveByResolution(retentions, opts.resolution)
+		step = int32(retentions[archive].SecondsPerPoint())
+	default:
+		for _, retention := range retentions {
+			if int32(retention.MaxRetention()) >= diff {
+				step = int32(retention.SecondsPerPoint())
+				break
+			}
 		}
 	}
 
@@ -68,12 +88,7 @@ func (listener *CarbonserverListener) fetchFromDisk(metric string, fromTime, unt
 		step = maxRetention
 	}
 
-	res := &metricFromDisk{
-		Metadata: Metadata{
-			ConsolidationFunc: w.AggregationMethod(),
-			XFilesFactor:      w.XFilesFactor(),
-		},
-	}
+	res := &metricFromDisk{Metadata: header.metadata}
 	if step != bestStep {
 		logger.Debug("cache is not supported for this query (required step != best step)",
 			zap.Int("step", int(step)),
@@ -88,12 +103,46 @@ func (listener *CarbonserverListener) fetchFromDisk(metric string, fromTime, unt
 		listener.prometheus.cacheDuration("wait", waitTime)
 	}
 
+	var cacheKey string
+	if version != "" {
+		cacheKey = seriesCacheKey(metric, version, retentions, step, now, fromTime, untilTime, opts)
+		if points := listener.cachedSeries(cacheKey, opts.format); points != nil {
+			if w != nil {
+				w.Close()
+			}
+			res.Timeseries = points
+			listener.countReturned(points)
+			return res, nil
+		}
+	}
+
+	if w == nil {
+		var err error
+		if w, err = listener.openWhisper(path); err != nil {
+			return nil, err
+		}
+	}
+
 	logger.Debug("fetching disk metric")
 	atomic.AddUint64(&listener.metrics.DiskRequests, 1)
 	listener.prometheus.diskRequest()
 
 	res.DiskStartTime = time.Now()
-	points, err := w.Fetch(int(fromTime), int(untilTime))
+	var points timeSeries
+	var err error
+	switch {
+	case opts.stitch:
+		points, err = fetchStitched(w, retentions, int(now), int(fromTime), int(untilTime))
+	case archive >= 0:
+		points, err = fetchArchive(w, retentions, archive, int(now), int(fromTime), int(untilTime))
+	default:
+		var wpoints *whisper.TimeSeries
+		wpoints, err = w.Fetch(int(fromTime), int(untilTime))
+		// avoid typed nil in interface
+		if wpoints != nil {
+			points = wpoints
+		}
+	}
 	w.Close()
 	if err != nil {
 		logger.Warn("failed to fetch points", zap.Error(err))
@@ -106,18 +155,39 @@ func (listener *CarbonserverListener) fetchFromDisk(metric string, fromTime, unt
 		return nil, errors.New("time range not found")
 	}
 
-	atomic.AddUint64(&listener.metrics.MetricsReturned, 1)
-	listener.prometheus.returnedMetric()
-
 	waitTime := time.Since(res.DiskStartTime)
 	atomic.AddUint64(&listener.metrics.DiskWaitTimeNS, uint64(waitTime.Nanoseconds()))
 	listener.prometheus.diskWaitDuration(waitTime)
 
-	values := points.Values()
-	atomic.AddUint64(&listener.metrics.PointsReturned, uint64(len(values)))
-	listener.prometheus.returnedPoint(len(values))
+	if cacheKey != "" {
+		listener.cacheSeries(cacheKey, points)
+	}
 
 	res.Timeseries = points
+	listener.countReturned(points)
 
 	return res, nil
 }
+
+func (listener *CarbonserverListener) openWhisper(path string) (*whisper.Whisper, error) {
+	w, err := whisper.OpenWithOptions(path, &whisper.Options{
+		FLock: listener.flock,
+	})
+	if err != nil {
+		// the FE/carbonzipper often requests metrics we don't have
+		// We shouldn't really see this any more -- expandGlobs() should filter them out
+		atomic.AddUint64(&listener.metrics.NotFound, 1)
+		listener.logger.Error("open error", zap.String("path", path), zap.Error(err))
+		return nil, err
+	}
+	return w, nil
+}
+
+func (listener *CarbonserverListener) countReturned(points timeSeries) {
+	atomic.AddUint64(&listener.metrics.MetricsReturned, 1)
+	listener.prometheus.returnedMetric()
+
+	values := points.Values()
+	atomic.AddUint64(&listener.metrics.PointsReturned, uint64(len(values)))
+	listener.prometheus.returnedPoint(len(values))
+}
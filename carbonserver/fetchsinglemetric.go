@@ -1,15 +1,20 @@
 package carbonserver
 
 import (
+	"context"
 	"errors"
 	"math"
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.uber.org/zap"
 
 	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/lomik/go-carbon/helper/tracing"
 )
 
 type response struct {
@@ -89,14 +94,22 @@ func (r response) proto3() *protov3.FetchResponse {
 	}
 }
 
-func (listener *CarbonserverListener) fetchSingleMetric(metric string, pathExpression string, fromTime, untilTime int32) (response, error) {
+func (listener *CarbonserverListener) fetchSingleMetric(ctx context.Context, metric string, pathExpression string, fromTime, untilTime int32, opts fetchOptions) (response, error) {
 	logger := listener.logger.With(
 		zap.String("metric", metric),
 		zap.Int("fromTime", int(fromTime)),
 		zap.Int("untilTime", int(untilTime)),
 	)
-	m, err := listener.fetchFromDisk(metric, fromTime, untilTime)
+
+	ctx, span := tracing.StartSpan(ctx, "fetchSingleMetric")
+	span.SetAttributes(attribute.String("metric", metric))
+	defer span.End()
+
+	_, diskSpan := tracing.StartSpan(ctx, "fetchFromDisk")
+	m, err := listener.fetchFromDisk(metric, fromTime, untilTime, opts)
+	diskSpan.End()
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		atomic.AddUint64(&listener.metrics.RenderErrors, 1)
 		logger.Warn("failed to fetch points", zap.Error(err))
 		return response{}, err
@@ -127,7 +140,10 @@ func (listener *CarbonserverListener) fetchSingleMetric(metric string, pathExpre
 		RequestStopTime:   int64(untilTime),
 	}
 
+	_, cacheSpan := tracing.StartSpan(ctx, "cacheMerge")
 	resp.enrichFromCache(listener, m)
+	cacheSpan.End()
+	resp.consolidate(opts.consolidation)
 
 	logger.Debug("fetched",
 		zap.Any("response", resp),
@@ -136,8 +152,8 @@ func (listener *CarbonserverListener) fetchSingleMetric(metric string, pathExpre
 	return resp, nil
 }
 
-func (listener *CarbonserverListener) fetchSingleMetricV2(metric string, fromTime, untilTime int32) (*protov2.FetchResponse, error) {
-	resp, err := listener.fetchSingleMetric(metric, "", fromTime, untilTime)
+func (listener *CarbonserverListener) fetchSingleMetricV2(ctx context.Context, metric string, fromTime, untilTime int32, opts fetchOptions) (*protov2.FetchResponse, error) {
+	resp, err := listener.fetchSingleMetric(ctx, metric, "", fromTime, untilTime, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -145,8 +161,8 @@ func (listener *CarbonserverListener) fetchSingleMetricV2(metric string, fromTim
 	return resp.proto2(), nil
 }
 
-func (listener *CarbonserverListener) fetchSingleMetricV3(metric string, pathExpression string, fromTime, untilTime int32) (*protov3.FetchResponse, error) {
-	resp, err := listener.fetchSingleMetric(metric, pathExpression, fromTime, untilTime)
+func (listener *CarbonserverListener) fetchSingleMetricV3(ctx context.Context, metric string, pathExpression string, fromTime, untilTime int32, opts fetchOptions) (*protov3.FetchResponse, error) {
+	resp, err := listener.fetchSingleMetric(ctx, metric, pathExpression, fromTime, untilTime, opts)
 	if err != nil {
 		return nil, err
 	}
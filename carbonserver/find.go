@@ -30,12 +30,18 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 	// URL: /metrics/find/?local=1&format=pickle&query=the.metric.path.with.glob
 
 	t0 := time.Now()
-	ctx := req.Context()
+	ctx, cancel := listener.withQueryTimeout(req.Context())
+	defer cancel()
+
+	cost := listener.newQueryCost("find", req, t0)
+	ctx = withQueryCost(ctx, cost)
+	defer listener.finishQueryCost(ctx, cost)
 
 	atomic.AddUint64(&listener.metrics.FindRequests, 1)
 
 	format := req.FormValue("format")
 	query := req.Form["query"]
+	details := req.FormValue("details") == "1"
 
 	var response *findResponse
 
@@ -106,6 +112,12 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 		zap.String("format", format),
 	)
 
+	targets := make([]queryTarget, 0, len(query))
+	for _, q := range query {
+		targets = append(targets, queryTarget{Name: q})
+	}
+	cost.setQuery(format, targets)
+
 	if len(query) == 0 {
 		atomic.AddUint64(&listener.metrics.FindErrors, 1)
 		accessLogger.Error("find failed",
@@ -121,6 +133,9 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 	fromCache := false
 	if listener.findCacheEnabled {
 		key := strings.Join(query, ",") + "&" + format
+		if details {
+			key += "&details"
+		}
 		size := uint64(100 * 1024 * 1024)
 		item := listener.findCache.getQueryItem(key, size, 300)
 		res, ok := item.FetchOrLock()
@@ -128,7 +143,7 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 		if !ok {
 			logger.Debug("find cache miss")
 			atomic.AddUint64(&listener.metrics.FindCacheMiss, 1)
-			response, err = listener.findMetrics(ctx, logger, t0, formatCode, query)
+			response, err = listener.findMetrics(ctx, logger, t0, formatCode, query, details)
 			if err != nil {
 				item.StoreAbort()
 			} else {
@@ -141,7 +156,7 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 			fromCache = true
 		}
 	} else {
-		response, err = listener.findMetrics(ctx, logger, t0, formatCode, query)
+		response, err = listener.findMetrics(ctx, logger, t0, formatCode, query, details)
 	}
 
 	if err != nil || response == nil {
@@ -150,6 +165,12 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 		if _, ok := err.(errorNotFound); ok {
 			reason = "Not Found"
 			code = http.StatusNotFound
+		} else if _, ok := err.(errorLimitExceeded); ok {
+			reason = "Bad request"
+			code = http.StatusBadRequest
+		} else if ctxErr := ctx.Err(); ctxErr != nil {
+			listener.countContextError(ctxErr)
+			code, reason = contextErrorStatus(ctxErr)
 		} else {
 			reason = "Internal error while processing request"
 			code = http.StatusInternalServerError
@@ -168,6 +189,7 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 
 	wr.Header().Set("Content-Type", response.contentType)
 	wr.Write(response.data)
+	cost.setResult(0, len(response.data))
 
 	if response.files == 0 {
 		// to get an idea how often we search for nothing
@@ -201,7 +223,9 @@ type globs struct {
 	Leafs []bool
 }
 
-func (listener *CarbonserverListener) findMetrics(ctx context.Context, logger *zap.Logger, t0 time.Time, format responseFormat, names []string) (*findResponse, error) {
+// findMetrics encodes expanded globs in format. Metadata of leafs is added to json and
+// carbonapi_v3_pb responses with details.
+func (listener *CarbonserverListener) findMetrics(ctx context.Context, logger *zap.Logger, t0 time.Time, format responseFormat, names []string, details bool) (*findResponse, error) {
 	var result findResponse
 	metricsCount := uint64(0)
 	expandedGlobs, err := listener.getExpandedGlobs(ctx, logger, t0, names)
@@ -213,31 +237,63 @@ func (listener *CarbonserverListener) findMetrics(ctx context.Context, logger *z
 	case protoV3Format, jsonFormat:
 		var err error
 		multiResponse := protov3.MultiGlobResponse{}
+		detailsResponse := multiGlobResponseDetails{}
+		leafsDetailed := 0
+		fidx := listener.CurrentFileIndex()
 		for _, glob := range expandedGlobs {
 			result.files += len(glob.Files)
+			for i := range glob.Files {
+				if glob.Leafs[i] {
+					metricsCount++
+				}
+			}
+			if details {
+				response, err := listener.globResponseDetails(fidx, glob, &leafsDetailed)
+				if err != nil {
+					atomic.AddUint64(&listener.metrics.FindErrors, 1)
+					logger.Error("find failed",
+						zap.Duration("runtime_seconds", time.Since(t0)),
+						zap.String("reason", "too many metrics for details"),
+						zap.Error(err),
+					)
+					return nil, err
+				}
+				detailsResponse.Metrics = append(detailsResponse.Metrics, response)
+				continue
+			}
+
 			response := protov3.GlobResponse{
 				Name:    glob.Name,
 				Matches: make([]protov3.GlobMatch, 0),
 			}
 
 			for i, p := range glob.Files {
-				if glob.Leafs[i] {
-					metricsCount++
-				}
 				response.Matches = append(response.Matches, protov3.GlobMatch{Path: p, IsLeaf: glob.Leafs[i]})
 			}
 			multiResponse.Metrics = append(multiResponse.Metrics, response)
 		}
 
-		logger.Debug("will send out response",
-			zap.Any("response", multiResponse),
-		)
+		if details {
+			logger.Debug("will send out response",
+				zap.Any("response", detailsResponse),
+			)
+		} else {
+			logger.Debug("will send out response",
+				zap.Any("response", multiResponse),
+			)
+		}
 
-		switch format {
-		case jsonFormat:
+		switch {
+		case details && format == jsonFormat:
+			result.contentType = httpHeaders.ContentTypeJSON
+			result.data, err = json.Marshal(detailsResponse)
+		case details:
+			result.contentType = httpHeaders.ContentTypeCarbonAPIv3PB
+			result.data, err = detailsResponse.marshalProtoV3()
+		case format == jsonFormat:
 			result.contentType = httpHeaders.ContentTypeJSON
 			result.data, err = json.Marshal(multiResponse)
-		case protoV3Format:
+		default:
 			result.contentType = httpHeaders.ContentTypeCarbonAPIv3PB
 			result.data, err = multiResponse.Marshal()
 		}
@@ -253,7 +309,7 @@ func (listener *CarbonserverListener) findMetrics(ctx context.Context, logger *z
 			return nil, err
 		}
 
-		if len(multiResponse.Metrics) == 0 {
+		if len(multiResponse.Metrics) == 0 && len(detailsResponse.Metrics) == 0 {
 			return nil, errorNotFound{}
 		}
 
@@ -343,17 +399,13 @@ GATHER:
 				errors = append(errors, findError{name: expandedResult.Name, err: err})
 			}
 			expandedGlobs = append(expandedGlobs, glob)
+			queryCostFromContext(ctx).addFiles(len(glob.Files))
 			if responseCount == len(names) {
 				break GATHER
 			}
 
 		case <-ctx.Done():
-			switch ctx.Err() {
-			case context.DeadlineExceeded:
-				listener.prometheus.timeoutRequests.Inc()
-			case context.Canceled:
-				listener.prometheus.cancelledRequests.Inc()
-			}
+			// accounted by handler
 			return nil, fmt.Errorf("could not expand globs - %s", ctx.Err().Error())
 		}
 	}
@@ -0,0 +1,152 @@
+package carbonserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-graphite/go-whisper"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// MetricSchema is retention and aggregation of metric from storage-schemas.conf and
+// storage-aggregation.conf
+type MetricSchema struct {
+	Retentions   whisper.Retentions
+	Aggregation  whisper.AggregationMethod
+	XFilesFactor float64
+}
+
+// Numbers of GlobMatch fields with details in carbonapi_v3_pb responses. They are far
+// from fields of GlobMatch, so clients which don't know them skip them
+const (
+	globMatchInfoField    = 100
+	globMatchDetailsField = 101
+)
+
+// globMatchDetails is GlobMatch of find request with details=1. Leaf matches have
+// info (retentions and aggregation of storage schemas) and details (size and last
+// update time from the last file list scan).
+type globMatchDetails struct {
+	protov3.GlobMatch
+	Info    *protov3.MetricsInfoResponse `json:"info,omitempty"`
+	Details *protov3.MetricDetails       `json:"details,omitempty"`
+}
+
+type globResponseDetails struct {
+	Name    string             `json:"name,omitempty"`
+	Matches []globMatchDetails `json:"matches"`
+}
+
+type multiGlobResponseDetails struct {
+	Metrics []globResponseDetails `json:"metrics"`
+}
+
+// errorLimitExceeded is returned if request exceeds limit of carbonserver, e.g.
+// max-metrics-globbed
+type errorLimitExceeded struct {
+	limit string
+	max   int
+}
+
+func (err errorLimitExceeded) Error() string {
+	return fmt.Sprintf("more than %d metrics are requested (%s)", err.max, err.limit)
+}
+
+// matchDetails returns metadata of leaf metric without reading the file. Info is
+// matched by schemaFn, it's nil if schemaFn is not set. Details are taken from the
+// file index, they are collected by file list scan only if internal-stats-dir is set.
+func (listener *CarbonserverListener) matchDetails(fidx *fileIndex, metric string) (*protov3.MetricsInfoResponse, *protov3.MetricDetails) {
+	var info *protov3.MetricsInfoResponse
+	if listener.schemaFn != nil {
+		if schema, ok := listener.schemaFn(metric); ok && len(schema.Retentions) > 0 {
+			aggr := schema.Aggregation.String()
+			info = &protov3.MetricsInfoResponse{
+				Name: metric,
+				// capitalized like aggregation method of whisper file
+				ConsolidationFunc: strings.ToUpper(aggr[:1]) + aggr[1:],
+				XFilesFactor:      float32(schema.XFilesFactor),
+				MaxRetention:      int64(schema.Retentions[len(schema.Retentions)-1].MaxRetention()),
+			}
+			for _, r := range schema.Retentions {
+				info.Retentions = append(info.Retentions, protov3.Retention{
+					SecondsPerPoint: int64(r.SecondsPerPoint()),
+					NumberOfPoints:  int64(r.NumberOfPoints()),
+				})
+			}
+		}
+	}
+
+	var details *protov3.MetricDetails
+	if fidx != nil {
+		if d, ok := fidx.details[metric]; ok {
+			c := *d
+			details = &c
+		}
+	}
+	return info, details
+}
+
+// globResponseDetails adds metadata to leafs of glob. leafs is number of leafs read by
+// the request so far, it's limited by max-metrics-globbed.
+func (listener *CarbonserverListener) globResponseDetails(fidx *fileIndex, glob globs, leafs *int) (globResponseDetails, error) {
+	response := globResponseDetails{
+		Name:    glob.Name,
+		Matches: make([]globMatchDetails, 0, len(glob.Files)),
+	}
+	for i, p := range glob.Files {
+		m := globMatchDetails{GlobMatch: protov3.GlobMatch{Path: p, IsLeaf: glob.Leafs[i]}}
+		if m.IsLeaf {
+			*leafs++
+			if listener.maxMetricsGlobbed > 0 && *leafs > listener.maxMetricsGlobbed {
+				return response, errorLimitExceeded{limit: "max-metrics-globbed", max: listener.maxMetricsGlobbed}
+			}
+			m.Info, m.Details = listener.matchDetails(fidx, p)
+		}
+		response.Matches = append(response.Matches, m)
+	}
+	return response, nil
+}
+
+// marshalProtoV3 encodes response as carbonapi_v3_pb MultiGlobResponse. Info and
+// details are appended to encoded GlobMatch as fields globMatchInfoField and
+// globMatchDetailsField.
+func (r *multiGlobResponseDetails) marshalProtoV3() ([]byte, error) {
+	res := proto.NewBuffer(nil)
+	for _, g := range r.Metrics {
+		glob := proto.NewBuffer(nil)
+		if g.Name != "" {
+			glob.EncodeVarint(1<<3 | proto.WireBytes)
+			glob.EncodeStringBytes(g.Name)
+		}
+		for i := range g.Matches {
+			m := &g.Matches[i]
+			match, err := m.GlobMatch.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			b := proto.NewBuffer(match)
+			if m.Info != nil {
+				data, err := m.Info.Marshal()
+				if err != nil {
+					return nil, err
+				}
+				b.EncodeVarint(globMatchInfoField<<3 | proto.WireBytes)
+				b.EncodeRawBytes(data)
+			}
+			if m.Details != nil {
+				data, err := m.Details.Marshal()
+				if err != nil {
+					return nil, err
+				}
+				b.EncodeVarint(globMatchDetailsField<<3 | proto.WireBytes)
+				b.EncodeRawBytes(data)
+			}
+			glob.EncodeVarint(2<<3 | proto.WireBytes)
+			glob.EncodeRawBytes(b.Bytes())
+		}
+		res.EncodeVarint(1<<3 | proto.WireBytes)
+		res.EncodeRawBytes(glob.Bytes())
+	}
+	return res.Bytes(), nil
+}
@@ -0,0 +1,257 @@
+package carbonserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+)
+
+// APILimit defines limits of single carbonserver endpoint. Zero value means unlimited
+type APILimit struct {
+	// Rate is number of requests per second allowed for single client
+	Rate float64
+	// Burst is size of client's token bucket. Rate is used if not set
+	Burst int
+	// MaxInflight is number of requests of single client processed at the same time
+	MaxInflight int
+	// MaxInflightTotal is number of requests of all clients processed at the same time
+	MaxInflightTotal int
+}
+
+// LimitedEndpoints are names of endpoints which could be limited
+var LimitedEndpoints = []string{"find", "list", "render", "details", "info", "capabilities"}
+
+const (
+	// limitMaxClients is number of clients tracked by single endpoint limiter. Clients
+	// over it share state of limitOtherClient
+	limitMaxClients = 10000
+	// limitMaxLabels is number of client label values of limited_requests_total per
+	// endpoint, other clients are counted as limitOtherClient
+	limitMaxLabels = 100
+	// limitOtherClient is client name of everybody over limitMaxClients or limitMaxLabels
+	limitOtherClient = "other"
+	// limitPruneInterval is how often idle clients are forgotten
+	limitPruneInterval = time.Minute
+)
+
+type clientLimitState struct {
+	tokens   float64
+	updated  time.Time
+	inflight int
+	// limited is number of rejected requests since last Stat call
+	limited uint64
+}
+
+type apiLimiter struct {
+	limit APILimit
+
+	mu       sync.Mutex
+	inflight int
+	clients  map[string]*clientLimitState
+	pruned   time.Time
+	// labels are clients with own label value of limited_requests_total
+	labels map[string]struct{}
+
+	limited uint64
+}
+
+func newAPILimiter(limit APILimit) *apiLimiter {
+	if limit.Rate > 0 && limit.Burst < 1 {
+		limit.Burst = int(limit.Rate)
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+	}
+	return &apiLimiter{
+		limit:   limit,
+		clients: make(map[string]*clientLimitState),
+		labels:  make(map[string]struct{}),
+	}
+}
+
+// acquire returns reason of rejection or empty string if request is accepted, and
+// client name the request is accounted to. release should be called with that name for
+// every accepted request.
+func (l *apiLimiter) acquire(client string, now time.Time) (string, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) >= limitPruneInterval {
+		l.prune(now)
+	}
+
+	c, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= limitMaxClients {
+			client = limitOtherClient
+			c, ok = l.clients[client]
+		}
+		if !ok {
+			c = &clientLimitState{tokens: float64(l.limit.Burst), updated: now}
+			l.clients[client] = c
+		}
+	}
+
+	var reason string
+	if l.limit.Rate > 0 {
+		c.tokens += now.Sub(c.updated).Seconds() * l.limit.Rate
+		if c.tokens > float64(l.limit.Burst) {
+			c.tokens = float64(l.limit.Burst)
+		}
+		c.updated = now
+	}
+
+	switch {
+	case l.limit.MaxInflightTotal > 0 && l.inflight >= l.limit.MaxInflightTotal:
+		reason = "max_inflight_total"
+	case l.limit.MaxInflight > 0 && c.inflight >= l.limit.MaxInflight:
+		reason = "max_inflight"
+	case l.limit.Rate > 0 && c.tokens < 1:
+		reason = "rate"
+	}
+
+	if reason != "" {
+		atomic.AddUint64(&c.limited, 1)
+		atomic.AddUint64(&l.limited, 1)
+		return reason, client
+	}
+
+	if l.limit.Rate > 0 {
+		c.tokens--
+	}
+	c.inflight++
+	l.inflight++
+	return "", client
+}
+
+// prune forgets clients without requests in flight, with full token bucket and
+// limited requests already sent by stat
+func (l *apiLimiter) prune(now time.Time) {
+	for client, c := range l.clients {
+		refilled := l.limit.Rate <= 0 || c.tokens+now.Sub(c.updated).Seconds()*l.limit.Rate >= float64(l.limit.Burst)
+		if c.inflight == 0 && refilled && atomic.LoadUint64(&c.limited) == 0 {
+			delete(l.clients, client)
+		}
+	}
+	l.pruned = now
+}
+
+// label returns value of client label of limited_requests_total. Number of values is
+// capped by limitMaxLabels, the rest are aggregated as limitOtherClient
+func (l *apiLimiter) label(client string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.labels[client]; ok {
+		return client
+	}
+	if len(l.labels) >= limitMaxLabels {
+		return limitOtherClient
+	}
+	l.labels[client] = struct{}{}
+	return client
+}
+
+func (l *apiLimiter) release(client string) {
+	l.mu.Lock()
+	if c, ok := l.clients[client]; ok {
+		c.inflight--
+	}
+	l.inflight--
+	l.mu.Unlock()
+}
+
+// stat sends number of limited requests of endpoint and of every limited client, and
+// forgets idle clients with full token bucket
+func (l *apiLimiter) stat(endpoint string, now time.Time, send helper.StatCallback) {
+	helper.SendAndSubstractUint64(fmt.Sprintf("api_limits.%s.limited", endpoint), &l.limited, send)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	clients := make([]string, 0, len(l.clients))
+	for client := range l.clients {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+
+	for _, client := range clients {
+		c := l.clients[client]
+		if atomic.LoadUint64(&c.limited) > 0 {
+			helper.SendAndSubstractUint64(fmt.Sprintf("api_limits.%s.clients.%s", endpoint, sanitizeClient(client)), &c.limited, send)
+		}
+	}
+	l.prune(now)
+}
+
+func sanitizeClient(client string) string {
+	return strings.NewReplacer(".", "_", ":", "_", " ", "_", "/", "_").Replace(client)
+}
+
+// SetAPILimits sets limits by endpoint name. clientHeader is request header identifying
+// clients, e.g. X-Forwarded-For or X-Grafana-Org-Id, peer address is used if it's empty or
+// not sent. It should be stable for the client, unlike per-request TraceHeaders.
+func (listener *CarbonserverListener) SetAPILimits(limits map[string]APILimit, clientHeader string) {
+	listener.apiLimiters = make(map[string]*apiLimiter, len(limits))
+	for endpoint, limit := range limits {
+		listener.apiLimiters[endpoint] = newAPILimiter(limit)
+	}
+	listener.apiLimitsClientHeader = clientHeader
+}
+
+func (listener *CarbonserverListener) limitClient(req *http.Request) string {
+	if listener.apiLimitsClientHeader != "" {
+		if v := req.Header.Get(listener.apiLimitsClientHeader); v != "" {
+			// X-Forwarded-For is "client, proxy1, proxy2"
+			if i := strings.IndexByte(v, ','); i >= 0 {
+				v = v[:i]
+			}
+			return strings.TrimSpace(v)
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// limitHandler rejects requests over the limit of endpoint with 429 status
+func (listener *CarbonserverListener) limitHandler(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	limiter, ok := listener.apiLimiters[endpoint]
+	if !ok {
+		return h
+	}
+
+	return func(wr http.ResponseWriter, req *http.Request) {
+		reason, client := limiter.acquire(listener.limitClient(req), time.Now())
+		if reason != "" {
+			listener.prometheus.limitedRequest(endpoint, limiter.label(client), reason)
+			TraceContextToZap(req.Context(), listener.accessLogger).Warn("request limited",
+				zap.String("handler", endpoint),
+				zap.String("url", req.URL.RequestURI()),
+				zap.String("peer", req.RemoteAddr),
+				zap.String("client", client),
+				zap.String("reason", reason),
+				zap.Int("http_code", http.StatusTooManyRequests),
+			)
+			if reason == "rate" {
+				wr.Header().Set("Retry-After", "1")
+			}
+			http.Error(wr, fmt.Sprintf("Too Many Requests (%s)", reason), http.StatusTooManyRequests)
+			return
+		}
+		defer limiter.release(client)
+
+		h(wr, req)
+	}
+}
@@ -0,0 +1,331 @@
+package carbonserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// QueryCostThresholds defines expensive find and render requests. Zero value disables
+// the threshold.
+type QueryCostThresholds struct {
+	Duration  time.Duration
+	Files     int64
+	TrieNodes int64
+	Points    int64
+	Bytes     int64
+}
+
+type globLimitReport struct {
+	Glob       string `json:"glob"`
+	Files      int    `json:"files"`
+	TrieNodes  int    `json:"trie_nodes"`
+	LastMetric string `json:"last_metric"`
+}
+
+// queryTarget is query of find request or target of render request
+type queryTarget struct {
+	Name  string `json:"name"`
+	From  int32  `json:"from,omitempty"`
+	Until int32  `json:"until,omitempty"`
+}
+
+// renderQueryTargets returns targets of render request sorted by name and time range
+func renderQueryTargets(targets map[timeRange][]target) []queryTarget {
+	var res []queryTarget
+	for tr, ts := range targets {
+		for _, t := range ts {
+			res = append(res, queryTarget{Name: t.Name, From: tr.from, Until: tr.until})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		if res[i].From != res[j].From {
+			return res[i].From < res[j].From
+		}
+		return res[i].Until < res[j].Until
+	})
+	return res
+}
+
+// queryCost is collected for every find and render request. Counters are updated
+// concurrently by glob expansion goroutines.
+type queryCost struct {
+	handler string
+	url     string
+	peer    string
+	start   time.Time
+
+	files     int64
+	trieNodes int64
+	points    int64
+	bytes     int64
+
+	mu sync.Mutex
+	// format and targets are parsed from url or body of carbonapi_v3_pb request
+	format  string
+	targets []queryTarget
+	// globLimit is set if glob expansion was stopped by max-metrics-globbed
+	globLimit *globLimitReport
+}
+
+// queryCostEntry is a snapshot of finished request cost
+type queryCostEntry struct {
+	Handler   string           `json:"handler"`
+	URL       string           `json:"url"`
+	Peer      string           `json:"peer"`
+	Format    string           `json:"format,omitempty"`
+	Targets   []queryTarget    `json:"targets,omitempty"`
+	Time      time.Time        `json:"time"`
+	Duration  time.Duration    `json:"duration_ns"`
+	Files     int64            `json:"files"`
+	TrieNodes int64            `json:"trie_nodes"`
+	Points    int64            `json:"points,omitempty"` // render only
+	Bytes     int64            `json:"bytes"`
+	GlobLimit *globLimitReport `json:"glob_limit,omitempty"`
+}
+
+type queryCostKey struct{}
+
+func withQueryCost(ctx context.Context, cost *queryCost) context.Context {
+	return context.WithValue(ctx, queryCostKey{}, cost)
+}
+
+// queryCostFromContext returns nil if request cost is not collected
+func queryCostFromContext(ctx context.Context) *queryCost {
+	cost, _ := ctx.Value(queryCostKey{}).(*queryCost)
+	return cost
+}
+
+func (c *queryCost) addFiles(n int) {
+	if c != nil {
+		atomic.AddInt64(&c.files, int64(n))
+	}
+}
+
+func (c *queryCost) addTrieNodes(n int) {
+	if c != nil {
+		atomic.AddInt64(&c.trieNodes, int64(n))
+	}
+}
+
+// reportGlobLimit keeps the first glob stopped by max-metrics-globbed
+func (c *queryCost) reportGlobLimit(report globLimitReport) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.globLimit == nil {
+		c.globLimit = &report
+	}
+	c.mu.Unlock()
+}
+
+// setQuery sets parsed request
+func (c *queryCost) setQuery(format string, targets []queryTarget) {
+	c.mu.Lock()
+	c.format = format
+	c.targets = targets
+	c.mu.Unlock()
+}
+
+// setResult sets size of request response
+func (c *queryCost) setResult(points, bytes int) {
+	c.mu.Lock()
+	c.points = int64(points)
+	c.bytes = int64(bytes)
+	c.mu.Unlock()
+}
+
+func (c *queryCost) entry() *queryCostEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &queryCostEntry{
+		Handler:   c.handler,
+		URL:       c.url,
+		Peer:      c.peer,
+		Format:    c.format,
+		Targets:   c.targets,
+		Time:      c.start,
+		Duration:  time.Since(c.start),
+		Files:     atomic.LoadInt64(&c.files),
+		TrieNodes: atomic.LoadInt64(&c.trieNodes),
+		Points:    c.points,
+		Bytes:     c.bytes,
+		GlobLimit: c.globLimit,
+	}
+}
+
+func (e *queryCostEntry) value(by string) int64 {
+	switch by {
+	case "files":
+		return e.Files
+	case "trie_nodes":
+		return e.TrieNodes
+	case "points":
+		return e.Points
+	case "bytes":
+		return e.Bytes
+	default:
+		return int64(e.Duration)
+	}
+}
+
+// exceeded returns names of thresholds exceeded by request
+func (t QueryCostThresholds) exceeded(e *queryCostEntry) []string {
+	var res []string
+	check := func(name string, threshold, value int64) {
+		if threshold > 0 && value >= threshold {
+			res = append(res, name)
+		}
+	}
+	check("duration", int64(t.Duration), int64(e.Duration))
+	check("files", t.Files, e.Files)
+	check("trie_nodes", t.TrieNodes, e.TrieNodes)
+	check("points", t.Points, e.Points)
+	check("bytes", t.Bytes, e.Bytes)
+	if e.GlobLimit != nil {
+		res = append(res, "max_metrics_globbed")
+	}
+	return res
+}
+
+// topQueries keeps costs of the recent requests
+type topQueries struct {
+	mu      sync.Mutex
+	entries []*queryCostEntry
+	next    int
+}
+
+func newTopQueries(capacity int) *topQueries {
+	return &topQueries{entries: make([]*queryCostEntry, 0, capacity)}
+}
+
+func (tq *topQueries) add(c *queryCostEntry) {
+	tq.mu.Lock()
+	if len(tq.entries) < cap(tq.entries) {
+		tq.entries = append(tq.entries, c)
+	} else {
+		tq.entries[tq.next] = c
+		tq.next = (tq.next + 1) % len(tq.entries)
+	}
+	tq.mu.Unlock()
+}
+
+// top returns n the most expensive recent requests by cost dimension
+func (tq *topQueries) top(by string, n int) []*queryCostEntry {
+	tq.mu.Lock()
+	res := make([]*queryCostEntry, len(tq.entries))
+	copy(res, tq.entries)
+	tq.mu.Unlock()
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].value(by) > res[j].value(by) })
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// SetSlowQueryThresholds sets thresholds of requests written to slow_query log
+func (listener *CarbonserverListener) SetSlowQueryThresholds(thresholds QueryCostThresholds) {
+	listener.slowQueryThresholds = thresholds
+}
+
+// SetTopQueriesCapacity sets number of recent requests shown by /admin/topqueries. 0 - disabled
+func (listener *CarbonserverListener) SetTopQueriesCapacity(capacity int) {
+	if capacity <= 0 {
+		listener.topQueries = nil
+		return
+	}
+	listener.topQueries = newTopQueries(capacity)
+}
+
+func (listener *CarbonserverListener) newQueryCost(handler string, req *http.Request, t0 time.Time) *queryCost {
+	return &queryCost{
+		handler: handler,
+		url:     req.URL.RequestURI(),
+		peer:    req.RemoteAddr,
+		start:   t0,
+	}
+}
+
+// finishQueryCost writes expensive request to slow query log and remembers it for
+// /admin/topqueries
+func (listener *CarbonserverListener) finishQueryCost(ctx context.Context, cost *queryCost) {
+	e := cost.entry()
+
+	if listener.topQueries != nil {
+		listener.topQueries.add(e)
+	}
+
+	exceeded := listener.slowQueryThresholds.exceeded(e)
+	if len(exceeded) == 0 {
+		return
+	}
+
+	atomic.AddUint64(&listener.metrics.SlowQueries, 1)
+	fields := []zap.Field{
+		zap.String("handler", e.Handler),
+		zap.String("url", e.URL),
+		zap.String("peer", e.Peer),
+		zap.String("format", e.Format),
+		zap.Any("targets", e.Targets),
+		zap.Duration("runtime_seconds", e.Duration),
+		zap.Int64("files", e.Files),
+		zap.Int64("trie_nodes", e.TrieNodes),
+		zap.Int64("bytes", e.Bytes),
+		zap.Strings("exceeded", exceeded),
+	}
+	if e.Handler == "render" {
+		// find responses have no points
+		fields = append(fields, zap.Int64("points", e.Points))
+	}
+	if e.GlobLimit != nil {
+		fields = append(fields, zap.Any("glob_limit", e.GlobLimit))
+	}
+	TraceContextToZap(ctx, listener.slowQueryLogger).Warn("slow query", fields...)
+}
+
+func (listener *CarbonserverListener) topQueriesHandler(wr http.ResponseWriter, req *http.Request) {
+	if listener.topQueries == nil {
+		http.Error(wr, "top queries are disabled (top-queries-capacity = 0)", http.StatusNotFound)
+		return
+	}
+
+	by := req.FormValue("by")
+	switch by {
+	case "":
+		by = "duration"
+	case "duration", "files", "trie_nodes", "points", "bytes":
+	default:
+		http.Error(wr, fmt.Sprintf("Bad request (unknown cost %q)", by), http.StatusBadRequest)
+		return
+	}
+
+	n := 10
+	if v := req.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(wr, fmt.Sprintf("Bad request (invalid n %q)", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	b, err := json.Marshal(listener.topQueries.top(by, n))
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Write(b)
+}
@@ -29,11 +29,17 @@ type fetchResponse struct {
 	valuesFetched  int
 	memoryUsed     int
 	metrics        []string
+	// partial is set if query timeout is exceeded and only part of metrics is fetched
+	partial bool
 }
 
 type target struct {
 	Name           string
 	PathExpression string
+	MaxDataPoints  int64
+	ConsolidateBy  string
+	Resolution     int32
+	Stitch         bool
 }
 
 type timeRange struct {
@@ -41,6 +47,14 @@ type timeRange struct {
 	until int32
 }
 
+func (t target) fetchOptions() fetchOptions {
+	return fetchOptions{
+		consolidation: consolidation{maxDataPoints: t.MaxDataPoints, function: t.ConsolidateBy},
+		resolution:    t.Resolution,
+		stitch:        t.Stitch,
+	}
+}
+
 func getTargetNames(targets map[timeRange][]target) []string {
 	c := 0
 	for _, v := range targets {
@@ -91,6 +105,45 @@ func getFormat(req *http.Request) (responseFormat, error) {
 func getTargets(req *http.Request, format responseFormat) (map[timeRange][]target, error) {
 	targets := make(map[timeRange][]target)
 
+	// consolidateBy, resolution and stitch are the same for all targets, they are passed
+	// in url for protobuf requests too. maxDataPoints of url is used for protobuf
+	// requests only if FetchRequest of target has no maxDataPoints
+	var maxDataPoints int64
+	if v := req.FormValue("maxDataPoints"); v != "" {
+		var err error
+		maxDataPoints, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxDataPoints < 0 {
+			return targets, fmt.Errorf("invalid 'maxDataPoints'")
+		}
+	}
+
+	consolidateBy := req.FormValue("consolidateBy")
+	if err := checkConsolidateBy(consolidateBy); err != nil {
+		return targets, err
+	}
+
+	var resolution int32
+	if v := req.FormValue("resolution"); v != "" {
+		var err error
+		resolution, err = stringToInt32(v)
+		if err != nil || resolution <= 0 {
+			return targets, fmt.Errorf("invalid 'resolution'")
+		}
+	}
+
+	var stitch bool
+	if v := req.FormValue("stitch"); v != "" {
+		var err error
+		stitch, err = strconv.ParseBool(v)
+		if err != nil {
+			return targets, fmt.Errorf("invalid 'stitch'")
+		}
+	}
+
+	if stitch && resolution > 0 {
+		return targets, fmt.Errorf("'resolution' and 'stitch' can't be used together")
+	}
+
 	switch format {
 	case protoV3Format:
 		body, err := ioutil.ReadAll(req.Body)
@@ -108,7 +161,21 @@ func getTargets(req *http.Request, format responseFormat) (map[timeRange][]targe
 				from:  int32(t.StartTime),
 				until: int32(t.StopTime),
 			}
-			targets[tr] = append(targets[tr], target{Name: t.Name, PathExpression: t.PathExpression})
+			if t.MaxDataPoints < 0 {
+				return targets, fmt.Errorf("invalid 'maxDataPoints' of target %q", t.Name)
+			}
+			mdp := t.MaxDataPoints
+			if mdp == 0 {
+				mdp = maxDataPoints
+			}
+			targets[tr] = append(targets[tr], target{
+				Name:           t.Name,
+				PathExpression: t.PathExpression,
+				MaxDataPoints:  mdp,
+				ConsolidateBy:  consolidateBy,
+				Resolution:     resolution,
+				Stitch:         stitch,
+			})
 		}
 
 	default:
@@ -125,7 +192,14 @@ func getTargets(req *http.Request, format responseFormat) (map[timeRange][]targe
 		tr := timeRange{from: from, until: until}
 
 		for _, t := range req.Form["target"] {
-			targets[tr] = append(targets[tr], target{Name: t, PathExpression: t})
+			targets[tr] = append(targets[tr], target{
+				Name:           t,
+				PathExpression: t,
+				MaxDataPoints:  maxDataPoints,
+				ConsolidateBy:  consolidateBy,
+				Resolution:     resolution,
+				Stitch:         stitch,
+			})
 		}
 	}
 
@@ -135,7 +209,12 @@ func getTargets(req *http.Request, format responseFormat) (map[timeRange][]targe
 func (listener *CarbonserverListener) renderHandler(wr http.ResponseWriter, req *http.Request) {
 	// URL: /render/?target=the.metric.Name&format=pickle&from=1396008021&until=1396022421
 	t0 := time.Now()
-	ctx := req.Context()
+	ctx, cancel := listener.withQueryTimeout(req.Context())
+	defer cancel()
+
+	cost := listener.newQueryCost("render", req, t0)
+	ctx = withQueryCost(ctx, cost)
+	defer listener.finishQueryCost(ctx, cost)
 
 	atomic.AddUint64(&listener.metrics.RenderRequests, 1)
 
@@ -173,6 +252,8 @@ func (listener *CarbonserverListener) renderHandler(wr http.ResponseWriter, req
 		return
 	}
 
+	cost.setQuery(format.String(), renderQueryTargets(targets))
+
 	tgs := getTargetNames(targets)
 	accessLogger = accessLogger.With(
 		zap.Strings("targets", tgs),
@@ -204,11 +285,42 @@ func (listener *CarbonserverListener) renderHandler(wr http.ResponseWriter, req
 		}
 	}()
 
-	response, fromCache, err := listener.fetchWithCache(ctx, logger, format, targets)
+	var response fetchResponse
+	streamed := listener.streamRender && streamingSupported(format)
+	if streamed {
+		response, err = listener.streamDataProto(ctx, wr, logger, format, targets)
+	} else {
+		response, err = listener.prepareDataProto(ctx, logger, format, targets)
+		wr.Header().Set("Content-Type", response.contentType)
+	}
 
-	wr.Header().Set("Content-Type", response.contentType)
 	if err != nil {
 		atomic.AddUint64(&listener.metrics.RenderErrors, 1)
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			listener.countContextError(ctxErr)
+		}
+		if streamed && response.metricsFetched > 0 {
+			// headers and part of the response are already sent
+			accessLogger.Error("fetch failed",
+				zap.Duration("runtime_seconds", time.Since(t0)),
+				zap.String("reason", "failed to stream data"),
+				zap.Int("metrics_fetched", response.metricsFetched),
+				zap.Error(err),
+			)
+			return
+		}
+		if ctxErr != nil {
+			code, reason := contextErrorStatus(ctxErr)
+			accessLogger.Error("fetch failed",
+				zap.Duration("runtime_seconds", time.Since(t0)),
+				zap.String("reason", reason),
+				zap.Int("http_code", code),
+				zap.Error(err),
+			)
+			http.Error(wr, reason, code)
+			return
+		}
 		accessLogger.Error("fetch failed",
 			zap.Duration("runtime_seconds", time.Since(t0)),
 			zap.String("reason", "failed to read data"),
@@ -235,13 +347,24 @@ func (listener *CarbonserverListener) renderHandler(wr http.ResponseWriter, req
 		listener.UpdateMetricsAccessTimesByRequest(response.metrics)
 	}
 
-	wr.Write(response.data)
+	if response.partial {
+		listener.countContextError(context.DeadlineExceeded)
+	}
+
+	if !streamed {
+		if response.partial {
+			wr.Header().Set(partialResultHeader, "true")
+		}
+		wr.Write(response.data)
+	}
 
 	atomic.AddUint64(&listener.metrics.FetchSize, uint64(response.memoryUsed))
+	cost.setResult(response.valuesFetched, response.memoryUsed)
 	logger.Info("fetch served",
 		zap.Duration("runtime_seconds", time.Since(t0)),
 		zap.Bool("query_cache_enabled", listener.queryCacheEnabled),
-		zap.Bool("from_cache", fromCache),
+		zap.Bool("streamed", streamed),
+		zap.Bool("partial", response.partial),
 		zap.Int("metrics_fetched", response.metricsFetched),
 		zap.Int("values_fetched", response.valuesFetched),
 		zap.Int("memory_used_bytes", response.memoryUsed),
@@ -250,83 +373,8 @@ func (listener *CarbonserverListener) renderHandler(wr http.ResponseWriter, req
 
 }
 
-func (listener *CarbonserverListener) fetchWithCache(ctx context.Context, logger *zap.Logger, format responseFormat, targets map[timeRange][]target) (fetchResponse, bool, error) {
-	logger = logger.With(
-		zap.String("function", "fetchWithCache"),
-	)
-	fromCache := false
-	var err error
-
-	var response fetchResponse
-	if listener.queryCacheEnabled {
-		targetKeys := make([]string, 0, len(targets))
-		for tr, ts := range targets {
-			names := make([]string, 0, len(ts))
-			for _, t := range ts {
-				names = append(names, t.Name)
-			}
-			targetKeys = append(targetKeys, fmt.Sprintf("%s&%d&%d", strings.Join(names, "&"), tr.from, tr.until))
-		}
-		key := fmt.Sprintf("%s&%s", strings.Join(targetKeys, "&"), format)
-
-		size := uint64(100 * 1024 * 1024)
-		renderRequests := atomic.LoadUint64(&listener.metrics.RenderRequests)
-		fetchSize := atomic.LoadUint64(&listener.metrics.FetchSize)
-		if renderRequests > 0 {
-			size = fetchSize / renderRequests
-		}
-
-		// TODO(gmagnusson): Our cache key changes if we permute any of the
-		// metric names while keeping the from/until pairs fixed, or permute
-		// any combination of metric names and from/until pairs as a unit.
-		// These permutations to not change the response, so we should be more
-		// clever about how we construct the cache key.
-		//
-		// An option is to sort the metric names within each from/until pair,
-		// and to order (names,from,until) triples by the from timestamp.
-		//
-		// This is probably worth doing, as the only source of differences in
-		// from/until pairs I know of comes from using timeShift or timeStack,
-		// which again probably comes from trying to compare trends from last
-		// week to what's going on now, which is something people are generally
-		// interested in. It wouldn't be good to start adding false negative
-		// cache misses to those kinds of queries.
-		item := listener.queryCache.getQueryItem(key, size, 60)
-		res, ok := item.FetchOrLock()
-		listener.prometheus.cacheRequest("query", ok)
-		if !ok {
-			logger.Debug("query cache miss")
-			atomic.AddUint64(&listener.metrics.QueryCacheMiss, 1)
-
-			response, err = listener.prepareDataProto(ctx, logger, format, targets)
-			if err != nil {
-				item.StoreAbort()
-			} else {
-				item.StoreAndUnlock(response)
-			}
-		} else {
-			logger.Debug("query cache hit")
-			atomic.AddUint64(&listener.metrics.QueryCacheHit, 1)
-
-			response = res.(fetchResponse)
-			fromCache = true
-		}
-	} else {
-		response, err = listener.prepareDataProto(ctx, logger, format, targets)
-	}
-	return response, fromCache, err
-}
-
-func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logger *zap.Logger, format responseFormat, targets map[timeRange][]target) (fetchResponse, error) {
-	contentType := "application/text"
-	var b []byte
-	var metricsFetched int
-	var memoryUsed int
-	var valuesFetched int
-
-	var multiv3 protov3.MultiFetchResponse
-	var multiv2 protov2.MultiFetchResponse
-
+// expandTargetGlobs returns expanded globs by target name. nil - globs can't be expanded
+func (listener *CarbonserverListener) expandTargetGlobs(ctx context.Context, logger *zap.Logger, targets map[timeRange][]target) (map[string]globs, error) {
 	metricMap := make(map[string]bool)
 
 	for _, ts := range targets {
@@ -340,10 +388,13 @@ func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logg
 		metricNames[i] = k
 		i++
 	}
+	if len(metricNames) == 0 {
+		return nil, nil
+	}
 	expandedGlobs, err := listener.getExpandedGlobs(ctx, logger, time.Now(), metricNames)
 
 	if expandedGlobs == nil {
-		return fetchResponse{nil, contentType, 0, 0, 0, nil}, err
+		return nil, err
 	}
 
 	metricGlobMap := make(map[string]globs)
@@ -351,12 +402,38 @@ func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logg
 		metricGlobMap[strings.Replace(expandedGlob.Name, "/", ".", -1)] = expandedGlob
 	}
 
+	return metricGlobMap, err
+}
+
+func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logger *zap.Logger, format responseFormat, targets map[timeRange][]target) (fetchResponse, error) {
+	contentType := "application/text"
+	var b []byte
+	var metricsFetched int
+	var memoryUsed int
+	var valuesFetched int
+
+	var multiv3 protov3.MultiFetchResponse
+	var multiv2 protov2.MultiFetchResponse
+
+	metricGlobMap, err := listener.expandTargetGlobs(ctx, logger, targets)
+	if metricGlobMap == nil {
+		return fetchResponse{contentType: contentType}, err
+	}
+
 	var metrics []string
+FETCH:
 	for tr, ts := range targets {
 		for _, metric := range ts {
+			if ctx.Err() != nil {
+				break FETCH
+			}
+
 			fromTime := tr.from
 			untilTime := tr.until
 
+			opts := metric.fetchOptions()
+			opts.format = format
+
 			listener.logger.Debug("fetching data...")
 			if expandedResult, ok := metricGlobMap[metric.Name]; ok {
 				files, leafs := expandedResult.Files, expandedResult.Leafs
@@ -381,7 +458,7 @@ func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logg
 				)
 
 				if format == protoV2Format || format == jsonFormat {
-					res, err := listener.fetchDataPB(metric.Name, files, leafs, fromTime, untilTime)
+					res, err := listener.fetchDataPB(ctx, metric.Name, files, leafs, fromTime, untilTime, opts)
 					if err != nil {
 						atomic.AddUint64(&listener.metrics.RenderErrors, 1)
 						listener.logger.Error("error while fetching the data",
@@ -391,7 +468,7 @@ func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logg
 					}
 					multiv2.Metrics = append(multiv2.Metrics, res.Metrics...)
 				} else {
-					res, err := listener.fetchDataPB3(metric.Name, files, leafs, fromTime, untilTime)
+					res, err := listener.fetchDataPB3(ctx, metric.Name, files, leafs, fromTime, untilTime, opts)
 					if err != nil {
 						atomic.AddUint64(&listener.metrics.RenderErrors, 1)
 						listener.logger.Error("error while fetching the data",
@@ -414,9 +491,17 @@ func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logg
 		}
 	}
 
+	var partial bool
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if ctxErr != context.DeadlineExceeded || !listener.queryTimeoutPartial || len(multiv2.Metrics)+len(multiv3.Metrics) == 0 {
+			return fetchResponse{contentType: contentType}, ctxErr
+		}
+		partial = true
+	}
+
 	if format == protoV2Format || format == jsonFormat {
 		if len(multiv2.Metrics) == 0 && format == protoV2Format {
-			return fetchResponse{nil, contentType, 0, 0, 0, nil}, err
+			return fetchResponse{contentType: contentType}, err
 		}
 
 		metricsFetched = len(multiv2.Metrics)
@@ -427,7 +512,7 @@ func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logg
 		}
 	} else {
 		if len(multiv3.Metrics) == 0 && format == protoV3Format {
-			return fetchResponse{nil, contentType, 0, 0, 0, nil}, err
+			return fetchResponse{contentType: contentType}, err
 		}
 
 		metricsFetched = len(multiv3.Metrics)
@@ -492,28 +577,30 @@ func (listener *CarbonserverListener) prepareDataProto(ctx context.Context, logg
 	}
 
 	if err != nil {
-		return fetchResponse{nil, contentType, 0, 0, 0, nil}, err
+		return fetchResponse{contentType: contentType}, err
 	}
-	return fetchResponse{b, contentType, metricsFetched, valuesFetched, memoryUsed, metrics}, nil
+	return fetchResponse{b, contentType, metricsFetched, valuesFetched, memoryUsed, metrics, partial}, nil
 }
 
-func (listener *CarbonserverListener) fetchDataPB3(pathExpression string, files []string, leafs []bool, fromTime, untilTime int32) (*protov3.MultiFetchResponse, error) {
-	var multi protov3.MultiFetchResponse
-	var errs []error
-	for i, fileName := range files {
+func (listener *CarbonserverListener) fetchDataPB3(ctx context.Context, pathExpression string, files []string, leafs []bool, fromTime, untilTime int32, opts fetchOptions) (*protov3.MultiFetchResponse, error) {
+	responses := make([]*protov3.FetchResponse, len(files))
+	errs := make([]error, len(files))
+	listener.fetchParallel(ctx, len(files), func(i int) {
 		if !leafs[i] {
 			listener.logger.Debug("skipping directory", zap.String("PathExpression", pathExpression))
 			// can't fetch a directory
-			continue
+			return
 		}
-		response, err := listener.fetchSingleMetricV3(fileName, pathExpression, fromTime, untilTime)
-		if err == nil {
+		responses[i], errs[i] = listener.fetchSingleMetricV3(ctx, files[i], pathExpression, fromTime, untilTime, opts)
+	})
+
+	var multi protov3.MultiFetchResponse
+	for _, response := range responses {
+		if response != nil {
 			multi.Metrics = append(multi.Metrics, *response)
-		} else {
-			errs = append(errs, err)
 		}
 	}
-	if len(errs) != 0 {
+	if errs = nonNilErrors(errs); len(errs) != 0 {
 		listener.logger.Warn("errors occur while fetching data",
 			zap.Any("errors", errs),
 		)
@@ -521,26 +608,38 @@ func (listener *CarbonserverListener) fetchDataPB3(pathExpression string, files
 	return &multi, nil
 }
 
-func (listener *CarbonserverListener) fetchDataPB(metric string, files []string, leafs []bool, fromTime, untilTime int32) (*protov2.MultiFetchResponse, error) {
-	var multi protov2.MultiFetchResponse
-	var errs []error
-	for i, metric := range files {
+func (listener *CarbonserverListener) fetchDataPB(ctx context.Context, metric string, files []string, leafs []bool, fromTime, untilTime int32, opts fetchOptions) (*protov2.MultiFetchResponse, error) {
+	responses := make([]*protov2.FetchResponse, len(files))
+	errs := make([]error, len(files))
+	listener.fetchParallel(ctx, len(files), func(i int) {
 		if !leafs[i] {
-			listener.logger.Debug("skipping directory", zap.String("metric", metric))
+			listener.logger.Debug("skipping directory", zap.String("metric", files[i]))
 			// can't fetch a directory
-			continue
+			return
 		}
-		response, err := listener.fetchSingleMetricV2(metric, fromTime, untilTime)
-		if err == nil {
+		responses[i], errs[i] = listener.fetchSingleMetricV2(ctx, files[i], fromTime, untilTime, opts)
+	})
+
+	var multi protov2.MultiFetchResponse
+	for _, response := range responses {
+		if response != nil {
 			multi.Metrics = append(multi.Metrics, *response)
-		} else {
-			errs = append(errs, err)
 		}
 	}
-	if len(errs) != 0 {
+	if errs = nonNilErrors(errs); len(errs) != 0 {
 		listener.logger.Warn("errors occur while fetching data",
 			zap.Any("errors", errs),
 		)
 	}
 	return &multi, nil
 }
+
+func nonNilErrors(errs []error) []error {
+	var res []error
+	for _, err := range errs {
+		if err != nil {
+			res = append(res, err)
+		}
+	}
+	return res
+}
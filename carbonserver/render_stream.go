@@ -0,0 +1,186 @@
+package carbonserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonzipper/zipper/httpHeaders"
+)
+
+const streamBufferSize = 64 * 1024
+
+// seriesWriter encodes fetched series one by one. Protobuf v3 response is a valid
+// MultiFetchResponse: every series is written as length-delimited `metrics` field.
+// Json response is the same as not streamed one.
+type seriesWriter struct {
+	w      http.ResponseWriter
+	buf    *bufio.Writer
+	format responseFormat
+	count  int
+	data   []byte
+}
+
+// write sends headers before the first series, so not found response could still be
+// returned if nothing was written
+func (sw *seriesWriter) write(r response) (int, error) {
+	if sw.buf == nil {
+		switch sw.format {
+		case protoV3Format:
+			sw.w.Header().Set("Content-Type", httpHeaders.ContentTypeCarbonAPIv3PB)
+		case jsonFormat:
+			sw.w.Header().Set("Content-Type", "application/json")
+		}
+		sw.buf = bufio.NewWriterSize(sw.w, streamBufferSize)
+
+		if sw.format == jsonFormat {
+			sw.buf.WriteString(`{"metrics":[`)
+		}
+	}
+
+	var err error
+	switch sw.format {
+	case protoV3Format:
+		m := r.proto3()
+		size := m.Size()
+		if cap(sw.data) < 1+binary.MaxVarintLen64+size {
+			sw.data = make([]byte, 1+binary.MaxVarintLen64+size)
+		}
+		sw.data = sw.data[:cap(sw.data)]
+		// field 1, wire type 2
+		sw.data[0] = 0xa
+		n := 1 + binary.PutUvarint(sw.data[1:], uint64(size))
+		var l int
+		l, err = m.MarshalTo(sw.data[n:])
+		sw.data = sw.data[:n+l]
+	case jsonFormat:
+		sw.data = sw.data[:0]
+		if sw.count > 0 {
+			sw.data = append(sw.data, ',')
+		}
+		var b []byte
+		b, err = json.Marshal(r.proto2())
+		sw.data = append(sw.data, b...)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sw.count++
+	return sw.buf.Write(sw.data)
+}
+
+func (sw *seriesWriter) close() error {
+	if sw.buf == nil {
+		return nil
+	}
+	if sw.format == jsonFormat {
+		sw.buf.WriteString("]}")
+	}
+	return sw.buf.Flush()
+}
+
+// streamingSupported returns true if response of format could be streamed
+func streamingSupported(format responseFormat) bool {
+	return format == protoV3Format || format == jsonFormat
+}
+
+// streamDataProto writes every series to the client as soon as it's fetched, so
+// memory usage doesn't depend on amount of fetched metrics. Returned response has no
+// data, memoryUsed is amount of written bytes.
+func (listener *CarbonserverListener) streamDataProto(ctx context.Context, wr http.ResponseWriter, logger *zap.Logger, format responseFormat, targets map[timeRange][]target) (fetchResponse, error) {
+	var res fetchResponse
+
+	metricGlobMap, err := listener.expandTargetGlobs(ctx, logger, targets)
+	if metricGlobMap == nil {
+		return res, err
+	}
+
+	sw := &seriesWriter{w: wr, format: format}
+STREAM:
+	for tr, ts := range targets {
+		for _, metric := range ts {
+			expandedResult, ok := metricGlobMap[metric.Name]
+			if !ok {
+				continue
+			}
+
+			files, leafs := expandedResult.Files, expandedResult.Leafs
+			if len(files) > listener.maxMetricsRendered {
+				files = files[:listener.maxMetricsRendered]
+				leafs = leafs[:listener.maxMetricsRendered]
+			}
+
+			var leafFiles []string
+			for i, file := range files {
+				// can't fetch a directory
+				if leafs[i] {
+					leafFiles = append(leafFiles, file)
+				}
+			}
+
+			// files are fetched in batches to keep memory usage bounded while worker
+			// pool is used, and written in order of expanded globs
+			opts := metric.fetchOptions()
+			opts.format = format
+			batchSize := 1
+			if listener.fetchPool != nil && listener.fetchRequestParallelism > 1 {
+				batchSize = listener.fetchRequestParallelism
+			}
+			batch := make([]response, batchSize)
+			batchErrs := make([]error, batchSize)
+			for start := 0; start < len(leafFiles); start += batchSize {
+				if ctx.Err() != nil {
+					break STREAM
+				}
+
+				chunk := leafFiles[start:]
+				if len(chunk) > batchSize {
+					chunk = chunk[:batchSize]
+				}
+				listener.fetchParallel(ctx, len(chunk), func(i int) {
+					batch[i], batchErrs[i] = listener.fetchSingleMetric(ctx, chunk[i], metric.PathExpression, tr.from, tr.until, opts)
+				})
+				if ctx.Err() != nil {
+					// skipped fetches left results of the previous batch
+					break STREAM
+				}
+
+				for i := range chunk {
+					if batchErrs[i] != nil {
+						// already logged and counted
+						continue
+					}
+					r := batch[i]
+
+					n, err := sw.write(r)
+					if err != nil {
+						atomic.AddUint64(&listener.metrics.RenderErrors, 1)
+						return res, err
+					}
+
+					res.metricsFetched++
+					res.valuesFetched += len(r.Values)
+					res.memoryUsed += n
+					res.metrics = append(res.metrics, r.Name)
+				}
+			}
+		}
+	}
+
+	// fetches of the last batch could be skipped too
+	if err := ctx.Err(); err != nil {
+		if err != context.DeadlineExceeded || !listener.queryTimeoutPartial || res.metricsFetched == 0 {
+			sw.close()
+			return res, err
+		}
+		res.partial = true
+	}
+
+	return res, sw.close()
+}
@@ -0,0 +1,124 @@
+package carbonserver
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// Query cache keeps whisper headers and fetched series of single metrics. Keys of
+// series are aligned to the archive step the same way whisper aligns fetched range,
+// so dashboard refreshes with from/until moved inside the same step share results.
+// Points of carbon cache are not cached and are merged by enrichFromCache on every
+// request. Keys include modification time and size of whisper file, so points
+// persisted after the series was cached and recreated files are never hidden by it.
+const queryCacheExpire = 60
+
+// queryCacheMinFileAge is age of whisper file modification below which nothing is
+// cached, because file system timestamps are coarse and next write could leave mtime
+// unchanged
+const queryCacheMinFileAge = time.Second
+
+// whisperFileVersion returns part of query cache key changed by every write of whisper
+// file, or empty string if file is modified too recently to be cached
+func whisperFileVersion(path string, now time.Time) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if now.Sub(info.ModTime()) < queryCacheMinFileAge {
+		return "", nil
+	}
+	return fmt.Sprintf("%d&%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// seriesHeader is a part of whisper header required to select archive
+type seriesHeader struct {
+	retentions []whisper.Retention
+	metadata   Metadata
+}
+
+func newSeriesHeader(w *whisper.Whisper) *seriesHeader {
+	return &seriesHeader{
+		retentions: w.Retentions(),
+		metadata: Metadata{
+			ConsolidationFunc: w.AggregationMethod(),
+			XFilesFactor:      w.XFilesFactor(),
+		},
+	}
+}
+
+func (listener *CarbonserverListener) cachedSeriesHeader(metric, version string) *seriesHeader {
+	if !listener.queryCacheEnabled || version == "" {
+		return nil
+	}
+	if h, ok := listener.queryCache.ec.Get("h&" + metric + "&" + version); ok {
+		return h.(*seriesHeader)
+	}
+	return nil
+}
+
+func (listener *CarbonserverListener) cacheSeriesHeader(metric, version string, h *seriesHeader) {
+	if !listener.queryCacheEnabled || version == "" {
+		return
+	}
+	key := "h&" + metric + "&" + version
+	listener.queryCache.ec.Set(key, h, uint64(len(key)+64*len(h.retentions)+64), queryCacheExpire)
+}
+
+// seriesCacheKey returns key of fetched series. Time range is clamped and aligned to
+// step same way as whisper does.
+func seriesCacheKey(metric, version string, retentions []whisper.Retention, step, now, fromTime, untilTime int32, opts fetchOptions) string {
+	oldest := now - int32(retentions[len(retentions)-1].MaxRetention())
+	if fromTime < oldest {
+		fromTime = oldest
+	}
+	if untilTime > now {
+		untilTime = now
+	}
+	fromTime -= int32(mod(int(fromTime), int(step)))
+	untilTime -= int32(mod(int(untilTime), int(step)))
+
+	return fmt.Sprintf("s&%s&%s&%d&%d&%d&%d&%t", metric, version, step, fromTime, untilTime, opts.resolution, opts.stitch)
+}
+
+// copySeries returns series which could be modified without changing the source.
+// Values of fetched series are changed in place by enrichFromCache and consolidation.
+func copySeries(s timeSeries) *archiveSeries {
+	values := make([]float64, len(s.Values()))
+	copy(values, s.Values())
+	return &archiveSeries{
+		fromTime:  s.FromTime(),
+		untilTime: s.UntilTime(),
+		step:      s.Step(),
+		values:    values,
+	}
+}
+
+// cachedSeries returns copy of cached series and accounts hit ratio of response format
+func (listener *CarbonserverListener) cachedSeries(key string, format responseFormat) timeSeries {
+	v, ok := listener.queryCache.ec.Get(key)
+	listener.prometheus.cacheRequest("query_"+format.String(), ok)
+	if !ok {
+		atomic.AddUint64(&listener.metrics.QueryCacheMiss, 1)
+		atomic.AddUint64(&listener.queryCacheFormatStats[format].miss, 1)
+		return nil
+	}
+	atomic.AddUint64(&listener.metrics.QueryCacheHit, 1)
+	atomic.AddUint64(&listener.queryCacheFormatStats[format].hit, 1)
+	return copySeries(v.(*archiveSeries))
+}
+
+func (listener *CarbonserverListener) cacheSeries(key string, s timeSeries) {
+	c := copySeries(s)
+	listener.queryCache.ec.Set(key, c, uint64(len(key)+8*len(c.values)+64), queryCacheExpire)
+}
+
+// queryCacheFormatStat counts series cache requests of response format
+type queryCacheFormatStat struct {
+	hit  uint64
+	miss uint64
+}
@@ -0,0 +1,42 @@
+package carbonserver
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// partialResultHeader is set on render responses truncated by query timeout
+const partialResultHeader = "X-Carbonserver-Partial-Result"
+
+// statusClientClosedRequest is used for requests cancelled by client (nginx convention)
+const statusClientClosedRequest = 499
+
+// withQueryTimeout limits processing time of find and render requests by query-timeout
+func (listener *CarbonserverListener) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if listener.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, listener.queryTimeout)
+}
+
+// countContextError accounts request stopped because client has gone or query timeout
+// is exceeded
+func (listener *CarbonserverListener) countContextError(err error) {
+	switch err {
+	case context.DeadlineExceeded:
+		atomic.AddUint64(&listener.metrics.TimeoutRequests, 1)
+		listener.prometheus.timeoutRequest()
+	case context.Canceled:
+		atomic.AddUint64(&listener.metrics.CancelledRequests, 1)
+		listener.prometheus.cancelledRequest()
+	}
+}
+
+// contextErrorStatus returns http code and reason for request stopped by context
+func contextErrorStatus(err error) (int, string) {
+	if err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout, "query timeout exceeded"
+	}
+	return statusClientClosedRequest, "request cancelled"
+}
@@ -1,6 +1,7 @@
 package carbonserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -20,6 +21,9 @@ const (
 	gstateRanges = 130
 )
 
+// trieQueryCheckInterval is number of visited nodes between context checks in query
+const trieQueryCheckInterval = 1024
+
 var endGstate = &gstate{}
 
 type gmatcher struct {
@@ -492,7 +496,8 @@ outer:
 
 // TODO: add some defensive logics agains bad queries?
 // depth first search
-func (ti *trieIndex) query(expr string, limit int, expand func(globs []string) ([]string, error)) (files []string, isFiles []bool, err error) {
+// query returns ctx.Err() if query is cancelled while walking the trie
+func (ti *trieIndex) query(ctx context.Context, expr string, limit int, expand func(globs []string) ([]string, error)) (files []string, isFiles []bool, err error) {
 	expr = strings.TrimSpace(expr)
 	if expr == "" {
 		expr = "*"
@@ -519,8 +524,17 @@ func (ti *trieIndex) query(expr string, limit int, expand func(globs []string) (
 	var curm = matchers[0]
 	var ndstate *gdstate
 	var isFile, isDir, hasMoreNodes bool
+	var steps int
+	cost := queryCostFromContext(ctx)
+	defer func() { cost.addTrieNodes(steps) }()
 
 	for {
+		if steps++; steps%trieQueryCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+		}
+
 		if nindex[ncindex] >= len(cur.childrens) {
 			curm.pop(len(cur.c))
 			goto parent
@@ -604,6 +618,14 @@ func (ti *trieIndex) query(expr string, limit int, expand func(globs []string) (
 		}
 
 		if len(files) >= limit || exact {
+			if !exact {
+				cost.reportGlobLimit(globLimitReport{
+					Glob:       expr,
+					Files:      len(files),
+					TrieNodes:  steps,
+					LastMetric: files[len(files)-1],
+				})
+			}
 			break
 		}
 
@@ -854,7 +876,7 @@ func (ti *trieIndex) setTrigrams() {
 
 }
 
-func (listener *CarbonserverListener) expandGlobsTrie(query string) ([]string, []bool, error) {
+func (listener *CarbonserverListener) expandGlobsTrie(ctx context.Context, query string) ([]string, []bool, error) {
 	query = strings.Replace(query, ".", "/", -1)
 	globs := []string{query}
 
@@ -883,7 +905,7 @@ func (listener *CarbonserverListener) expandGlobsTrie(query string) ([]string, [
 	var leafs []bool
 
 	for _, g := range globs {
-		f, l, err := fidx.trieIdx.query(g, listener.maxMetricsGlobbed-len(files), listener.expandGlobBraces)
+		f, l, err := fidx.trieIdx.query(ctx, g, listener.maxMetricsGlobbed-len(files), listener.expandGlobBraces)
 		if err != nil {
 			return nil, nil, err
 		}
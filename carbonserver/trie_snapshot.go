@@ -0,0 +1,286 @@
+package carbonserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Trie index snapshot is used to serve find queries right after start, before the first
+// file list scan is completed.
+//
+// Format (all integers are uvarints):
+//
+//	magic version fileExt fileCount depth longestMetric node crc32
+//
+// Nodes are written in depth first order:
+//
+//	0                                                   - file node
+//	len(c)+1 c trigramsCount trigrams... childrenCount children...
+//
+// Strings are written as length followed by bytes. Checksum is crc32 (IEEE) of all
+// preceding bytes in little endian.
+
+const (
+	trieSnapshotMagic   = "GCTRIE"
+	trieSnapshotVersion = 1
+
+	// sanity limits for reading corrupted snapshots
+	trieSnapshotMaxString = 1 << 16
+)
+
+var errTrieSnapshotCorrupted = errors.New("trie snapshot is corrupted")
+
+func writeSnapshotUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func writeSnapshotString(w *bufio.Writer, s string) {
+	writeSnapshotUvarint(w, uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (ti *trieIndex) writeSnapshotNode(w *bufio.Writer, node *trieNode) {
+	if node == fileNode {
+		writeSnapshotUvarint(w, 0)
+		return
+	}
+
+	writeSnapshotUvarint(w, uint64(len(node.c)+1))
+	w.Write(node.c)
+
+	trigrams := ti.trigrams[node]
+	writeSnapshotUvarint(w, uint64(len(trigrams)))
+	for _, t := range trigrams {
+		writeSnapshotUvarint(w, uint64(t))
+	}
+
+	writeSnapshotUvarint(w, uint64(len(node.childrens)))
+	for _, child := range node.childrens {
+		ti.writeSnapshotNode(w, child)
+	}
+}
+
+// writeSnapshot serializes trie index together with trigrams (if any)
+func (ti *trieIndex) writeSnapshot(w io.Writer) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	bw.WriteString(trieSnapshotMagic)
+	writeSnapshotUvarint(bw, trieSnapshotVersion)
+	writeSnapshotString(bw, ti.fileExt)
+	writeSnapshotUvarint(bw, uint64(ti.fileCount))
+	writeSnapshotUvarint(bw, uint64(ti.depth))
+	writeSnapshotString(bw, ti.longestMetric)
+	ti.writeSnapshotNode(bw, ti.root)
+
+	// bufio.Writer keeps the first write error
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// writeTrieSnapshot atomically replaces snapshot file
+func writeTrieSnapshot(filename string, ti *trieIndex) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err = ti.writeSnapshot(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// snapshotReader calculates checksum of consumed bytes only, so trailing checksum
+// prefetched by bufio is not included
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc uint32
+	b   [1]byte
+
+	fileCount int
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	sr.b[0] = b
+	sr.crc = crc32.Update(sr.crc, crc32.IEEETable, sr.b[:])
+	return b, nil
+}
+
+func (sr *snapshotReader) readFull(buf []byte) error {
+	if _, err := io.ReadFull(sr.r, buf); err != nil {
+		return err
+	}
+	sr.crc = crc32.Update(sr.crc, crc32.IEEETable, buf)
+	return nil
+}
+
+func (sr *snapshotReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(sr)
+}
+
+func (sr *snapshotReader) int(max uint64) (int, error) {
+	v, err := sr.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > max {
+		return 0, errTrieSnapshotCorrupted
+	}
+	return int(v), nil
+}
+
+func (sr *snapshotReader) bytes(max uint64) ([]byte, error) {
+	l, err := sr.int(max)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, l)
+	if err := sr.readFull(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (sr *snapshotReader) node(ti *trieIndex, level int) (*trieNode, error) {
+	// every level of trie consumes at least one byte of metric path
+	if level > ti.depth+2 {
+		return nil, errTrieSnapshotCorrupted
+	}
+
+	l, err := sr.int(trieSnapshotMaxString + 1)
+	if err != nil {
+		return nil, err
+	}
+	if l == 0 {
+		sr.fileCount++
+		return fileNode, nil
+	}
+
+	node := &trieNode{c: make([]byte, l-1)}
+	if err = sr.readFull(node.c); err != nil {
+		return nil, err
+	}
+
+	tcount, err := sr.int(1 << 24)
+	if err != nil {
+		return nil, err
+	}
+	if tcount > 0 {
+		trigrams := make([]uint32, tcount)
+		for i := 0; i < tcount; i++ {
+			t, err := sr.int(1<<24 - 1)
+			if err != nil {
+				return nil, err
+			}
+			trigrams[i] = uint32(t)
+		}
+		ti.trigrams[node] = trigrams
+	}
+
+	ccount, err := sr.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < ccount; i++ {
+		child, err := sr.node(ti, level+1)
+		if err != nil {
+			return nil, err
+		}
+		node.childrens = append(node.childrens, child)
+	}
+
+	return node, nil
+}
+
+// readTrieSnapshot restores trie index written by writeSnapshot
+func readTrieSnapshot(r io.Reader) (*trieIndex, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(trieSnapshotMagic))
+	if err := sr.readFull(magic); err != nil || string(magic) != trieSnapshotMagic {
+		return nil, errTrieSnapshotCorrupted
+	}
+
+	version, err := sr.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if version != trieSnapshotVersion {
+		return nil, fmt.Errorf("unsupported trie snapshot version %d", version)
+	}
+
+	fileExt, err := sr.bytes(trieSnapshotMaxString)
+	if err != nil {
+		return nil, err
+	}
+	ti := newTrie(string(fileExt))
+
+	if ti.fileCount, err = sr.int(1 << 40); err != nil {
+		return nil, err
+	}
+	if ti.depth, err = sr.int(trieSnapshotMaxString); err != nil {
+		return nil, err
+	}
+	longestMetric, err := sr.bytes(trieSnapshotMaxString)
+	if err != nil {
+		return nil, err
+	}
+	ti.longestMetric = string(longestMetric)
+
+	if ti.root, err = sr.node(ti, 0); err != nil {
+		return nil, err
+	}
+	if ti.root == fileNode || sr.fileCount != ti.fileCount {
+		return nil, errTrieSnapshotCorrupted
+	}
+
+	var crc uint32
+	if err = binary.Read(sr.r, binary.LittleEndian, &crc); err != nil {
+		return nil, err
+	}
+	if crc != sr.crc {
+		return nil, errTrieSnapshotCorrupted
+	}
+
+	return ti, nil
+}
+
+// loadTrieSnapshot reads snapshot file
+func loadTrieSnapshot(filename string) (*trieIndex, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readTrieSnapshot(f)
+}
@@ -1,11 +1,18 @@
 package carbonserver
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
@@ -15,6 +22,7 @@ import (
 	"time"
 
 	"github.com/dgryski/go-trigram"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"go.uber.org/zap"
 )
 
@@ -793,3 +801,154 @@ func TestDumpAllMetrics(t *testing.T) {
 		t.Errorf("trie.allMetrics:\nwant: %s\ngot:  %s\n", files, metrics)
 	}
 }
+
+func TestTrieSnapshot(t *testing.T) {
+	files := []string{
+		"/something.wsp",
+		"/somet/xxx.wsp",
+		"/something/else/server.wsp",
+		"/service-00/server-000/metric-namespace-000/cpu.wsp",
+		"/service-00/server-000/metric-namespace-001/cpu.wsp",
+		"/service-01/server-000/metric-namespace-002/cpu.wsp",
+		"/service-01/switch-000/metric-namespace-002/cpu.wsp",
+		"/service-01/server-170/metric-namespace-004-007-xdp/cpu.wsp",
+		"/empty-dir",
+	}
+	for i := 0; i < 20; i++ {
+		files = append(files, fmt.Sprintf("/service-02/server-%03d/cpu.wsp", i))
+	}
+
+	server := newTrieServer(files, true)
+	trie := server.CurrentFileIndex().trieIdx
+
+	var buf bytes.Buffer
+	if err := trie.writeSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	restored, err := readTrieSnapshot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.fileCount != trie.fileCount || restored.depth != trie.depth || restored.longestMetric != trie.longestMetric {
+		t.Errorf("trie attributes mismatch: want %d %d %s, got %d %d %s",
+			trie.fileCount, trie.depth, trie.longestMetric,
+			restored.fileCount, restored.depth, restored.longestMetric,
+		)
+	}
+	if len(restored.trigrams) == 0 || len(restored.trigrams) != len(trie.trigrams) {
+		t.Errorf("trigrams mismatch: want %d, got %d", len(trie.trigrams), len(restored.trigrams))
+	}
+	if want, got := trie.allMetrics('.'), restored.allMetrics('.'); !reflect.DeepEqual(want, got) {
+		t.Errorf("restored.allMetrics:\nwant: %s\ngot:  %s\n", want, got)
+	}
+
+	for _, query := range []string{"*", "service-0*/*/*", "*/*/*xdp/cpu", "service-02/server-01*/cpu", "empty-dir"} {
+		wantFiles, wantLeafs, _ := trie.query(context.Background(), query, math.MaxInt64, server.expandGlobBraces)
+		gotFiles, gotLeafs, err := restored.query(context.Background(), query, math.MaxInt64, server.expandGlobBraces)
+		if err != nil {
+			t.Errorf("query %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(wantFiles, gotFiles) || !reflect.DeepEqual(wantLeafs, gotLeafs) {
+			t.Errorf("query %s:\nwant: %v %v\ngot:  %v %v\n", query, wantFiles, wantLeafs, gotFiles, gotLeafs)
+		}
+	}
+
+	for _, corrupted := range [][]byte{
+		data[:len(data)-1],
+		append([]byte{}, data[:len(data)/2]...),
+		append(append([]byte{}, data[:len(data)-5]...), data[len(data)-5]^0xff, 0, 0, 0, 0),
+	} {
+		if _, err := readTrieSnapshot(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("corrupted snapshot of size %d is loaded", len(corrupted))
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "trie.snapshot")
+	if err := writeTrieSnapshot(filename, trie); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err = loadTrieSnapshot(filename); err != nil {
+		t.Fatal(err)
+	}
+	if restored.fileCount != trie.fileCount {
+		t.Errorf("loaded snapshot has %d files, want %d", restored.fileCount, trie.fileCount)
+	}
+}
+
+func TestQueryCost(t *testing.T) {
+	var files []string
+	for i := 0; i < 10; i++ {
+		files = append(files, fmt.Sprintf("/a/b/c%d.wsp", i))
+	}
+	listener := newTrieServer(files, false)
+	listener.metrics = &metricStruct{}
+	listener.slowQueryLogger = zap.NewNop()
+	listener.maxMetricsGlobbed = 3
+	listener.SetSlowQueryThresholds(QueryCostThresholds{TrieNodes: 1000})
+	listener.SetTopQueriesCapacity(2)
+
+	find := func(query string) {
+		rr := httptest.NewRecorder()
+		listener.findHandler(rr, httptest.NewRequest("GET", "/metrics/find/?format=json&query="+query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", query, rr.Code)
+		}
+	}
+	find("a.b.c1")
+	if listener.metrics.SlowQueries != 0 {
+		t.Errorf("exact query is slow")
+	}
+	find("a.b.*")
+	if listener.metrics.SlowQueries != 1 {
+		t.Errorf("query cut by max-metrics-globbed isn't slow")
+	}
+	find("a.*")
+
+	rr := httptest.NewRecorder()
+	listener.topQueriesHandler(rr, httptest.NewRequest("GET", "/admin/topqueries?by=files&n=5", nil))
+	var top []queryCostEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &top); err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Files != 3 || top[1].Files != 1 {
+		t.Fatalf("unexpected top queries %+v", top)
+	}
+	if top[0].GlobLimit == nil || top[0].GlobLimit.Files != 3 || top[0].GlobLimit.LastMetric != "a.b.c2" || top[0].TrieNodes == 0 {
+		t.Errorf("unexpected glob limit report %+v", top[0].GlobLimit)
+	}
+	if top[0].Format != "json" || !reflect.DeepEqual(top[0].Targets, []queryTarget{{Name: "a.b.*"}}) {
+		t.Errorf("unexpected find query %q %+v", top[0].Format, top[0].Targets)
+	}
+
+	// targets of render request are parsed from body
+	body, err := (&protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{
+		{Name: "a.b.c1", PathExpression: "a.b.c1", StartTime: 100, StopTime: 200},
+		{Name: "a.b.c0", PathExpression: "a.b.c0", StartTime: 100, StopTime: 200},
+	}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.SetTopQueriesCapacity(1)
+	req := httptest.NewRequest("POST", "/render/?format=carbonapi_v3_pb", bytes.NewReader(body))
+	listener.renderHandler(httptest.NewRecorder(), req)
+
+	rr = httptest.NewRecorder()
+	listener.topQueriesHandler(rr, httptest.NewRequest("GET", "/admin/topqueries", nil))
+	top = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &top); err != nil {
+		t.Fatal(err)
+	}
+	want := []queryTarget{{Name: "a.b.c0", From: 100, Until: 200}, {Name: "a.b.c1", From: 100, Until: 200}}
+	if len(top) != 1 || top[0].Format != "carbonapi_v3_pb" || !reflect.DeepEqual(top[0].Targets, want) {
+		t.Errorf("unexpected render query %+v", top)
+	}
+}
@@ -158,9 +158,17 @@ func main() {
 	}
 	/* CONFIG end */
 
+	// json metric exporter serves /debug/stats on pprof listener
+	statsEnabled := false
+	for _, e := range cfg.MetricExporters {
+		if e.Type == carbon.ExporterJSON {
+			statsEnabled = true
+		}
+	}
+
 	// pprof
 	// httpStop := func() {}
-	if cfg.Pprof.Enabled || cfg.Prometheus.Enabled {
+	if cfg.Pprof.Enabled || cfg.Prometheus.Enabled || statsEnabled {
 		_, err = httpServe(cfg.Pprof.Listen)
 		if err != nil {
 			mainLogger.Fatal(err.Error())
@@ -174,6 +182,10 @@ func main() {
 		expvar.Publish("GoroutineCount", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
 	}
 
+	if statsEnabled {
+		http.HandleFunc("/debug/stats", app.StatsHandler)
+	}
+
 	if cfg.Prometheus.Enabled {
 		app.PromRegisterer.MustRegister(prometheus.NewGoCollector())
 		app.PromRegisterer.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
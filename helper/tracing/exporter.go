@@ -0,0 +1,93 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// jsonSpan is line of file exporter
+type jsonSpan struct {
+	TraceID       string                 `json:"trace_id"`
+	SpanID        string                 `json:"span_id"`
+	ParentSpanID  string                 `json:"parent_span_id,omitempty"`
+	Name          string                 `json:"name"`
+	Kind          string                 `json:"kind"`
+	StartTime     time.Time              `json:"start_time"`
+	EndTime       time.Time              `json:"end_time"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	StatusCode    string                 `json:"status_code,omitempty"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+}
+
+// FileExporter appends finished spans to file as JSON lines
+type FileExporter struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+var _ sdktrace.SpanExporter = (*FileExporter)(nil)
+
+// NewFileExporter opens file for append
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// ExportSpans implements sdktrace.SpanExporter
+func (e *FileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.file == nil {
+		return nil
+	}
+
+	for _, s := range spans {
+		span := jsonSpan{
+			TraceID:   s.SpanContext().TraceID().String(),
+			SpanID:    s.SpanContext().SpanID().String(),
+			Name:      s.Name(),
+			Kind:      s.SpanKind().String(),
+			StartTime: s.StartTime(),
+			EndTime:   s.EndTime(),
+		}
+		if s.Parent().HasSpanID() {
+			span.ParentSpanID = s.Parent().SpanID().String()
+		}
+		if attrs := s.Attributes(); len(attrs) > 0 {
+			span.Attributes = make(map[string]interface{}, len(attrs))
+			for _, a := range attrs {
+				span.Attributes[string(a.Key)] = a.Value.AsInterface()
+			}
+		}
+		if s.Status().Code != codes.Unset {
+			span.StatusCode = s.Status().Code.String()
+			span.StatusMessage = s.Status().Description
+		}
+		if err := e.enc.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown closes file, spans exported later are dropped
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+// StartHTTPSpan starts server span of request. Parent span is taken from W3C
+// traceparent header. Returned span records nothing if tracing is disabled
+func StartHTTPSpan(req *http.Request, name string) (*http.Request, trace.Span) {
+	if !Enabled() {
+		return req, trace.SpanFromContext(context.Background())
+	}
+
+	ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := getTracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+	return req.WithContext(ctx), span
+}
+
+// Store wraps store callback of receiver. Sampled points carry span context through
+// cache to persister
+func Store(receiver string, store func(*points.Points)) func(*points.Points) {
+	name := "receiver." + receiver
+	return func(p *points.Points) {
+		if !sampleIngest() {
+			store(p)
+			return
+		}
+
+		ctx := context.WithValue(context.Background(), alwaysSampleKey{}, true)
+		_, span := getTracer().Start(ctx, name, trace.WithAttributes(
+			attribute.String("metric", p.Metric),
+			attribute.Int("points", len(p.Data)),
+		))
+		sc := span.SpanContext()
+		p.SpanContext = &sc
+
+		store(p)
+		span.End()
+	}
+}
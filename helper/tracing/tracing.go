@@ -0,0 +1,253 @@
+// Package tracing configures OpenTelemetry tracing of go-carbon: sampling of queries and
+// ingested points, W3C trace context propagation and span exporters. Spans are sent
+// to OpenTelemetry collector by OTLP/HTTP, file exporter is intended for tests
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/lomik/zapwriter"
+)
+
+// Types of span exporters
+const (
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+// DefaultOTLPEndpoint is traces endpoint of local OpenTelemetry collector with OTLP/HTTP receiver
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// DefaultServiceName is service.name resource attribute of spans
+const DefaultServiceName = "go-carbon"
+
+// instrumentationName is name of tracer
+const instrumentationName = "github.com/lomik/go-carbon"
+
+// shutdownTimeout limits time of sending queued spans on Setup
+const shutdownTimeout = 10 * time.Second
+
+// Options of tracing
+type Options struct {
+	Enabled bool
+	// QuerySampleRate is fraction of carbonserver requests traced if request has no
+	// sampled parent span
+	QuerySampleRate float64
+	// IngestSampleRate is fraction of received points traced through cache and persister
+	IngestSampleRate float64
+	Exporter         string
+	Endpoint         string // traces URL of collector for "otlp" exporter
+	Path             string // file of "file" exporter
+	ServiceName      string // service.name of spans, DefaultServiceName if empty
+}
+
+var (
+	setupMutex sync.Mutex
+	provider   *sdktrace.TracerProvider
+
+	tracer     atomic.Value // tracerValue
+	enabled    uint32
+	ingestRate uint64 // math.Float64bits
+
+	propagator = propagation.TraceContext{}
+)
+
+func init() {
+	tracer.Store(tracerValue{trace.NewNoopTracerProvider().Tracer(instrumentationName)})
+
+	logger := zapwriter.Logger("tracing")
+	// failed and partially rejected exports are reported by exporter to error handler
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Error("tracing error", zap.Error(err))
+	}))
+}
+
+// Check validates options
+func Check(opts Options) error {
+	if !opts.Enabled {
+		return nil
+	}
+	if opts.QuerySampleRate < 0 || opts.QuerySampleRate > 1 {
+		return fmt.Errorf("tracing.query-sample-rate should be in range [0, 1], got %v", opts.QuerySampleRate)
+	}
+	if opts.IngestSampleRate < 0 || opts.IngestSampleRate > 1 {
+		return fmt.Errorf("tracing.ingest-sample-rate should be in range [0, 1], got %v", opts.IngestSampleRate)
+	}
+	switch opts.Exporter {
+	case ExporterOTLP:
+		if _, err := otlpOptions(opts.Endpoint); err != nil {
+			return err
+		}
+	case ExporterFile:
+		if opts.Path == "" {
+			return fmt.Errorf("tracing.path should be set for %q exporter", opts.Exporter)
+		}
+	default:
+		return fmt.Errorf("go-carbon support only \"otlp\" and \"file\" tracing exporters, got %#v", opts.Exporter)
+	}
+	return nil
+}
+
+// otlpOptions returns options of OTLP/HTTP exporter to traces URL of collector
+func otlpOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("tracing.endpoint should be http(s) URL for %q exporter, got %#v", ExporterOTLP, endpoint)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return opts, nil
+}
+
+// Setup replaces global tracing configuration. Spans of previous configuration are
+// flushed. Disabled options stop tracing
+func Setup(opts Options) error {
+	setupMutex.Lock()
+	defer setupMutex.Unlock()
+
+	atomic.StoreUint32(&enabled, 0)
+	tracer.Store(tracerValue{trace.NewNoopTracerProvider().Tracer(instrumentationName)})
+	if provider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := provider.Shutdown(ctx)
+		cancel()
+		provider = nil
+		if err != nil {
+			zapwriter.Logger("tracing").Error("failed to flush spans", zap.Error(err))
+		}
+	}
+
+	if !opts.Enabled {
+		return nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var spanProcessor sdktrace.SpanProcessor
+	switch opts.Exporter {
+	case ExporterFile:
+		e, err := NewFileExporter(opts.Path)
+		if err != nil {
+			return err
+		}
+		// spans are written in order of end, as they are finished
+		exporter, spanProcessor = e, sdktrace.NewSimpleSpanProcessor(e)
+	default:
+		otlpOpts, err := otlpOptions(opts.Endpoint)
+		if err != nil {
+			return err
+		}
+		// client is not connected until the first export
+		e, err := otlptracehttp.New(context.Background(), otlpOpts...)
+		if err != nil {
+			return err
+		}
+		exporter, spanProcessor = e, sdktrace.NewBatchSpanProcessor(e)
+	}
+
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		exporter.Shutdown(context.Background())
+		return err
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(spanProcessor),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler{
+			Sampler: sdktrace.ParentBased(
+				sdktrace.TraceIDRatioBased(opts.QuerySampleRate),
+				// requests of not sampled clients are sampled as requests without parent
+				sdktrace.WithRemoteParentNotSampled(sdktrace.TraceIDRatioBased(opts.QuerySampleRate)),
+			),
+		}),
+	)
+	tracer.Store(tracerValue{provider.Tracer(instrumentationName)})
+
+	atomic.StoreUint64(&ingestRate, math.Float64bits(opts.IngestSampleRate))
+	atomic.StoreUint32(&enabled, 1)
+	return nil
+}
+
+// Enabled returns true if tracing is set up
+func Enabled() bool {
+	return atomic.LoadUint32(&enabled) == 1
+}
+
+// alwaysSampleKey is key of context value which forces sampling of span started with
+// the context. Points are sampled by IngestSampleRate before span is started
+type alwaysSampleKey struct{}
+
+// sampler samples spans started with alwaysSampleKey, other spans are sampled by
+// embedded sampler
+type sampler struct {
+	sdktrace.Sampler
+}
+
+func (s sampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.ParentContext != nil && p.ParentContext.Value(alwaysSampleKey{}) != nil {
+		return sdktrace.AlwaysSample().ShouldSample(p)
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+// tracerValue keeps tracers of different types in atomic.Value
+type tracerValue struct {
+	trace.Tracer
+}
+
+func getTracer() trace.Tracer {
+	return tracer.Load().(tracerValue).Tracer
+}
+
+// StartSpan starts child span only if parent span from ctx is sampled, otherwise
+// returns span which records nothing
+func StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		// span of empty context is a no-op span
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	return getTracer().Start(ctx, name)
+}
+
+// StartLinkedSpan continues trace of sampled parent which is not in context, e.g.
+// carried by points from receiver to persister
+func StartLinkedSpan(parent trace.SpanContext, name string) trace.Span {
+	_, span := getTracer().Start(trace.ContextWithRemoteSpanContext(context.Background(), parent), name)
+	return span
+}
+
+// sampleIngest returns true for IngestSampleRate of calls
+func sampleIngest() bool {
+	if !Enabled() {
+		return false
+	}
+	rate := math.Float64frombits(atomic.LoadUint64(&ingestRate))
+	return rate > 0 && rand.Float64() < rate
+}
@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestTraceparent(t *testing.T) {
+	assert.NoError(t, Setup(Options{Enabled: true, Exporter: ExporterFile, Path: os.DevNull}))
+	defer Setup(Options{})
+
+	table := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03-future", true, true},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	// query sample rate is 0, so only requests with sampled parent are traced
+	for _, c := range table {
+		req := httptest.NewRequest("GET", "/render/", nil)
+		req.Header.Set("traceparent", c.header)
+		_, span := StartHTTPSpan(req, "carbonserver/render")
+		assert.Equal(t, c.sampled, span.SpanContext().IsSampled(), c.header)
+		if c.ok {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(), c.header)
+		} else {
+			assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(), c.header)
+		}
+		span.End()
+	}
+}
+
+func readSpans(t *testing.T, path string) []jsonSpan {
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer f.Close()
+
+	var res []jsonSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s jsonSpan
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+		res = append(res, s)
+	}
+	return res
+}
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		path := filepath.Join(root, "traces.json")
+		assert.NoError(Setup(Options{
+			Enabled:          true,
+			QuerySampleRate:  0,
+			IngestSampleRate: 1,
+			Exporter:         ExporterFile,
+			Path:             path,
+		}))
+		defer Setup(Options{})
+
+		// ingest
+		var stored *points.Points
+		Store("tcp", func(p *points.Points) {
+			stored = p
+			span := StartLinkedSpan(*p.SpanContext, "cache.add")
+			span.End()
+		})(points.OnePoint("hello.world", 42, 10))
+
+		if assert.NotNil(stored.SpanContext) {
+			assert.True(stored.SpanContext.IsSampled())
+		}
+
+		// request with sampled parent is traced in spite of zero query rate
+		req := httptest.NewRequest("GET", "/render/", nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		req, span := StartHTTPSpan(req, "carbonserver/render")
+		_, child := StartSpan(req.Context(), "fetchFromDisk")
+		child.End()
+		span.End()
+
+		// not sampled request
+		req = httptest.NewRequest("GET", "/render/", nil)
+		req, span = StartHTTPSpan(req, "carbonserver/render")
+		_, child = StartSpan(req.Context(), "fetchFromDisk")
+		assert.False(child.IsRecording())
+		child.End()
+		span.End()
+
+		assert.NoError(Setup(Options{}))
+
+		spans := readSpans(t, path)
+		if !assert.Len(spans, 4) {
+			return
+		}
+
+		assert.Equal("cache.add", spans[0].Name)
+		assert.Equal("receiver.tcp", spans[1].Name)
+		assert.Equal(spans[1].SpanID, spans[0].ParentSpanID)
+		assert.Equal(spans[1].TraceID, spans[0].TraceID)
+		assert.Equal(map[string]interface{}{"metric": "hello.world", "points": float64(1)}, spans[1].Attributes)
+
+		assert.Equal("fetchFromDisk", spans[2].Name)
+		assert.Equal("carbonserver/render", spans[3].Name)
+		assert.Equal("server", spans[3].Kind)
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[3].TraceID)
+		assert.Equal("00f067aa0ba902b7", spans[3].ParentSpanID)
+		assert.Equal(spans[3].SpanID, spans[2].ParentSpanID)
+	})
+}
+
+func TestOTLPExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var requests []*coltracepb.ExportTraceServiceRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/traces", r.URL.Path)
+		assert.Equal("application/x-protobuf", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(err)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		assert.NoError(proto.Unmarshal(body, req))
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	assert.Error(Check(Options{Enabled: true, Exporter: ExporterOTLP, Endpoint: "localhost:4318"}))
+	opts := Options{
+		Enabled:          true,
+		QuerySampleRate:  1,
+		IngestSampleRate: 0,
+		Exporter:         ExporterOTLP,
+		Endpoint:         srv.URL + "/v1/traces",
+		ServiceName:      "carbon-a",
+	}
+	assert.NoError(Check(opts))
+	assert.NoError(Setup(opts))
+	defer Setup(Options{})
+
+	req := httptest.NewRequest("GET", "/render/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req, span := StartHTTPSpan(req, "carbonserver/render")
+	_, child := StartSpan(req.Context(), "fetchFromDisk")
+	child.SetAttributes(attribute.String("metric", "hello.world"), attribute.Int("points", 42))
+	child.SetStatus(codes.Error, "read failed")
+	child.End()
+	span.End()
+
+	// queued spans are sent on shutdown
+	assert.NoError(Setup(Options{}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Len(requests, 1) {
+		return
+	}
+	rs := requests[0].ResourceSpans[0]
+	var serviceName string
+	for _, a := range rs.Resource.Attributes {
+		if a.Key == "service.name" {
+			serviceName = a.Value.GetStringValue()
+		}
+	}
+	assert.Equal("carbon-a", serviceName)
+
+	spans := rs.ScopeSpans[0].Spans
+	if !assert.Len(spans, 2) {
+		return
+	}
+
+	assert.Equal("fetchFromDisk", spans[0].Name)
+	assert.Equal(tracepb.Span_SPAN_KIND_INTERNAL, spans[0].Kind)
+	assert.Equal(spans[1].SpanId, spans[0].ParentSpanId)
+	if assert.Len(spans[0].Attributes, 2) {
+		assert.Equal("metric", spans[0].Attributes[0].Key)
+		assert.Equal("hello.world", spans[0].Attributes[0].Value.GetStringValue())
+		assert.Equal("points", spans[0].Attributes[1].Key)
+		assert.Equal(int64(42), spans[0].Attributes[1].Value.GetIntValue())
+	}
+	assert.Equal(tracepb.Status_STATUS_CODE_ERROR, spans[0].Status.Code)
+	assert.Equal("read failed", spans[0].Status.Message)
+
+	assert.Equal("carbonserver/render", spans[1].Name)
+	assert.Equal(tracepb.Span_SPAN_KIND_SERVER, spans[1].Kind)
+	assert.Equal([]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}, spans[1].TraceId)
+	assert.Equal([]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}, spans[1].ParentSpanId)
+	assert.Equal(tracepb.Status_STATUS_CODE_UNSET, spans[1].Status.GetCode())
+	assert.NotZero(spans[1].StartTimeUnixNano)
+}
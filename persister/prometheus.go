@@ -0,0 +1,92 @@
+package persister
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// whisperPrometheus mirrors persister stats as Prometheus metrics. Persister is
+// re-created on config reload, so metrics are unregistered by Stop
+type whisperPrometheus struct {
+	reg        prometheus.Registerer
+	collectors []prometheus.Collector
+
+	updates          prometheus.Counter
+	committedPoints  prometheus.Counter
+	created          prometheus.Counter
+	throttledCreates prometheus.Counter
+	extended         prometheus.Counter
+	updateDuration   prometheus.Histogram
+	pointsPerUpdate  prometheus.Histogram
+}
+
+func newWhisperPrometheus(p *Whisper) whisperPrometheus {
+	w := whisperPrometheus{
+		updates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "persister_updates_total",
+			Help: "Number of whisper update operations",
+		}),
+		committedPoints: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "persister_committed_points_total",
+			Help: "Number of points written to whisper files",
+		}),
+		created: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "persister_created_total",
+			Help: "Number of created whisper files",
+		}),
+		throttledCreates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "persister_throttled_creates_total",
+			Help: "Number of whisper file creations throttled by max-creates-per-second",
+		}),
+		extended: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "persister_extended_total",
+			Help: "Number of extended compressed whisper files",
+		}),
+		updateDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "persister_update_duration_seconds_exp",
+			Help:    "Duration of whisper update operation (exponential buckets)",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2.0, 16),
+		}),
+		pointsPerUpdate: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "persister_points_per_update",
+			Help:    "Number of points written by whisper update operation (exponential buckets)",
+			Buckets: prometheus.ExponentialBuckets(1, 2.0, 12),
+		}),
+	}
+
+	w.collectors = []prometheus.Collector{
+		w.updates, w.committedPoints, w.created, w.throttledCreates, w.extended,
+		w.updateDuration, w.pointsPerUpdate,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "persister_workers",
+			Help: "Number of persister workers",
+		}, func() float64 { return float64(p.workersCount) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "persister_max_updates_per_second",
+			Help: "Limit of whisper updates per second",
+		}, func() float64 { return float64(p.maxUpdatesPerSecond) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "persister_max_creates_per_second",
+			Help: "Limit of whisper creations per second",
+		}, func() float64 { return float64(p.maxCreatesPerSecond) }),
+	}
+
+	return w
+}
+
+// InitPrometheus registers persister metrics
+func (p *Whisper) InitPrometheus(reg prometheus.Registerer) {
+	for _, m := range p.prometheus.collectors {
+		reg.MustRegister(m)
+	}
+	p.prometheus.reg = reg
+}
+
+func (w *whisperPrometheus) unregister() {
+	if w.reg == nil {
+		return
+	}
+	for _, m := range w.collectors {
+		w.reg.Unregister(m)
+	}
+	w.reg = nil
+}
@@ -8,11 +8,14 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	whisper "github.com/go-graphite/go-whisper"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
 	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/helper/tracing"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/go-carbon/tags"
 	"github.com/lomik/zapwriter"
@@ -54,6 +57,7 @@ type Whisper struct {
 	mockStore               func() (StoreFunc, func())
 	logger                  *zap.Logger
 	createLogger            *zap.Logger
+	prometheus              whisperPrometheus
 	// blockThrottleNs        uint64 // sum ns counter
 	// blockQueueGetNs        uint64 // sum ns counter
 	// blockAvoidConcurrentNs uint64 // sum ns counter
@@ -70,7 +74,7 @@ func NewWhisper(
 	confirm func(*points.Points),
 	popConfirm func(string) (*points.Points, bool)) *Whisper {
 
-	return &Whisper{
+	p := &Whisper{
 		recv:                recv,
 		pop:                 pop,
 		confirm:             confirm,
@@ -83,6 +87,8 @@ func NewWhisper(
 		logger:              zapwriter.Logger("persister"),
 		createLogger:        zapwriter.Logger("whisper:new"),
 	}
+	p.prometheus = newWhisperPrometheus(p)
+	return p
 }
 
 // SetMaxUpdatesPerSecond enable throttling
@@ -168,8 +174,10 @@ func (p *Whisper) updateMany(w *whisper.Whisper, path string, points []*whisper.
 		}
 	}()
 
-	// start = time.Now()
-	if err := w.UpdateMany(points); err != nil {
+	start := time.Now()
+	err := w.UpdateMany(points)
+	p.prometheus.updateDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
 		p.logger.Error("fail to update metric",
 			zap.String("path", path),
 			zap.Error(err),
@@ -177,6 +185,7 @@ func (p *Whisper) updateMany(w *whisper.Whisper, path string, points []*whisper.
 	}
 	if w.Extended {
 		atomic.AddUint32(&p.extended, 1)
+		p.prometheus.extended.Inc()
 		p.logger.Info("cwhisper file has extended", zap.String("path", path))
 	}
 }
@@ -233,6 +242,7 @@ func (p *Whisper) store(metric string) {
 			}
 
 			atomic.AddUint32(&p.throttledCreates, 1)
+			p.prometheus.throttledCreates.Inc()
 			p.logger.Error("metric creation throttled",
 				zap.String("name", metric),
 				zap.String("operation", "create"),
@@ -301,6 +311,7 @@ func (p *Whisper) store(metric string) {
 		)
 
 		atomic.AddUint32(&p.created, 1)
+		p.prometheus.created.Inc()
 	}
 
 	values, exists := p.pop(metric)
@@ -311,6 +322,15 @@ func (p *Whisper) store(metric string) {
 		defer p.confirm(values)
 	}
 
+	if values.SpanContext != nil {
+		span := tracing.StartLinkedSpan(*values.SpanContext, "persister.store")
+		span.SetAttributes(
+			attribute.String("path", path),
+			attribute.Int("points", len(values.Data)),
+		)
+		defer span.End()
+	}
+
 	points := make([]*whisper.TimeSeriesPoint, len(values.Data))
 	for i, r := range values.Data {
 		points[i] = &whisper.TimeSeriesPoint{Time: int(r.Timestamp), Value: r.Value}
@@ -318,6 +338,9 @@ func (p *Whisper) store(metric string) {
 
 	atomic.AddUint32(&p.committedPoints, uint32(len(values.Data)))
 	atomic.AddUint32(&p.updateOperations, 1)
+	p.prometheus.committedPoints.Add(float64(len(values.Data)))
+	p.prometheus.updates.Inc()
+	p.prometheus.pointsPerUpdate.Observe(float64(len(values.Data)))
 
 	// start = time.Now()
 	p.updateMany(w, path, points)
@@ -467,4 +490,5 @@ func (p *Whisper) Stop() {
 		p.throttleTicker.Stop()
 		p.maxCreatesTicker.Stop()
 	})
+	p.prometheus.unregister()
 }
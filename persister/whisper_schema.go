@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-graphite/go-whisper"
 )
@@ -22,6 +23,14 @@ type Schema struct {
 	Retentions   whisper.Retentions
 	Priority     int64
 	Compressed   *bool
+	Duplicates   string        // duplicate points policy in cache: "last", "first", "sum", "max" or "" (keep all)
+	MaxLag       time.Duration // points older than now-MaxLag are dropped by cache. 0 - disabled
+	MaxSkew      time.Duration // points newer than now+MaxSkew are dropped by cache. 0 - disabled
+}
+
+// HasPointsPolicy returns true if schema defines duplicates or out-of-range points handling
+func (s *Schema) HasPointsPolicy() bool {
+	return s.Duplicates != "" || s.MaxLag > 0 || s.MaxSkew > 0
 }
 
 // WhisperSchemas contains schema settings
@@ -71,6 +80,21 @@ func ParseRetentionDefs(retentionDefs string) (whisper.Retentions, error) {
 	return retentions, nil
 }
 
+func parseSchemaDuration(section map[string]string, key string) (time.Duration, error) {
+	if section[key] == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(section[key])
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration")
+	}
+	return d, nil
+}
+
 // ReadWhisperSchemas reads and parses a storage-schemas.conf file and returns a sorted
 // schemas structure
 // see https://graphite.readthedocs.io/en/0.9.9/config-carbon.html#storage-schemas-conf
@@ -121,6 +145,20 @@ func ReadWhisperSchemas(filename string) (WhisperSchemas, error) {
 			return nil, fmt.Errorf("[persister] Failed to parse compressed %q for [%s]: %s", section["compressed"], schema.Name, "unknown value, please use true/false")
 		}
 
+		switch section["duplicates"] {
+		case "", "last", "first", "sum", "max":
+			schema.Duplicates = section["duplicates"]
+		default:
+			return nil, fmt.Errorf("[persister] Failed to parse duplicates %q for [%s]: %s", section["duplicates"], schema.Name, "unknown value, please use last/first/sum/max")
+		}
+
+		if schema.MaxLag, err = parseSchemaDuration(section, "max-lag"); err != nil {
+			return nil, fmt.Errorf("[persister] Failed to parse max-lag %q for [%s]: %s", section["max-lag"], schema.Name, err.Error())
+		}
+		if schema.MaxSkew, err = parseSchemaDuration(section, "max-skew"); err != nil {
+			return nil, fmt.Errorf("[persister] Failed to parse max-skew %q for [%s]: %s", section["max-skew"], schema.Name, err.Error())
+		}
+
 		schemas = append(schemas, schema)
 	}
 
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/go-graphite/go-whisper"
 	"github.com/stretchr/testify/assert"
@@ -273,3 +274,54 @@ retentions = 60s:90d
 priority =
 `, nil, "Empty priority")
 }
+
+func TestParseSchemasPointsPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	schemas := assertSchemas(t, `
+[carbon]
+pattern = ^carbon\.
+retentions = 60s:90d
+duplicates = sum
+max-lag = 24h
+max-skew = 10m
+
+[default]
+pattern = .*
+retentions = 1m:30d
+	`,
+		[]testcase{
+			testcase{"carbon", "^carbon\\.", "60s:90d"},
+			testcase{"default", ".*", "1m:30d"},
+		},
+	)
+
+	if assert.Len(schemas, 2) {
+		assert.True(schemas[0].HasPointsPolicy())
+		assert.Equal("sum", schemas[0].Duplicates)
+		assert.Equal(24*time.Hour, schemas[0].MaxLag)
+		assert.Equal(10*time.Minute, schemas[0].MaxSkew)
+		assert.False(schemas[1].HasPointsPolicy())
+	}
+
+	assertSchemas(t, `
+[carbon]
+pattern = ^carbon\.
+retentions = 60s:90d
+duplicates = avg
+`, nil, "Wrong duplicates")
+
+	assertSchemas(t, `
+[carbon]
+pattern = ^carbon\.
+retentions = 60s:90d
+max-lag = 1d
+`, nil, "Wrong max-lag")
+
+	assertSchemas(t, `
+[carbon]
+pattern = ^carbon\.
+retentions = 60s:90d
+max-skew = -1m
+`, nil, "Negative max-skew")
+}
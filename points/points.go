@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Point value/time pair
@@ -20,6 +22,8 @@ type Point struct {
 type Points struct {
 	Metric string
 	Data   []Point
+	// SpanContext is set for sampled points traced from receiver to persister
+	SpanContext *trace.SpanContext
 }
 
 // New creates new instance of Points
@@ -48,8 +52,9 @@ func NowPoint(metric string, value float64) *Points {
 // Copy returns copy of object
 func (p *Points) Copy() *Points {
 	return &Points{
-		Metric: p.Metric,
-		Data:   p.Data,
+		Metric:      p.Metric,
+		Data:        p.Data,
+		SpanContext: p.SpanContext,
 	}
 }
 
@@ -1,13 +1,20 @@
 package http
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"sync/atomic"
 	"time"
 
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
 	"go.uber.org/zap"
 
 	"github.com/lomik/go-carbon/helper"
@@ -46,11 +53,14 @@ type HTTP struct {
 	name            string // name for store metrics
 	maxMessageSize  uint32
 	metricsReceived uint32
+	metricsRejected uint32
 	errors          uint32
 	listener        *net.TCPListener
 	server          *http.Server
 	logger          *zap.Logger
 	closed          chan struct{}
+	backpressure    atomic.Value // func() <-chan struct{}
+	rejected        uint32
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
@@ -114,6 +124,107 @@ func (rcv *HTTP) Stat(send helper.StatCallback) {
 	errors := atomic.LoadUint32(&rcv.errors)
 	atomic.AddUint32(&rcv.errors, -errors)
 	send("errors", float64(errors))
+
+	helper.SendAndSubstractUint32("metricsRejected", &rcv.metricsRejected, send)
+
+	helper.SendAndSubstractUint32("backpressureRejected", &rcv.rejected, send)
+}
+
+// SetBackpressure sets function which is checked on each request.
+// Requests are rejected with 503 while storage is overloaded
+func (rcv *HTTP) SetBackpressure(backpressure func() <-chan struct{}) {
+	rcv.backpressure.Store(backpressure)
+}
+
+func (rcv *HTTP) isOverloaded() bool {
+	backpressure, ok := rcv.backpressure.Load().(func() <-chan struct{})
+	return ok && backpressure() != nil
+}
+
+// maxResponseErrors limits number of rejected points described in response
+const maxResponseErrors = 10
+
+// response is returned on successfully parsed request
+type response struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// errUnsupportedEncoding is returned by readBody for unknown Content-Encoding
+type errUnsupportedEncoding string
+
+func (e errUnsupportedEncoding) Error() string {
+	return fmt.Sprintf("Content-Encoding %#v is not supported", string(e))
+}
+
+// readBody reads request body and decodes it according to Content-Encoding.
+// Size of decoded body is limited by max-message-size too
+func (rcv *HTTP) readBody(r *http.Request) ([]byte, error) {
+	encoding := r.Header.Get("Content-Encoding")
+	switch encoding {
+	case "", "identity", "gzip", "snappy", "zstd":
+	default:
+		return nil, errUnsupportedEncoding(encoding)
+	}
+
+	limit := int64(rcv.maxMessageSize)
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("Read request failed: %s", err.Error())
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("Message too long. Max allowed message size is %#v", rcv.maxMessageSize)
+	}
+
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("Decompress failed: %s", err.Error())
+		}
+		defer gz.Close()
+
+		body, err = ioutil.ReadAll(io.LimitReader(gz, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("Decompress failed: %s", err.Error())
+		}
+	case "snappy":
+		// block format, like in prometheus remote write
+		n, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, fmt.Errorf("Decompress failed: %s", err.Error())
+		}
+		if int64(n) > limit {
+			return nil, fmt.Errorf("Message too long. Max allowed message size is %#v", rcv.maxMessageSize)
+		}
+		body, err = snappy.Decode(nil, body)
+		if err != nil {
+			return nil, fmt.Errorf("Decompress failed: %s", err.Error())
+		}
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(limit)),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Decompress failed: %s", err.Error())
+		}
+		defer zr.Close()
+
+		body, err = ioutil.ReadAll(io.LimitReader(zr, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("Decompress failed: %s", err.Error())
+		}
+	}
+
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("Message too long. Max allowed message size is %#v", rcv.maxMessageSize)
+	}
+	return body, nil
 }
 
 func (rcv *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -123,26 +234,42 @@ func (rcv *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if rcv.isOverloaded() {
+		atomic.AddUint32(&rcv.rejected, 1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Storage is overloaded, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
 	if r.ContentLength > int64(rcv.maxMessageSize) {
 		atomic.AddUint32(&rcv.errors, 1)
 		http.Error(w, fmt.Sprintf("Message too long. Max allowed message size is %#v", rcv.maxMessageSize), http.StatusBadRequest)
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := rcv.readBody(r)
 	if err != nil {
 		atomic.AddUint32(&rcv.errors, 1)
-		http.Error(w, fmt.Sprintf("Read request failed: %s", err.Error()), http.StatusBadRequest)
+		code := http.StatusBadRequest
+		if _, ok := err.(errUnsupportedEncoding); ok {
+			code = http.StatusUnsupportedMediaType
+		}
+		http.Error(w, err.Error(), code)
 		return
 	}
 
 	var data []*points.Points
+	var rejected []error
 
-	switch r.Header.Get("Content-Type") {
+	// parameters like "; charset=utf-8" are ignored, bad header means plain text
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
 	case "application/python-pickle":
 		data, err = parse.Pickle(body)
 	case "application/protobuf":
 		data, err = parse.Protobuf(body)
+	case "application/json":
+		data, rejected, err = parse.JSONPartial(body)
 	default:
 		data, err = parse.Plain(body)
 	}
@@ -160,6 +287,15 @@ func (rcv *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	atomic.AddUint32(&rcv.metricsReceived, uint32(cnt))
+	atomic.AddUint32(&rcv.metricsRejected, uint32(len(rejected)))
+
+	res := response{Accepted: cnt, Rejected: len(rejected)}
+	for i := 0; i < len(rejected) && i < maxResponseErrors; i++ {
+		res.Errors = append(res.Errors, rejected[i].Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
 }
 
 // InitPrometheus is a stub for the receiver prom metrics. Required to satisfy Receiver interface.
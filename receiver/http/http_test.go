@@ -3,10 +3,15 @@ package http
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/go-carbon/receiver"
 	"github.com/stretchr/testify/assert"
@@ -90,3 +95,186 @@ func TestHttp(t *testing.T) {
 		}
 	}
 }
+
+func TestHttpBackpressure(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]*points.Points, 0)
+
+	r, err := receiver.New("http", map[string]interface{}{
+		"protocol": "http",
+		"listen":   addr.String(),
+	},
+		func(p *points.Points) {
+			received = append(received, p)
+		},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Stop()
+
+	var release chan struct{}
+	r.(receiver.BackpressureReceiver).SetBackpressure(func() <-chan struct{} {
+		if release == nil {
+			return nil
+		}
+		return release
+	})
+
+	url := fmt.Sprintf("http://%s/", r.(*HTTP).Addr())
+	body := "hello.world 42.15 1422698155\n"
+
+	release = make(chan struct{})
+	resp, err := http.Post(url, "", bytes.NewReader([]byte(body)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 0, len(received))
+
+	release = nil
+	resp, err = http.Post(url, "", bytes.NewReader([]byte(body)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []*points.Points{points.OnePoint("hello.world", 42.15, 1422698155)}, received)
+}
+
+func TestHttpEncoding(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]*points.Points, 0)
+
+	r, err := receiver.New("http", map[string]interface{}{
+		"protocol":         "http",
+		"listen":           addr.String(),
+		"max-message-size": 1024,
+	},
+		func(p *points.Points) {
+			received = append(received, p)
+		},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Stop()
+
+	gzipped := func(body string) string {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(body))
+		w.Close()
+		return buf.String()
+	}
+
+	zstded := func(body string) string {
+		w, _ := zstd.NewWriter(nil)
+		defer w.Close()
+		return string(w.EncodeAll([]byte(body), nil))
+	}
+
+	jsonBody := `[{"metric": "hello.world", "value": 42.15, "timestamp": 1422698155}, {"metric": "", "value": 1}, {"value": 2}]`
+
+	table := []struct {
+		Body            string
+		ContentType     string
+		ContentEncoding string
+		Status          int
+		Response        string
+		Expected        []*points.Points
+	}{
+		{
+			Body:            gzipped("hello.world 42.15 1422698155\n"),
+			ContentEncoding: "gzip",
+			Status:          http.StatusOK,
+			Response:        `{"accepted":1,"rejected":0}`,
+			Expected:        []*points.Points{points.OnePoint("hello.world", 42.15, 1422698155)},
+		},
+		{
+			Body:            string(snappy.Encode(nil, []byte("hello.world 42.15 1422698155\n"))),
+			ContentEncoding: "snappy",
+			Status:          http.StatusOK,
+			Response:        `{"accepted":1,"rejected":0}`,
+			Expected:        []*points.Points{points.OnePoint("hello.world", 42.15, 1422698155)},
+		},
+		{
+			Body:            gzipped(jsonBody),
+			ContentType:     "application/json",
+			ContentEncoding: "gzip",
+			Status:          http.StatusOK,
+			Response:        `{"accepted":1,"rejected":2,"errors":["bad point #1: name is empty","bad point #2: name is empty"]}`,
+			Expected:        []*points.Points{points.OnePoint("hello.world", 42.15, 1422698155)},
+		},
+		{
+			Body:        `{"metric": "hello.world"}`,
+			ContentType: "application/json",
+			Status:      http.StatusBadRequest,
+		},
+		{
+			Body:            zstded(jsonBody),
+			ContentType:     "application/json; charset=utf-8",
+			ContentEncoding: "zstd",
+			Status:          http.StatusOK,
+			Response:        `{"accepted":1,"rejected":2,"errors":["bad point #1: name is empty","bad point #2: name is empty"]}`,
+			Expected:        []*points.Points{points.OnePoint("hello.world", 42.15, 1422698155)},
+		},
+		{
+			Body:            "hello.world 42.15 1422698155\n",
+			ContentEncoding: "br",
+			Status:          http.StatusUnsupportedMediaType,
+		},
+		{
+			// decompressed body is larger than max-message-size
+			Body:            zstded(strings.Repeat("hello.world 42.15 1422698155\n", 100)),
+			ContentEncoding: "zstd",
+			Status:          http.StatusBadRequest,
+		},
+		{
+			Body:            "hello.world 42.15 1422698155\n",
+			ContentEncoding: "gzip",
+			Status:          http.StatusBadRequest,
+		},
+		{
+			// decompressed body is larger than max-message-size
+			Body:            gzipped(strings.Repeat("hello.world 42.15 1422698155\n", 100)),
+			ContentEncoding: "gzip",
+			Status:          http.StatusBadRequest,
+		},
+	}
+
+	url := fmt.Sprintf("http://%s/", r.(*HTTP).Addr())
+
+	for index, tc := range table {
+		received = make([]*points.Points, 0)
+
+		req, err := http.NewRequest("POST", url, strings.NewReader(tc.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tc.ContentType)
+		req.Header.Set("Content-Encoding", tc.ContentEncoding)
+
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, fmt.Sprintf("test #%d", index)) {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, tc.Status, resp.StatusCode, fmt.Sprintf("test #%d", index))
+		if tc.Status == http.StatusOK {
+			assert.JSONEq(t, tc.Response, string(body), fmt.Sprintf("test #%d", index))
+			assert.Equal(t, tc.Expected, received, fmt.Sprintf("test #%d", index))
+		} else {
+			assert.Equal(t, 0, len(received), fmt.Sprintf("test #%d", index))
+		}
+	}
+}
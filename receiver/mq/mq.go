@@ -0,0 +1,236 @@
+// Package mq contains common parts of receivers subscribed to message brokers:
+// message parsing, topic to metric prefix mapping, TLS settings and stats
+package mq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver/parse"
+)
+
+// Message formats
+const (
+	ProtocolPlain    = "plain"
+	ProtocolProtobuf = "protobuf"
+	ProtocolPickle   = "pickle"
+)
+
+// Duration wrapper time.Duration for TOML
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText from TOML
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText encode text with TOML format
+func (d *Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Parser returns parse function of protocol
+func Parser(protocol string) (func([]byte) ([]*points.Points, error), error) {
+	switch protocol {
+	case ProtocolPlain:
+		return parse.Plain, nil
+	case ProtocolProtobuf:
+		return parse.Protobuf, nil
+	case ProtocolPickle:
+		return parse.Pickle, nil
+	}
+	return nil, fmt.Errorf("unsupported parse-protocol %#v, supported: \"plain\", \"protobuf\", \"pickle\"", protocol)
+}
+
+// TLSConfig returns client TLS config with optional CA and client certificate, nil
+// config if all files are empty
+func TLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %#v", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Consumer handles messages of subscribed topics
+type Consumer struct {
+	out    func(*points.Points)
+	parse  func([]byte) ([]*points.Points, error)
+	plain  bool
+	logger *zap.Logger
+
+	// topic is used as prefix of metric names after removing of trim and replacing
+	// separators with dots
+	topicPrefix bool
+	topicTrim   string
+	topicSep    string
+
+	messagesReceived uint32
+	metricsReceived  uint32
+	errors           uint32
+	reconnects       uint32
+	connected        int32
+
+	// stats are mirrored to Prometheus even if it is disabled, InitPrometheus only
+	// registers them
+	promMessagesReceived prometheus.Counter
+	promMetricsReceived  prometheus.Counter
+	promErrors           prometheus.Counter
+	promReconnects       prometheus.Counter
+	promConnected        prometheus.GaugeFunc
+}
+
+// NewConsumer returns consumer. kind is type of broker and name is name of receiver,
+// they are used in Prometheus metrics. topicSep is separator of topic levels of broker
+func NewConsumer(kind, name, protocol string, topicPrefix bool, topicTrim, topicSep string, logger *zap.Logger, store func(*points.Points)) (*Consumer, error) {
+	parser, err := Parser(protocol)
+	if err != nil {
+		return nil, err
+	}
+	c := &Consumer{
+		out:         store,
+		parse:       parser,
+		plain:       protocol == ProtocolPlain,
+		logger:      logger,
+		topicPrefix: topicPrefix,
+		topicTrim:   topicTrim,
+		topicSep:    topicSep,
+	}
+
+	labels := prometheus.Labels{"receiver": name}
+	counter := func(metric, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        fmt.Sprintf(metric, kind),
+			Help:        help,
+			ConstLabels: labels,
+		})
+	}
+	c.promMessagesReceived = counter("messages_received_%s_total", "Counter of messages received from broker.")
+	c.promMetricsReceived = counter("metrics_received_%s_total", "Counter of metrics received from broker.")
+	c.promErrors = counter("errors_%s_total", "Counter of messages with parse errors.")
+	c.promReconnects = counter("reconnects_%s_total", "Counter of reconnects to broker.")
+	c.promConnected = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        fmt.Sprintf("connected_%s", kind),
+			Help:        "1 if receiver is connected to broker.",
+			ConstLabels: labels,
+		},
+		func() float64 { return float64(atomic.LoadInt32(&c.connected)) },
+	)
+
+	return c, nil
+}
+
+// InitPrometheus registers consumer metrics
+func (c *Consumer) InitPrometheus(reg prometheus.Registerer) {
+	reg.MustRegister(
+		c.promMessagesReceived,
+		c.promMetricsReceived,
+		c.promErrors,
+		c.promReconnects,
+		c.promConnected,
+	)
+}
+
+// prefix returns prefix of metric names of topic
+func (c *Consumer) prefix(topic string) string {
+	if !c.topicPrefix {
+		return ""
+	}
+	topic = strings.TrimPrefix(topic, c.topicTrim)
+	if c.topicSep != "." {
+		topic = strings.Replace(topic, c.topicSep, ".", -1)
+	}
+	topic = strings.Trim(topic, ".")
+	if topic == "" {
+		return ""
+	}
+	return topic + "."
+}
+
+// Handle parses message and stores points. Message with parse error is dropped as
+// a whole
+func (c *Consumer) Handle(topic string, payload []byte) {
+	atomic.AddUint32(&c.messagesReceived, 1)
+	c.promMessagesReceived.Inc()
+
+	// last line of plain message may be published without newline
+	if c.plain && len(payload) > 0 && payload[len(payload)-1] != '\n' {
+		payload = append(payload[:len(payload):len(payload)], '\n')
+	}
+
+	msg, err := c.parse(payload)
+	if err != nil {
+		atomic.AddUint32(&c.errors, 1)
+		c.promErrors.Inc()
+		c.logger.Error("message parse failed", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+
+	prefix := c.prefix(topic)
+	cnt := 0
+	for _, p := range msg {
+		cnt += len(p.Data)
+		if prefix != "" {
+			p.Metric = prefix + p.Metric
+		}
+		c.out(p)
+	}
+	atomic.AddUint32(&c.metricsReceived, uint32(cnt))
+	c.promMetricsReceived.Add(float64(cnt))
+}
+
+// Reconnected increments reconnects counter
+func (c *Consumer) Reconnected() {
+	atomic.AddUint32(&c.reconnects, 1)
+	c.promReconnects.Inc()
+}
+
+// SetConnected updates connected gauge
+func (c *Consumer) SetConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&c.connected, 1)
+	} else {
+		atomic.StoreInt32(&c.connected, 0)
+	}
+}
+
+// Stat sends internal stats of consumer
+func (c *Consumer) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("messagesReceived", &c.messagesReceived, send)
+	helper.SendAndSubstractUint32("metricsReceived", &c.metricsReceived, send)
+	helper.SendAndSubstractUint32("errors", &c.errors, send)
+	helper.SendAndSubstractUint32("reconnects", &c.reconnects, send)
+	send("connected", float64(atomic.LoadInt32(&c.connected)))
+}
@@ -0,0 +1,222 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+	"github.com/lomik/go-carbon/receiver/mq"
+	"github.com/lomik/zapwriter"
+)
+
+// disconnectQuiesce is time in milliseconds to complete work on stop
+const disconnectQuiesce = 250
+
+func init() {
+	receiver.Register(
+		"mqtt",
+		func() interface{} { return NewOptions() },
+		func(name string, options interface{}, store func(*points.Points)) (receiver.Receiver, error) {
+			return newMQTT(name, options.(*Options), store)
+		},
+	)
+}
+
+// Options contains all receiver's options that can be changed by user
+type Options struct {
+	// Broker is host:port or URL with scheme tcp, ssl or ws
+	Broker       string   `toml:"broker"`
+	ClientID     string   `toml:"client-id"`
+	Username     string   `toml:"username"`
+	Password     string   `toml:"password"`
+	Topics       []string `toml:"topics"`
+	QoS          int      `toml:"qos"`
+	CleanSession bool     `toml:"clean-session"`
+	Protocol     string   `toml:"parse-protocol"`
+	// TopicPrefix prepends topic of message to metric names, levels of topic are separated by dots
+	TopicPrefix       bool         `toml:"topic-prefix"`
+	TopicTrim         string       `toml:"topic-prefix-trim"`
+	KeepAlive         *mq.Duration `toml:"keep-alive"`
+	ReconnectInterval *mq.Duration `toml:"reconnect-interval"`
+	ConnectTimeout    *mq.Duration `toml:"connect-timeout"`
+	TLSCAFile         string       `toml:"tls-ca-file"`
+	TLSCertFile       string       `toml:"tls-cert-file"`
+	TLSKeyFile        string       `toml:"tls-key-file"`
+}
+
+// NewOptions returns Options struct filled with default values.
+func NewOptions() *Options {
+	return &Options{
+		Broker:            "localhost:1883",
+		Topics:            []string{"graphite/#"},
+		QoS:               0,
+		CleanSession:      true,
+		Protocol:          mq.ProtocolPlain,
+		KeepAlive:         &mq.Duration{Duration: 30 * time.Second},
+		ReconnectInterval: &mq.Duration{Duration: 5 * time.Second},
+		ConnectTimeout:    &mq.Duration{Duration: 5 * time.Second},
+	}
+}
+
+// MQTT receives metrics from topics of MQTT broker
+type MQTT struct {
+	helper.Stoppable
+	*mq.Consumer
+	options  *Options
+	client   paho.Client
+	connects uint32 // number of successful connects
+	logger   *zap.Logger
+}
+
+// brokerURL adds default scheme to host:port
+func brokerURL(broker string) (string, error) {
+	if !strings.Contains(broker, "://") {
+		broker = "tcp://" + broker
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported scheme of mqtt broker %#v, supported: tcp, ssl, ws", broker)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("mqtt broker should be host:port or URL, got %#v", broker)
+	}
+	return broker, nil
+}
+
+func newMQTT(name string, options *Options, store func(*points.Points)) (*MQTT, error) {
+	logger := zapwriter.Logger(name)
+
+	broker, err := brokerURL(options.Broker)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.Topics) == 0 {
+		return nil, errors.New("'topics' must be specified")
+	}
+	if options.QoS < 0 || options.QoS > 2 {
+		return nil, fmt.Errorf("unsupported qos %d, supported: 0, 1, 2", options.QoS)
+	}
+	if options.KeepAlive.Duration < time.Second || options.KeepAlive.Duration > 65535*time.Second {
+		return nil, fmt.Errorf("keep-alive should be between 1s and 65535s, got %s", options.KeepAlive.Duration)
+	}
+	if options.ReconnectInterval.Duration <= 0 {
+		return nil, errors.New("'reconnect-interval' should be positive")
+	}
+	if options.ConnectTimeout.Duration <= 0 {
+		return nil, errors.New("'connect-timeout' should be positive")
+	}
+	if options.ClientID == "" {
+		hostname, _ := os.Hostname()
+		options.ClientID = fmt.Sprintf("go-carbon-%s-%d", hostname, os.Getpid())
+	}
+	if !options.CleanSession && options.QoS == 0 {
+		logger.Warn("clean-session = false is useless with qos = 0")
+	}
+
+	tlsConfig, err := mq.TLSConfig(options.TLSCAFile, options.TLSCertFile, options.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := mq.NewConsumer("mqtt", name, options.Protocol, options.TopicPrefix, options.TopicTrim, "/", logger, store)
+	if err != nil {
+		return nil, err
+	}
+
+	rcv := &MQTT{
+		Consumer: consumer,
+		options:  options,
+		logger:   logger,
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(options.ClientID).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetCleanSession(options.CleanSession).
+		SetKeepAlive(options.KeepAlive.Duration).
+		SetConnectTimeout(options.ConnectTimeout.Duration).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(options.ReconnectInterval.Duration).
+		// broker may be unavailable on start, connection is established in background
+		SetConnectRetry(true).
+		SetConnectRetryInterval(options.ReconnectInterval.Duration).
+		SetOnConnectHandler(rcv.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			rcv.SetConnected(false)
+			logger.Error("connection lost", zap.Error(err))
+		})
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	logger.Info("starting mqtt receiver",
+		zap.String("broker", broker),
+		zap.String("client_id", options.ClientID),
+		zap.Strings("topics", options.Topics),
+	)
+
+	rcv.client = paho.NewClient(opts)
+	rcv.client.Connect()
+
+	rcv.Start()
+	return rcv, nil
+}
+
+// onConnect subscribes to topics after every connect, session of broker may be lost
+func (rcv *MQTT) onConnect(client paho.Client) {
+	if atomic.AddUint32(&rcv.connects, 1) > 1 {
+		rcv.Reconnected()
+	}
+
+	filters := make(map[string]byte, len(rcv.options.Topics))
+	for _, topic := range rcv.options.Topics {
+		filters[topic] = byte(rcv.options.QoS)
+	}
+	token := client.SubscribeMultiple(filters, rcv.handle)
+	if !token.WaitTimeout(rcv.options.ConnectTimeout.Duration) {
+		rcv.logger.Error("subscribe timed out")
+		return
+	}
+	if err := token.Error(); err != nil {
+		rcv.logger.Error("subscribe failed", zap.Error(err))
+		return
+	}
+	rcv.SetConnected(true)
+}
+
+// handle is called sequentially for messages, QoS 1 and 2 messages are
+// acknowledged after return
+func (rcv *MQTT) handle(_ paho.Client, msg paho.Message) {
+	rcv.Handle(msg.Topic(), msg.Payload())
+}
+
+// Stop disconnects from broker
+func (rcv *MQTT) Stop() {
+	rcv.StopFunc(func() {
+		rcv.client.Disconnect(disconnectQuiesce)
+		rcv.SetConnected(false)
+	})
+}
+
+// InitPrometheus registers metrics of consumer
+func (rcv *MQTT) InitPrometheus(reg prometheus.Registerer) {
+	rcv.Consumer.InitPrometheus(reg)
+}
@@ -0,0 +1,134 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+)
+
+// testAuth allows only user with password "secret"
+type testAuth struct{}
+
+func (testAuth) Authenticate(user, password []byte) bool {
+	return string(user) == "user" && string(password) == "secret"
+}
+
+func (testAuth) ACL(user []byte, topic string, write bool) bool {
+	return true
+}
+
+// freeAddr returns address of free local port, it is reused after broker restart
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// runBroker starts embedded MQTT broker
+func runBroker(t *testing.T, addr string) *mqtt.Server {
+	s := mqtt.NewServer(nil)
+	if err := s.AddListener(listeners.NewTCP("t1", addr), &listeners.Config{Auth: testAuth{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// waitSubscribed waits for subscription of receiver to topic
+func waitSubscribed(t *testing.T, s *mqtt.Server, topic string) {
+	for start := time.Now(); len(s.Topics.Subscribers(topic)) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("receiver is not subscribed")
+		}
+	}
+}
+
+func receive(t *testing.T, ch chan *points.Points, expected ...*points.Points) {
+	for _, e := range expected {
+		select {
+		case p := <-ch:
+			assert.Equal(t, e, p)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("point %s not received", e.Metric)
+		}
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	addr := freeAddr(t)
+	s := runBroker(t, addr)
+	defer func() { s.Close() }()
+
+	ch := make(chan *points.Points, 128)
+	r, err := receiver.New("mqtt", map[string]interface{}{
+		"protocol":           "mqtt",
+		"broker":             addr,
+		"client-id":          "test",
+		"username":           "user",
+		"password":           "secret",
+		"topics":             []string{"metrics/#"},
+		"qos":                2,
+		"topic-prefix":       true,
+		"topic-prefix-trim":  "metrics/",
+		"reconnect-interval": "10ms",
+	}, func(p *points.Points) { ch <- p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	waitSubscribed(t, s, "metrics/dc1/host1")
+	assert.NoError(t, s.Publish("metrics/dc1/host1", []byte("cpu.user 42 1422797267\nmem.free 12 1422797267\n"), false))
+	assert.NoError(t, s.Publish("metrics/dc1/host1", []byte("invalid line\n"), false))
+	// last line without newline
+	assert.NoError(t, s.Publish("metrics/dc1/host1", []byte("cpu.idle 1 1422797267"), false))
+	receive(t, ch,
+		points.OnePoint("dc1.host1.cpu.user", 42, 1422797267),
+		points.OnePoint("dc1.host1.mem.free", 12, 1422797267),
+		points.OnePoint("dc1.host1.cpu.idle", 1, 1422797267),
+	)
+
+	// broker restart, clean session is lost and receiver subscribes again
+	s.Close()
+	s = runBroker(t, addr)
+	waitSubscribed(t, s, "metrics/host2")
+
+	assert.NoError(t, s.Publish("metrics/host2", []byte("cpu.user 1 1422797267\n"), false))
+	receive(t, ch, points.OnePoint("host2.cpu.user", 1, 1422797267))
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(t, float64(4), stat["messagesReceived"])
+	assert.Equal(t, float64(4), stat["metricsReceived"])
+	assert.Equal(t, float64(1), stat["errors"])
+	assert.Equal(t, float64(1), stat["reconnects"])
+	assert.Equal(t, float64(1), stat["connected"])
+}
+
+func TestBrokerURL(t *testing.T) {
+	for broker, expected := range map[string]string{
+		"localhost:1883":       "tcp://localhost:1883",
+		"tcp://localhost:1883": "tcp://localhost:1883",
+		"ssl://localhost:8883": "ssl://localhost:8883",
+		"ws://localhost/mqtt":  "ws://localhost/mqtt",
+	} {
+		u, err := brokerURL(broker)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, u)
+	}
+
+	_, err := brokerURL("http://localhost")
+	assert.Error(t, err)
+}
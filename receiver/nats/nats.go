@@ -0,0 +1,186 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+	"github.com/lomik/go-carbon/receiver/mq"
+	"github.com/lomik/zapwriter"
+)
+
+func init() {
+	receiver.Register(
+		"nats",
+		func() interface{} { return NewOptions() },
+		func(name string, options interface{}, store func(*points.Points)) (receiver.Receiver, error) {
+			return newNATS(name, options.(*Options), store)
+		},
+	)
+}
+
+// Options contains all receiver's options that can be changed by user
+type Options struct {
+	// URL of server: nats://[user:password@]host:port, nats://token@host:port or
+	// tls://host:port. Several servers of cluster are separated by commas
+	URL        string   `toml:"url"`
+	Subjects   []string `toml:"subjects"`
+	QueueGroup string   `toml:"queue-group"`
+	Protocol   string   `toml:"parse-protocol"`
+	// TopicPrefix prepends subject of message to metric names
+	TopicPrefix       bool         `toml:"topic-prefix"`
+	TopicTrim         string       `toml:"topic-prefix-trim"`
+	ReconnectInterval *mq.Duration `toml:"reconnect-interval"`
+	PingInterval      *mq.Duration `toml:"ping-interval"`
+	ConnectTimeout    *mq.Duration `toml:"connect-timeout"`
+	CredentialsFile   string       `toml:"credentials-file"`
+	NkeySeedFile      string       `toml:"nkey-seed-file"`
+	TLSCAFile         string       `toml:"tls-ca-file"`
+	TLSCertFile       string       `toml:"tls-cert-file"`
+	TLSKeyFile        string       `toml:"tls-key-file"`
+}
+
+// NewOptions returns Options struct filled with default values.
+func NewOptions() *Options {
+	return &Options{
+		URL:               nats.DefaultURL,
+		Subjects:          []string{"graphite"},
+		Protocol:          mq.ProtocolPlain,
+		ReconnectInterval: &mq.Duration{Duration: 5 * time.Second},
+		PingInterval:      &mq.Duration{Duration: 30 * time.Second},
+		ConnectTimeout:    &mq.Duration{Duration: 5 * time.Second},
+	}
+}
+
+// NATS receives metrics from subjects of NATS server
+type NATS struct {
+	helper.Stoppable
+	*mq.Consumer
+	options *Options
+	conn    *nats.Conn
+	logger  *zap.Logger
+}
+
+func newNATS(name string, options *Options, store func(*points.Points)) (*NATS, error) {
+	logger := zapwriter.Logger(name)
+
+	if options.URL == "" {
+		return nil, errors.New("'url' must be specified")
+	}
+	if len(options.Subjects) == 0 {
+		return nil, errors.New("'subjects' must be specified")
+	}
+	for opt, d := range map[string]*mq.Duration{
+		"reconnect-interval": options.ReconnectInterval,
+		"ping-interval":      options.PingInterval,
+		"connect-timeout":    options.ConnectTimeout,
+	} {
+		if d == nil || d.Duration <= 0 {
+			return nil, fmt.Errorf("'%s' should be positive", opt)
+		}
+	}
+
+	consumer, err := mq.NewConsumer("nats", name, options.Protocol, options.TopicPrefix, options.TopicTrim, ".", logger, store)
+	if err != nil {
+		return nil, err
+	}
+
+	rcv := &NATS{
+		Consumer: consumer,
+		options:  options,
+		logger:   logger,
+	}
+
+	opts := []nats.Option{
+		nats.Name("go-carbon"),
+		nats.Timeout(options.ConnectTimeout.Duration),
+		nats.PingInterval(options.PingInterval.Duration),
+		nats.ReconnectWait(options.ReconnectInterval.Duration),
+		nats.MaxReconnects(-1),
+		// server may be unavailable on start, connection is established in background
+		nats.RetryOnFailedConnect(true),
+		nats.ConnectHandler(func(*nats.Conn) {
+			rcv.SetConnected(true)
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			rcv.SetConnected(false)
+			if err != nil {
+				logger.Error("connection lost", zap.Error(err))
+			}
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			rcv.Reconnected()
+			rcv.SetConnected(true)
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				logger.Error("subscription error", zap.String("subject", sub.Subject), zap.Error(err))
+			} else {
+				logger.Error("connection error", zap.Error(err))
+			}
+		}),
+	}
+	if options.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(options.CredentialsFile))
+	}
+	if options.NkeySeedFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(options.NkeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	tlsConfig, err := mq.TLSConfig(options.TLSCAFile, options.TLSCertFile, options.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	logger.Info("starting nats receiver",
+		zap.String("url", options.URL),
+		zap.Strings("subjects", options.Subjects),
+	)
+
+	rcv.conn, err = nats.Connect(options.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	rcv.SetConnected(rcv.conn.IsConnected())
+
+	// subscriptions are sent to server after connect and restored after reconnects
+	for _, subject := range options.Subjects {
+		if _, err := rcv.conn.QueueSubscribe(subject, options.QueueGroup, rcv.handle); err != nil {
+			rcv.conn.Close()
+			return nil, err
+		}
+	}
+
+	rcv.Start()
+	return rcv, nil
+}
+
+func (rcv *NATS) handle(msg *nats.Msg) {
+	rcv.Handle(msg.Subject, msg.Data)
+}
+
+// Stop closes connection
+func (rcv *NATS) Stop() {
+	rcv.StopFunc(func() {
+		rcv.conn.Close()
+		rcv.SetConnected(false)
+	})
+}
+
+// InitPrometheus registers metrics of consumer
+func (rcv *NATS) InitPrometheus(reg prometheus.Registerer) {
+	rcv.Consumer.InitPrometheus(reg)
+}
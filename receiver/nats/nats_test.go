@@ -0,0 +1,158 @@
+package nats
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+)
+
+// runServer starts embedded NATS server, port 0 selects random port
+func runServer(t *testing.T, port int) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "user",
+		Password: "secret",
+		NoLog:    true,
+		NoSigs:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server is not ready")
+	}
+	return s
+}
+
+// waitSubscribed waits for subscription of receiver to subject
+func waitSubscribed(t *testing.T, s *server.Server, subject string) {
+	for start := time.Now(); !s.GlobalAccount().SubscriptionInterest(subject); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("receiver is not subscribed")
+		}
+	}
+}
+
+func publish(t *testing.T, s *server.Server, subject string, payloads ...string) {
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("user", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	for _, payload := range payloads {
+		if err := nc.Publish(subject, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, ch chan *points.Points, expected ...*points.Points) {
+	for _, e := range expected {
+		select {
+		case p := <-ch:
+			assert.Equal(t, e, p)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("point %s not received", e.Metric)
+		}
+	}
+}
+
+func TestNATS(t *testing.T) {
+	s := runServer(t, -1)
+	port := s.Addr().(*net.TCPAddr).Port
+	defer func() { s.Shutdown() }()
+
+	ch := make(chan *points.Points, 128)
+	r, err := receiver.New("nats", map[string]interface{}{
+		"protocol":           "nats",
+		"url":                "nats://user:secret@" + s.Addr().String(),
+		"subjects":           []string{"metrics.>"},
+		"queue-group":        "carbon",
+		"topic-prefix":       true,
+		"topic-prefix-trim":  "metrics.",
+		"reconnect-interval": "10ms",
+	}, func(p *points.Points) { ch <- p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	reg := prometheus.NewRegistry()
+	r.InitPrometheus(reg)
+
+	waitSubscribed(t, s, "metrics.dc1.host1")
+	publish(t, s, "metrics.dc1.host1",
+		"cpu.user 42 1422797267\nmem.free 12 1422797267\n",
+		"invalid line\n",
+		// last line without newline
+		"cpu.idle 1 1422797267",
+	)
+	receive(t, ch,
+		points.OnePoint("dc1.host1.cpu.user", 42, 1422797267),
+		points.OnePoint("dc1.host1.mem.free", 12, 1422797267),
+		points.OnePoint("dc1.host1.cpu.idle", 1, 1422797267),
+	)
+
+	// server restart
+	s.Shutdown()
+	s = runServer(t, port)
+	waitSubscribed(t, s, "metrics.host2")
+
+	publish(t, s, "metrics.host2", "cpu.user 1 1422797267\n")
+	receive(t, ch, points.OnePoint("host2.cpu.user", 1, 1422797267))
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(t, float64(4), stat["messagesReceived"])
+	assert.Equal(t, float64(4), stat["metricsReceived"])
+	assert.Equal(t, float64(1), stat["errors"])
+	assert.Equal(t, float64(1), stat["reconnects"])
+	assert.Equal(t, float64(1), stat["connected"])
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prom := make(map[string]float64)
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		assert.Equal(t, "receiver", m.GetLabel()[0].GetName())
+		assert.Equal(t, "nats", m.GetLabel()[0].GetValue())
+		if m.GetCounter() != nil {
+			prom[mf.GetName()] = m.GetCounter().GetValue()
+		} else {
+			prom[mf.GetName()] = m.GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"messages_received_nats_total": 4,
+		"metrics_received_nats_total":  4,
+		"errors_nats_total":            1,
+		"reconnects_nats_total":        1,
+		"connected_nats":               1,
+	}, prom)
+}
+
+func TestOptions(t *testing.T) {
+	for _, opt := range []string{"reconnect-interval", "ping-interval", "connect-timeout"} {
+		_, err := receiver.New("nats", map[string]interface{}{
+			"protocol": "nats",
+			"url":      "nats://127.0.0.1:1",
+			opt:        "0s",
+		}, func(p *points.Points) {})
+		assert.EqualError(t, err, "'"+opt+"' should be positive")
+	}
+}
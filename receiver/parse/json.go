@@ -0,0 +1,56 @@
+package parse
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+type jsonPoint struct {
+	Metric    *string  `json:"metric"`
+	Value     *float64 `json:"value"`
+	Timestamp *float64 `json:"timestamp"`
+}
+
+// JSONPartial parses array of points [{"metric": "name", "value": 42, "timestamp": 1422698155}, ...].
+// Timestamp is optional, current time is used if it is omitted. Names with whitespace or NUL are
+// invalid as in plain protocol. Invalid points are skipped and returned in rejected, err is
+// returned if body is not a JSON array
+func JSONPartial(body []byte) (result []*points.Points, rejected []error, err error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, nil, err
+	}
+
+	result = make([]*points.Points, 0, len(items))
+	now := time.Now().Unix()
+
+	for i := 0; i < len(items); i++ {
+		var p jsonPoint
+		if err := json.Unmarshal(items[i], &p); err != nil {
+			rejected = append(rejected, fmt.Errorf("bad point #%d: %s", i, err.Error()))
+			continue
+		}
+
+		switch {
+		case p.Metric == nil || len(*p.Metric) == 0:
+			rejected = append(rejected, fmt.Errorf("bad point #%d: name is empty", i))
+		case len(*p.Metric) > 16384:
+			rejected = append(rejected, fmt.Errorf("bad point #%d: name too long", i))
+		case strings.ContainsAny(*p.Metric, " \t\r\n\x00"):
+			// separators of plain protocol, such names can't be written or queried
+			rejected = append(rejected, fmt.Errorf("bad point #%d: invalid name %#v", i, *p.Metric))
+		case p.Value == nil:
+			rejected = append(rejected, fmt.Errorf("bad point #%d: value is empty", i))
+		case p.Timestamp == nil:
+			result = append(result, points.OnePoint(*p.Metric, *p.Value, now))
+		default:
+			result = append(result, points.OnePoint(*p.Metric, *p.Value, int64(*p.Timestamp)))
+		}
+	}
+
+	return result, rejected, nil
+}
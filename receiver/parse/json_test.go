@@ -0,0 +1,53 @@
+package parse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONPartial(t *testing.T) {
+	now := time.Now().Unix()
+
+	result, rejected, err := JSONPartial([]byte(`[
+		{"metric": "hello.world", "value": 42.15, "timestamp": 1422698155},
+		{"metric": "", "value": 1, "timestamp": 1422698155},
+		{"metric": "hello.now", "value": 1},
+		42
+	]`))
+
+	assert.NoError(t, err)
+	assert.Len(t, rejected, 2)
+	if assert.Len(t, result, 2) {
+		assert.Equal(t, points.OnePoint("hello.world", 42.15, 1422698155), result[0])
+		assert.Equal(t, "hello.now", result[1].Metric)
+		assert.True(t, result[1].Data[0].Timestamp >= now)
+	}
+
+	for _, body := range []string{
+		`{"metric": "hello.world", "value": 42, "timestamp": 1422698155}`,
+		`[{"metric": "hello.world", "value": 42`,
+	} {
+		_, _, err := JSONPartial([]byte(body))
+		assert.Error(t, err, body)
+	}
+
+	_, rejected, err = JSONPartial([]byte(`[{"metric": "hello.world", "timestamp": 1422698155}, {"metric": "hello.world", "value": "42"}]`))
+	assert.NoError(t, err)
+	assert.Len(t, rejected, 2)
+
+	result, rejected, err = JSONPartial([]byte(`[
+		{"metric": "hello world", "value": 1},
+		{"metric": "hello.world\n", "value": 1},
+		{"metric": "hello\u0000world", "value": 1},
+		{"metric": "hello\tworld", "value": 1},
+		{"metric": "hello.world;tag=value", "value": 1}
+	]`))
+	assert.NoError(t, err)
+	assert.Len(t, rejected, 4)
+	if assert.Len(t, result, 1) {
+		assert.Equal(t, "hello.world;tag=value", result[0].Metric)
+	}
+}
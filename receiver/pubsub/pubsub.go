@@ -7,17 +7,22 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 
 	"cloud.google.com/go/pubsub"
 	"go.uber.org/zap"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 
 	"github.com/lomik/go-carbon/helper"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/go-carbon/receiver"
 	"github.com/lomik/go-carbon/receiver/parse"
+	"github.com/lomik/go-carbon/tags"
 	"github.com/lomik/zapwriter"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -36,6 +41,14 @@ func init() {
 	)
 }
 
+// Message formats
+const (
+	ProtocolAuto     = "" // by content-type attribute
+	ProtocolPlain    = "plain"
+	ProtocolProtobuf = "protobuf"
+	ProtocolPickle   = "pickle"
+)
+
 // Options contains all receiver's options that can be changed by user
 type Options struct {
 	Project             string `toml:"project"`
@@ -43,6 +56,15 @@ type Options struct {
 	ReceiverGoRoutines  int    `toml:"receiver_go_routines"`
 	ReceiverMaxMessages int    `toml:"receiver_max_messages"`
 	ReceiverMaxBytes    int    `toml:"receiver_max_bytes"`
+	// EmulatorHost is address of local Pub/Sub emulator. Same as PUBSUB_EMULATOR_HOST
+	// environment variable
+	EmulatorHost string `toml:"emulator-host"`
+	// Protocol of messages. Empty - detected by content-type attribute of message
+	Protocol string `toml:"parse-protocol"`
+	// PrefixAttribute is message attribute prepended to metric names
+	PrefixAttribute string `toml:"prefix-attribute"`
+	// TagAttributes are message attributes added to metric names as tags
+	TagAttributes []string `toml:"tag-attributes"`
 }
 
 // NewOptions returns Options struct filled with default values.
@@ -69,6 +91,17 @@ type PubSub struct {
 	logger           *zap.Logger
 	closed           chan struct{}
 	statsAsCounters  bool
+
+	protocol        string
+	prefixAttribute string
+	tagAttributes   []string
+
+	// flow control
+	bytesReceived       uint64
+	outstandingMessages int32
+	outstandingBytes    int64
+	maxMessages         int
+	maxBytes            int
 }
 
 // newPubSub returns a PubSub receiver. Optionally accepts a client to allow
@@ -85,9 +118,30 @@ func newPubSub(client *pubsub.Client, name string, options *Options, store func(
 		return nil, fmt.Errorf("'project' must be specified")
 	}
 
+	switch options.Protocol {
+	case ProtocolAuto, ProtocolPlain, ProtocolProtobuf, ProtocolPickle:
+	default:
+		return nil, fmt.Errorf("unsupported parse-protocol %#v, supported: \"plain\", \"protobuf\", \"pickle\" or empty", options.Protocol)
+	}
+
+	for _, tag := range options.TagAttributes {
+		if tag == "" || strings.ContainsAny(tag, ";!^=") {
+			return nil, fmt.Errorf("invalid tag-attributes name %#v", tag)
+		}
+	}
+
 	ctx := context.Background()
 	if client == nil {
-		c, err := pubsub.NewClient(ctx, options.Project)
+		var opts []option.ClientOption
+		if options.EmulatorHost != "" {
+			logger.Info("using pubsub emulator", zap.String("emulator-host", options.EmulatorHost))
+			conn, err := grpc.Dial(options.EmulatorHost, grpc.WithInsecure())
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, option.WithGRPCConn(conn))
+		}
+		c, err := pubsub.NewClient(ctx, options.Project, opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -118,13 +172,18 @@ func newPubSub(client *pubsub.Client, name string, options *Options, store func(
 	cctx, cancel := context.WithCancel(ctx)
 
 	rcv := &PubSub{
-		out:          store,
-		name:         name,
-		client:       client,
-		cancel:       cancel,
-		subscription: sub,
-		logger:       logger,
-		closed:       make(chan struct{}),
+		out:             store,
+		name:            name,
+		client:          client,
+		cancel:          cancel,
+		subscription:    sub,
+		logger:          logger,
+		closed:          make(chan struct{}),
+		protocol:        options.Protocol,
+		prefixAttribute: options.PrefixAttribute,
+		tagAttributes:   options.TagAttributes,
+		maxMessages:     sub.ReceiveSettings.MaxOutstandingMessages,
+		maxBytes:        sub.ReceiveSettings.MaxOutstandingBytes,
 	}
 
 	// Receive() will create goroutines as necessary to handle incoming messages. Reconnect
@@ -132,10 +191,19 @@ func newPubSub(client *pubsub.Client, name string, options *Options, store func(
 	go func() {
 		for {
 			err := rcv.subscription.Receive(cctx, func(ctx context.Context, m *pubsub.Message) {
+				size := int64(len(m.Data))
+				atomic.AddInt32(&rcv.outstandingMessages, 1)
+				atomic.AddInt64(&rcv.outstandingBytes, size)
+				atomic.AddUint64(&rcv.bytesReceived, uint64(size))
+
 				rcv.handleMessage(m)
 				m.Ack()
+
+				atomic.AddInt32(&rcv.outstandingMessages, -1)
+				atomic.AddInt64(&rcv.outstandingBytes, -size)
 			})
-			if err == context.Canceled {
+			// Receive returns nil on cancel in some versions of client
+			if err == context.Canceled || cctx.Err() != nil {
 				close(rcv.closed)
 				rcv.Stop()
 				break
@@ -178,10 +246,22 @@ func (rcv *PubSub) handleMessage(m *pubsub.Message) {
 		data = m.Data
 	}
 
-	switch m.Attributes["content-type"] {
-	case "application/python-pickle":
+	protocol := rcv.protocol
+	if protocol == ProtocolAuto {
+		switch m.Attributes["content-type"] {
+		case "application/python-pickle":
+			protocol = ProtocolPickle
+		case "application/protobuf":
+			protocol = ProtocolProtobuf
+		default:
+			protocol = ProtocolPlain
+		}
+	}
+
+	switch protocol {
+	case ProtocolPickle:
 		points, err = parse.Pickle(data)
-	case "application/protobuf":
+	case ProtocolProtobuf:
 		points, err = parse.Protobuf(data)
 	default:
 		points, err = parse.Plain(data)
@@ -189,19 +269,59 @@ func (rcv *PubSub) handleMessage(m *pubsub.Message) {
 	if err != nil {
 		atomic.AddUint32(&rcv.errors, 1)
 		rcv.logger.Error(err.Error())
-	}
-	if len(points) == 0 {
 		return
 	}
 
+	prefix, suffix := rcv.rename(m.Attributes)
+
 	cnt := 0
 	for i := 0; i < len(points); i++ {
+		if prefix != "" || suffix != "" {
+			metric, err := tags.Normalize(prefix + points[i].Metric + suffix)
+			if err != nil {
+				atomic.AddUint32(&rcv.errors, 1)
+				rcv.logger.Error(err.Error())
+				continue
+			}
+			points[i].Metric = metric
+		}
 		cnt += len(points[i].Data)
 		rcv.out(points[i])
 	}
 	atomic.AddUint32(&rcv.metricsReceived, uint32(cnt))
 }
 
+// rename returns prefix and tags added to metric names by message attributes
+func (rcv *PubSub) rename(attrs map[string]string) (prefix, suffix string) {
+	if rcv.prefixAttribute != "" {
+		if v := strings.TrimSuffix(attributeValue(attrs[rcv.prefixAttribute]), "."); v != "" {
+			prefix = v + "."
+		}
+	}
+	for _, tag := range rcv.tagAttributes {
+		if v := tagValue(attrs[tag]); v != "" {
+			suffix += ";" + tag + "=" + v
+		}
+	}
+	return
+}
+
+// attributeValue replaces characters which break metric name: ";" separates tags,
+// whitespace separates fields of plain protocol
+func attributeValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ';' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// tagValue makes graphite tag value of message attribute, value can't start with "~"
+func tagValue(v string) string {
+	return strings.TrimLeft(attributeValue(v), "~")
+}
+
 // Stop shuts down the pubsub receiver and waits until all message processing is completed
 // before returning
 func (rcv *PubSub) Stop() {
@@ -220,10 +340,20 @@ func (rcv *PubSub) Stat(send helper.StatCallback) {
 	errors := atomic.LoadUint32(&rcv.errors)
 	send("errors", float64(errors))
 
+	bytesReceived := atomic.LoadUint64(&rcv.bytesReceived)
+	send("bytesReceived", float64(bytesReceived))
+
+	// flow control
+	send("outstandingMessages", float64(atomic.LoadInt32(&rcv.outstandingMessages)))
+	send("outstandingBytes", float64(atomic.LoadInt64(&rcv.outstandingBytes)))
+	send("maxOutstandingMessages", float64(rcv.maxMessages))
+	send("maxOutstandingBytes", float64(rcv.maxBytes))
+
 	if !rcv.statsAsCounters {
 		atomic.AddUint32(&rcv.messagesReceived, -messagesReceived)
 		atomic.AddUint32(&rcv.metricsReceived, -metricsReceived)
 		atomic.AddUint32(&rcv.errors, -errors)
+		atomic.AddUint64(&rcv.bytesReceived, -bytesReceived)
 	}
 }
 
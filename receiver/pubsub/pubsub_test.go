@@ -135,3 +135,103 @@ func Test_handleMessage(t *testing.T) {
 		}
 	}
 }
+
+func Test_handleMessageOptions(t *testing.T) {
+	_, _, client, err := newTestClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]*points.Points, 0)
+	storeFn := func(p *points.Points) {
+		received = append(received, p)
+	}
+	opts := &Options{
+		Project:         testProject,
+		Subscription:    testSub,
+		Protocol:        ProtocolPickle,
+		PrefixAttribute: "source",
+		TagAttributes:   []string{"dc", "env"},
+	}
+	r, err := newPubSub(client, "pubsub", opts, storeFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// content-type is ignored with explicit parse-protocol
+	r.handleMessage(&pubsub.Message{
+		Data: []byte("(lp0\n(S'param1'\np1\n(I1423931224\nF60.2\ntp2\ntp3\na."),
+		Attributes: map[string]string{
+			"content-type": "application/protobuf",
+			"source":       "host1",
+			"dc":           "east",
+		},
+	})
+	assert.Equal(t, []*points.Points{points.OnePoint("host1.param1;dc=east", 60.2, 1423931224)}, received)
+
+	// prefix and tag values are sanitized
+	received = received[:0]
+	r.protocol = ProtocolPlain
+	r.handleMessage(&pubsub.Message{
+		Data: []byte("cpu;dc=west 1 1423931224\nmem 2 1423931224\n"),
+		Attributes: map[string]string{
+			"source": "a;env=x b.",
+			"dc":     "north pole",
+			"env":    "~prod;host=x",
+		},
+	})
+	assert.Equal(t, []*points.Points{
+		points.OnePoint("a_env=x_b.cpu;dc=north_pole;env=prod_host=x", 1, 1423931224),
+		points.OnePoint("a_env=x_b.mem;dc=north_pole;env=prod_host=x", 2, 1423931224),
+	}, received)
+
+	// message with parse error is dropped
+	received = received[:0]
+	r.handleMessage(&pubsub.Message{Data: []byte("cpu 1 1423931224\nbroken")})
+	assert.Empty(t, received)
+	assert.Equal(t, uint32(1), r.errors)
+
+	opts.Protocol = "json"
+	_, err = newPubSub(client, "pubsub", opts, storeFn)
+	assert.Error(t, err)
+
+	opts.Protocol = ProtocolPlain
+	opts.TagAttributes = []string{"dc;x"}
+	_, err = newPubSub(client, "pubsub", opts, storeFn)
+	assert.Error(t, err)
+}
+
+func TestEmulator(t *testing.T) {
+	srv, topic, _, err := newTestClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *points.Points, 10)
+	opts := NewOptions()
+	opts.Project = testProject
+	opts.Subscription = testSub
+	opts.EmulatorHost = srv.Addr
+	r, err := newPubSub(nil, "pubsub", opts, func(p *points.Points) { received <- p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	_, err = topic.Publish(context.Background(), &pubsub.Message{Data: []byte("hello.world 42 1422698155\n")}).Get(context.Background())
+	assert.NoError(t, err)
+
+	select {
+	case p := <-received:
+		assert.Equal(t, points.OnePoint("hello.world", 42, 1422698155), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received from emulator")
+	}
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(t, float64(1), stat["messagesReceived"])
+	assert.Equal(t, float64(26), stat["bytesReceived"])
+	assert.Equal(t, float64(1000), stat["maxOutstandingMessages"])
+}
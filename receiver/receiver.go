@@ -18,6 +18,14 @@ type Receiver interface {
 	InitPrometheus(prometheus.Registerer)
 }
 
+// BackpressureReceiver is implemented by receivers which are able to slow down clients
+// instead of dropping data when storage is overloaded.
+// backpressure returns nil if storage accepts data, or channel which will be closed when
+// storage is ready to accept data again
+type BackpressureReceiver interface {
+	SetBackpressure(backpressure func() <-chan struct{})
+}
+
 type protocolRecord struct {
 	newOptions  func() interface{}
 	newReceiver func(name string, options interface{}, store func(*points.Points)) (Receiver, error)
@@ -96,6 +96,8 @@ type TCP struct {
 	buffer              chan *points.Points
 	logger              *zap.Logger
 	decompressor        decompressor
+	backpressure        atomic.Value // func() <-chan struct{}
+	backpressureCnt     uint32
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
@@ -175,7 +177,32 @@ func newFraming(parser string, name string, options *FramingOptions, store func(
 	return r, err
 }
 
-func (rcv *TCP) HandleConnection(conn net.Conn) {
+// SetBackpressure sets function which is checked before reading of each line or frame.
+// Reading from connection is paused while storage is overloaded
+func (rcv *TCP) SetBackpressure(backpressure func() <-chan struct{}) {
+	rcv.backpressure.Store(backpressure)
+}
+
+func (rcv *TCP) waitBackpressure(exit chan bool) {
+	backpressure, ok := rcv.backpressure.Load().(func() <-chan struct{})
+	if !ok {
+		return
+	}
+
+	release := backpressure()
+	if release == nil {
+		return
+	}
+
+	atomic.AddUint32(&rcv.backpressureCnt, 1)
+
+	select {
+	case <-release:
+	case <-exit:
+	}
+}
+
+func (rcv *TCP) HandleConnection(conn net.Conn, exit chan bool) {
 	atomic.AddInt32(&rcv.active, 1)
 	defer atomic.AddInt32(&rcv.active, -1)
 
@@ -206,6 +233,8 @@ func (rcv *TCP) HandleConnection(conn net.Conn) {
 	conn.SetReadDeadline(lastDeadline.Add(readTimeout))
 
 	for {
+		rcv.waitBackpressure(exit)
+
 		now := time.Now()
 		if now.Sub(lastDeadline) > (readTimeout / 4) {
 			conn.SetReadDeadline(now.Add(readTimeout))
@@ -241,7 +270,7 @@ func (rcv *TCP) HandleConnection(conn net.Conn) {
 	}
 }
 
-func (rcv *TCP) handleFraming(conn net.Conn) {
+func (rcv *TCP) handleFraming(conn net.Conn, exit chan bool) {
 	framedConn, _ := framing.NewConn(conn, byte(4), binary.BigEndian)
 	defer func() {
 		if r := recover(); r != nil {
@@ -270,6 +299,8 @@ func (rcv *TCP) handleFraming(conn net.Conn) {
 	framedConn.MaxFrameSize = uint(rcv.maxMessageSize)
 
 	for {
+		rcv.waitBackpressure(exit)
+
 		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
 		data, err := framedConn.ReadFrame()
 		if err == io.EOF {
@@ -317,6 +348,8 @@ func (rcv *TCP) Stat(send helper.StatCallback) {
 	atomic.AddUint32(&rcv.errors, -errors)
 	send("errors", float64(errors))
 
+	helper.SendAndSubstractUint32("backpressureCount", &rcv.backpressureCnt, send)
+
 	if rcv.buffer != nil {
 		send("bufferLen", float64(len(rcv.buffer)))
 		send("bufferCap", float64(cap(rcv.buffer)))
@@ -378,7 +411,7 @@ func (rcv *TCP) Listen(addr *net.TCPAddr) error {
 				}
 
 				rcv.Go(func(exit chan bool) {
-					handler(conn)
+					handler(conn, exit)
 				})
 			}
 
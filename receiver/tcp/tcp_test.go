@@ -135,3 +135,44 @@ func TestTCPIssue176(t *testing.T) {
 		t.Fatalf("Message #1 not received")
 	}
 }
+
+func TestTCPBackpressure(t *testing.T) {
+	test := newTCPTestCase(t, "tcp")
+	defer test.Finish()
+
+	release := make(chan struct{})
+	test.receiver.SetBackpressure(func() <-chan struct{} {
+		select {
+		case <-release:
+			return nil
+		default:
+			return release
+		}
+	})
+
+	test.Send("hello.world 42.15 1422698155\nmetric.name -72.11 1422698155\n")
+
+	time.Sleep(10 * time.Millisecond)
+
+	if len(test.rcvChan) > 1 {
+		t.Fatalf("Reading should be paused")
+	}
+
+	close(release)
+
+	time.Sleep(10 * time.Millisecond)
+
+	select {
+	case msg := <-test.rcvChan:
+		test.Eq(msg, points.OnePoint("hello.world", 42.15, 1422698155))
+	default:
+		t.Fatalf("Message #0 not received")
+	}
+
+	select {
+	case msg := <-test.rcvChan:
+		test.Eq(msg, points.OnePoint("metric.name", -72.11, 1422698155))
+	default:
+		t.Fatalf("Message #1 not received")
+	}
+}
@@ -2,6 +2,7 @@ package udp
 
 import (
 	"bytes"
+	"fmt"
 	"net"
 	"strings"
 	"sync/atomic"
@@ -30,6 +31,17 @@ type Options struct {
 	Listen     string `toml:"listen"`
 	Enabled    bool   `toml:"enabled"`
 	BufferSize int    `toml:"buffer-size"`
+	Sockets    int    `toml:"sockets"`
+	BatchSize  int    `toml:"batch-size"`
+}
+
+// socket is one of SO_REUSEPORT sockets bound to the same address
+type socket struct {
+	conn         *net.UDPConn
+	datagrams    uint32 // received datagrams
+	batches      uint32 // reads which returned datagrams, datagrams/batches is average batch size
+	overflow     uint32 // datagrams dropped by kernel (SO_RXQ_OVFL)
+	lastOverflow uint32 // last seen SO_RXQ_OVFL value. Used only by reader goroutine
 }
 
 // UDP receive metrics from UDP socket
@@ -40,7 +52,8 @@ type UDP struct {
 	metricsReceived uint32
 	errors          uint32
 	logIncomplete   bool
-	conn            *net.UDPConn
+	sockets         []*socket
+	batchSize       int
 	buffer          chan *points.Points
 	logger          *zap.Logger
 }
@@ -50,15 +63,17 @@ func NewOptions() *Options {
 		Listen:     ":2003",
 		Enabled:    true,
 		BufferSize: 0,
+		Sockets:    1,
+		BatchSize:  1,
 	}
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
 func (rcv *UDP) Addr() net.Addr {
-	if rcv.conn == nil {
+	if len(rcv.sockets) == 0 {
 		return nil
 	}
-	return rcv.conn.LocalAddr()
+	return rcv.sockets[0].conn.LocalAddr()
 }
 
 func newUDP(name string, options *Options, store func(*points.Points)) (*UDP, error) {
@@ -71,10 +86,24 @@ func newUDP(name string, options *Options, store func(*points.Points)) (*UDP, er
 		return nil, err
 	}
 
+	if options.Sockets < 1 {
+		options.Sockets = 1
+	}
+
+	if options.Sockets > 1 && !reusePortSupported {
+		return nil, fmt.Errorf("sockets = %d is not supported on this platform", options.Sockets)
+	}
+
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+
 	r := &UDP{
-		out:    store,
-		name:   name,
-		logger: zapwriter.Logger(name),
+		out:       store,
+		name:      name,
+		sockets:   make([]*socket, options.Sockets),
+		batchSize: options.BatchSize,
+		logger:    zapwriter.Logger(name),
 	}
 
 	if options.BufferSize > 0 {
@@ -98,68 +127,86 @@ func (rcv *UDP) Stat(send helper.StatCallback) {
 	atomic.AddUint32(&rcv.errors, -errors)
 	send("errors", float64(errors))
 
+	for i, s := range rcv.sockets {
+		if s == nil {
+			continue
+		}
+		helper.SendAndSubstractUint32(fmt.Sprintf("socket.%d.datagrams", i), &s.datagrams, send)
+		helper.SendAndSubstractUint32(fmt.Sprintf("socket.%d.batches", i), &s.batches, send)
+		helper.SendAndSubstractUint32(fmt.Sprintf("socket.%d.overflow", i), &s.overflow, send)
+	}
+
 	if rcv.buffer != nil {
 		send("bufferLen", float64(len(rcv.buffer)))
 		send("bufferCap", float64(cap(rcv.buffer)))
 	}
 }
 
-func (rcv *UDP) receiveWorker(exit chan bool) {
-	defer rcv.conn.Close()
-
-	var buf [65535]byte
+// handleDatagram parses single datagram. Trailing newline is optional
+func (rcv *UDP) handleDatagram(data []byte, peer func() string) {
+	// every line is parsed separately: bad line doesn't drop the rest of datagram
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
 
-	var data *bytes.Buffer
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
 
-	for {
-		rlen, peer, err := rcv.conn.ReadFromUDP(buf[:])
+		name, value, timestamp, err := parse.PlainLine(line)
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				break
-			}
 			atomic.AddUint32(&rcv.errors, 1)
-			rcv.logger.Error("read error", zap.Error(err))
+			rcv.logger.Info("parse failed",
+				zap.Error(err),
+				zap.String("peer", peer()),
+			)
 			continue
 		}
 
-		data = bytes.NewBuffer(buf[:rlen])
-
-		for {
-			line, err := data.ReadBytes('\n')
-
-			if len(line) > 0 {
-				name, value, timestamp, err := parse.PlainLine(line)
-				if err != nil {
-					atomic.AddUint32(&rcv.errors, 1)
-					rcv.logger.Info("parse failed",
-						zap.Error(err),
-						zap.String("peer", peer.String()),
-					)
-				} else {
-					atomic.AddUint32(&rcv.metricsReceived, 1)
-					rcv.out(points.OnePoint(string(name), value, timestamp))
-				}
-			}
+		atomic.AddUint32(&rcv.metricsReceived, 1)
+		rcv.out(points.OnePoint(string(name), value, timestamp))
+	}
+}
 
-			if err != nil {
-				break
-			}
-		}
+func (rcv *UDP) receiveWorker(sock *socket) func(exit chan bool) {
+	return func(exit chan bool) {
+		defer sock.conn.Close()
+
+		rcv.readLoop(sock)
 	}
 }
 
+func isClosedError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
 // Listen bind port. Receive messages and send to out channel
 func (rcv *UDP) Listen(addr *net.UDPAddr) error {
 	return rcv.StartFunc(func() error {
-		var err error
-		rcv.conn, err = net.ListenUDP("udp", addr)
-		if err != nil {
-			return err
+		for i := 0; i < len(rcv.sockets); i++ {
+			conn, err := listenUDP(addr, len(rcv.sockets) > 1)
+			if err != nil {
+				for _, s := range rcv.sockets[:i] {
+					s.conn.Close()
+				}
+				return err
+			}
+
+			// all other sockets should be bound to the same port (for listen port 0)
+			addr = conn.LocalAddr().(*net.UDPAddr)
+
+			rcv.sockets[i] = &socket{conn: conn}
 		}
 
 		rcv.Go(func(exit chan bool) {
 			<-exit
-			rcv.conn.Close()
+			for _, s := range rcv.sockets {
+				s.conn.Close()
+			}
 		})
 
 		if rcv.buffer != nil {
@@ -181,7 +228,9 @@ func (rcv *UDP) Listen(addr *net.UDPAddr) error {
 			}
 		}
 
-		rcv.Go(rcv.receiveWorker)
+		for _, s := range rcv.sockets {
+			rcv.Go(rcv.receiveWorker(s))
+		}
 
 		return nil
 	})
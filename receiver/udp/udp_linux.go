@@ -0,0 +1,188 @@
+// +build linux
+
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// mmsghdr is struct mmsghdr from recvmmsg(2)
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+func listenUDP(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if reusePort {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+					if sockErr != nil {
+						return
+					}
+				}
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// readLoop reads datagrams with recvmmsg(2) up to batchSize messages per syscall
+func (rcv *UDP) readLoop(sock *socket) {
+	rawConn, err := sock.conn.SyscallConn()
+	if err != nil {
+		rcv.logger.Error("can't get raw connection", zap.Error(err))
+		return
+	}
+
+	oobSize := unix.CmsgSpace(4)
+
+	msgs := make([]mmsghdr, rcv.batchSize)
+	bufs := make([][]byte, rcv.batchSize)
+	oobs := make([][]byte, rcv.batchSize)
+	iovs := make([]unix.Iovec, rcv.batchSize)
+	names := make([]unix.RawSockaddrAny, rcv.batchSize)
+
+	for i := 0; i < rcv.batchSize; i++ {
+		bufs[i] = make([]byte, 65535)
+		oobs[i] = make([]byte, oobSize)
+
+		iovs[i].Base = &bufs[i][0]
+		iovs[i].SetLen(len(bufs[i]))
+
+		msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+		msgs[i].hdr.Control = &oobs[i][0]
+	}
+
+	for {
+		for i := 0; i < rcv.batchSize; i++ {
+			msgs[i].hdr.Namelen = unix.SizeofSockaddrAny
+			msgs[i].hdr.SetControllen(oobSize)
+			msgs[i].hdr.Flags = 0
+			msgs[i].len = 0
+		}
+
+		var n int
+		var errno syscall.Errno
+
+		err = rawConn.Read(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(unix.SYS_RECVMMSG, fd,
+				uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)),
+				unix.MSG_DONTWAIT, 0, 0)
+			if e == unix.EAGAIN || e == unix.EWOULDBLOCK {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		})
+
+		if err != nil {
+			if !isClosedError(err) {
+				rcv.logger.Error("read error", zap.Error(err))
+			}
+			return
+		}
+
+		if errno != 0 {
+			if errno == unix.EINTR {
+				continue
+			}
+			atomic.AddUint32(&rcv.errors, 1)
+			rcv.logger.Error("read error", zap.Error(errno))
+			continue
+		}
+
+		if n > 0 {
+			atomic.AddUint32(&sock.batches, 1)
+			atomic.AddUint32(&sock.datagrams, uint32(n))
+		}
+
+		// buffers are not less than max UDP payload, datagrams are never truncated
+		for i := 0; i < n; i++ {
+			m := &msgs[i]
+
+			rcv.checkOverflow(sock, oobs[i][:m.hdr.Controllen])
+
+			name := &names[i]
+			rcv.handleDatagram(bufs[i][:m.len], func() string {
+				return sockaddrString(name)
+			})
+		}
+	}
+}
+
+// checkOverflow updates socket overflow counter from SO_RXQ_OVFL control message
+func (rcv *UDP) checkOverflow(sock *socket, oob []byte) {
+	if len(oob) == 0 {
+		return
+	}
+
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level != unix.SOL_SOCKET || cmsg.Header.Type != unix.SO_RXQ_OVFL || len(cmsg.Data) < 4 {
+			continue
+		}
+
+		// kernel reports total number of dropped datagrams since socket creation
+		value := nativeEndian.Uint32(cmsg.Data)
+		if value != sock.lastOverflow {
+			atomic.AddUint32(&sock.overflow, value-sock.lastOverflow)
+			sock.lastOverflow = value
+		}
+	}
+}
+
+func sockaddrString(rsa *unix.RawSockaddrAny) string {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(int(p[0])<<8+int(p[1])))
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(int(p[0])<<8+int(p[1])))
+	}
+	return ""
+}
+
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&i))[0] == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
@@ -0,0 +1,37 @@
+// +build !linux
+
+package udp
+
+import (
+	"net"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+const reusePortSupported = false
+
+func listenUDP(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	return net.ListenUDP("udp", addr)
+}
+
+// readLoop reads one datagram per syscall. batch-size is ignored on this platform
+func (rcv *UDP) readLoop(sock *socket) {
+	var buf [65535]byte
+
+	for {
+		rlen, peer, err := sock.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if isClosedError(err) {
+				return
+			}
+			atomic.AddUint32(&rcv.errors, 1)
+			rcv.logger.Error("read error", zap.Error(err))
+			continue
+		}
+
+		atomic.AddUint32(&sock.batches, 1)
+		atomic.AddUint32(&sock.datagrams, 1)
+		rcv.handleDatagram(buf[:rlen], peer.String)
+	}
+}
@@ -1,6 +1,7 @@
 package udp
 
 import (
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -17,6 +18,12 @@ type udpTestCase struct {
 }
 
 func newUDPTestCaseWithOptions(t *testing.T, logIncomplete bool) *udpTestCase {
+	return newUDPTestCaseWithExtraOptions(t, map[string]interface{}{
+		"log-incomplete": logIncomplete,
+	})
+}
+
+func newUDPTestCaseWithExtraOptions(t *testing.T, extra map[string]interface{}) *udpTestCase {
 	test := &udpTestCase{
 		T: t,
 	}
@@ -28,11 +35,15 @@ func newUDPTestCaseWithOptions(t *testing.T, logIncomplete bool) *udpTestCase {
 
 	test.rcvChan = make(chan *points.Points, 128)
 
-	r, err := receiver.New("udp", map[string]interface{}{
-		"protocol":       "udp",
-		"log-incomplete": logIncomplete,
-		"listen":         addr.String(),
-	},
+	options := map[string]interface{}{
+		"protocol": "udp",
+		"listen":   addr.String(),
+	}
+	for k, v := range extra {
+		options[k] = v
+	}
+
+	r, err := receiver.New("udp", options,
 		func(p *points.Points) {
 			test.rcvChan <- p
 		},
@@ -120,6 +131,33 @@ func TestUDP2(t *testing.T) {
 	}
 }
 
+func TestUDPBadLine(t *testing.T) {
+	test := newUDPTestCase(t)
+	defer test.Finish()
+
+	test.Send("bad.line 42.15\nhello.world 42.15 1422698155\nbad.value x 1422698155\nmetric.name -72.11 1422698155\n")
+
+	for i, expected := range []*points.Points{
+		points.OnePoint("hello.world", 42.15, 1422698155),
+		points.OnePoint("metric.name", -72.11, 1422698155),
+	} {
+		select {
+		case msg := <-test.rcvChan:
+			test.Eq(msg, expected)
+		default:
+			t.Fatalf("Message #%d not received", i)
+		}
+	}
+
+	stat := make(map[string]float64)
+	test.receiver.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["errors"] != 2 || stat["metricsReceived"] != 2 {
+		t.Fatalf("unexpected stat %v", stat)
+	}
+}
+
 func TestUDPWithoutTrailingNewline(t *testing.T) {
 	test := newUDPTestCase(t)
 	defer test.Finish()
@@ -140,3 +178,95 @@ func TestUDPWithoutTrailingNewline(t *testing.T) {
 		t.Fatalf("Message #1 not received")
 	}
 }
+
+func TestUDPMultiSocketBatch(t *testing.T) {
+	// store of the first point is blocked until all datagrams are sent, so they are
+	// queued by kernel and read by the next recvmmsg at once
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	rcvChan := make(chan *points.Points, 128)
+	blocked := false
+
+	r, err := receiver.New("udp", map[string]interface{}{
+		"protocol":   "udp",
+		"listen":     "localhost:0",
+		"sockets":    4,
+		"batch-size": 8,
+	}, func(p *points.Points) {
+		if !blocked {
+			blocked = true
+			close(entered)
+			<-release
+		}
+		rcvChan <- p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv := r.(*UDP)
+	defer rcv.Stop()
+
+	if len(rcv.sockets) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(rcv.sockets))
+	}
+
+	// datagrams of one connection are always delivered to the same socket
+	conn, err := net.Dial("udp", rcv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 16; i++ {
+		if _, err := conn.Write([]byte("hello.world 42.15 1422698155\nmetric.name -72.11 1422698155")); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			<-entered
+		}
+	}
+	close(release)
+
+	for i := 0; i < 16; i++ {
+		for _, expected := range []*points.Points{
+			points.OnePoint("hello.world", 42.15, 1422698155),
+			points.OnePoint("metric.name", -72.11, 1422698155),
+		} {
+			select {
+			case msg := <-rcvChan:
+				if !msg.Eq(expected) {
+					t.Fatalf("%#v != %#v", msg, expected)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Message #%d not received", i)
+			}
+		}
+	}
+
+	stat := make(map[string]float64)
+	rcv.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+
+	if stat["metricsReceived"] != 32 {
+		t.Fatalf("expected 32 received metrics, got %v", stat["metricsReceived"])
+	}
+
+	var datagrams, batches float64
+	for i := 0; i < 4; i++ {
+		for _, key := range []string{"datagrams", "batches", "overflow"} {
+			if _, ok := stat[fmt.Sprintf("socket.%d.%s", i, key)]; !ok {
+				t.Fatalf("socket.%d.%s not reported", i, key)
+			}
+		}
+		datagrams += stat[fmt.Sprintf("socket.%d.datagrams", i)]
+		batches += stat[fmt.Sprintf("socket.%d.batches", i)]
+	}
+	if datagrams != 16 {
+		t.Fatalf("expected 16 datagrams, got %v", datagrams)
+	}
+	// the first datagram is read alone, 15 queued ones by ceil(15/8) reads
+	if batches != 3 {
+		t.Fatalf("expected 3 batches, got %v (%v datagrams)", batches, datagrams)
+	}
+}
@@ -0,0 +1,132 @@
+package tags
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ServeHTTP implements graphite-web HTTP TagDB API over local tag index, so
+// graphite-web could use go-carbon as TAGDB_HTTP_URL
+func (t *Tags) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if t.local == nil {
+		http.Error(w, "local tagdb is disabled", http.StatusNotFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("Bad request (%s)", err), http.StatusBadRequest)
+		return
+	}
+
+	var res interface{}
+	var err error
+	switch path := strings.Trim(r.URL.Path, "/"); path {
+	case "tags":
+		res, err = t.listTags(r)
+	case "tags/tagSeries":
+		var series []string
+		series, err = t.local.AddSeries([]string{r.Form.Get("path")})
+		if err == nil && len(series) == 0 {
+			err = fmt.Errorf("cannot parse path %#v", r.Form.Get("path"))
+		}
+		if err == nil {
+			res = series[0]
+		}
+	case "tags/tagMultiSeries":
+		res, err = t.local.AddSeries(r.Form["path"])
+	case "tags/delSeries":
+		_, err = t.local.DelSeries(r.Form["path"])
+		res = err == nil
+	case "tags/findSeries":
+		res, err = t.findSeries(r)
+	default:
+		if strings.HasPrefix(path, "tags/") && strings.Count(path, "/") == 1 {
+			res, err = t.tagValues(r, path[len("tags/"):])
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad request (%s)", err), http.StatusBadRequest)
+		return
+	}
+	if res == nil {
+		// keep json arrays for empty results
+		res = []string{}
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func formFilter(r *http.Request) (*regexp.Regexp, int, error) {
+	var filter *regexp.Regexp
+	if f := r.Form.Get("filter"); f != "" {
+		var err error
+		if filter, err = regexp.Compile("^(?:" + f + ")"); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var limit int
+	if l := r.Form.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			return nil, 0, err
+		}
+	}
+	return filter, limit, nil
+}
+
+func (t *Tags) listTags(r *http.Request) (interface{}, error) {
+	filter, limit, err := formFilter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	type tagInfo struct {
+		Tag string `json:"tag"`
+	}
+	res := []tagInfo{}
+	for _, tag := range t.local.Tags(filter, limit) {
+		res = append(res, tagInfo{Tag: tag})
+	}
+	return res, nil
+}
+
+func (t *Tags) findSeries(r *http.Request) (interface{}, error) {
+	var limit int
+	if l := r.Form.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			return nil, err
+		}
+	}
+	return t.local.FindSeries(r.Context(), r.Form["expr"], limit)
+}
+
+func (t *Tags) tagValues(r *http.Request, tag string) (interface{}, error) {
+	filter, limit, err := formFilter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	values := t.local.TagValues(tag, filter, limit)
+	if values == nil {
+		values = []TagValueCount{}
+	}
+	return struct {
+		Tag    string          `json:"tag"`
+		Values []TagValueCount `json:"values"`
+	}{tag, values}, nil
+}
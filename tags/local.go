@@ -0,0 +1,403 @@
+package tags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"go.uber.org/zap"
+
+	"github.com/lomik/zapwriter"
+)
+
+// LocalTagDB is used instead of TagDB url to keep tag index in go-carbon
+const LocalTagDB = "local"
+
+// localCompactDeletes is number of deleted series which triggers compaction of index
+const localCompactDeletes = 100000
+
+// LocalDB is tag index stored in leveldb. Keys are:
+//
+//	s<series> - known series
+//	t<tag>\x00<value>\x00<series> - postings of tag value, metric name is tag "name"
+type LocalDB struct {
+	db     *leveldb.DB
+	logger *zap.Logger
+
+	// deleted is number of deleted series since the last compaction
+	deleted    uint64
+	compacting uint32
+
+	stat struct {
+		addCount     uint32
+		addErrors    uint32
+		deleteCount  uint32
+		deleteErrors uint32
+		findCount    uint32
+		compactions  uint32
+	}
+	prometheus localPrometheus
+}
+
+type tagValue struct {
+	tag   string
+	value string
+}
+
+// parseSeries returns tags of normalized series including "name"
+func parseSeries(series string) []tagValue {
+	arr := strings.Split(series, ";")
+	res := make([]tagValue, 0, len(arr))
+	res = append(res, tagValue{tag: "name", value: arr[0]})
+	for _, kv := range arr[1:] {
+		p := strings.IndexByte(kv, '=')
+		res = append(res, tagValue{tag: kv[:p], value: kv[p+1:]})
+	}
+	return res
+}
+
+func seriesKey(series string) []byte {
+	return []byte("s" + series)
+}
+
+func postingKey(tag, value, series string) []byte {
+	return []byte("t" + tag + "\x00" + value + "\x00" + series)
+}
+
+func OpenLocalDB(path string) (*LocalDB, error) {
+	db, err := leveldb.OpenFile(path, &opt.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &LocalDB{
+		db:         db,
+		logger:     zapwriter.Logger("tags").With(zap.String("path", path)),
+		prometheus: newLocalPrometheus(),
+	}, nil
+}
+
+func (l *LocalDB) Close() error {
+	return l.db.Close()
+}
+
+// AddSeries adds series to index and returns normalized names
+func (l *LocalDB) AddSeries(paths []string) ([]string, error) {
+	res := make([]string, 0, len(paths))
+	batch := new(leveldb.Batch)
+	for _, p := range paths {
+		series, err := Normalize(p)
+		if err != nil {
+			atomic.AddUint32(&l.stat.addErrors, 1)
+			l.prometheus.addErrors.Inc()
+			l.logger.Warn("bad series", zap.String("series", p), zap.Error(err))
+			continue
+		}
+		res = append(res, series)
+
+		batch.Put(seriesKey(series), nil)
+		for _, tv := range parseSeries(series) {
+			batch.Put(postingKey(tv.tag, tv.value, series), nil)
+		}
+	}
+
+	if err := l.db.Write(batch, nil); err != nil {
+		atomic.AddUint32(&l.stat.addErrors, 1)
+		l.prometheus.addErrors.Inc()
+		return nil, err
+	}
+	atomic.AddUint32(&l.stat.addCount, uint32(len(res)))
+	l.prometheus.added.Add(float64(len(res)))
+	return res, nil
+}
+
+// DelSeries removes series from index and returns number of removed series
+func (l *LocalDB) DelSeries(paths []string) (int, error) {
+	batch := new(leveldb.Batch)
+	deleted := 0
+	for _, p := range paths {
+		series, err := Normalize(p)
+		if err != nil {
+			atomic.AddUint32(&l.stat.deleteErrors, 1)
+			l.prometheus.deleteErrs.Inc()
+			continue
+		}
+		ok, err := l.db.Has(seriesKey(series), nil)
+		if err != nil {
+			atomic.AddUint32(&l.stat.deleteErrors, 1)
+			l.prometheus.deleteErrs.Inc()
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+
+		deleted++
+		batch.Delete(seriesKey(series))
+		for _, tv := range parseSeries(series) {
+			batch.Delete(postingKey(tv.tag, tv.value, series))
+		}
+	}
+
+	if err := l.db.Write(batch, nil); err != nil {
+		atomic.AddUint32(&l.stat.deleteErrors, uint32(deleted))
+		l.prometheus.deleteErrs.Add(float64(deleted))
+		return 0, err
+	}
+	atomic.AddUint32(&l.stat.deleteCount, uint32(deleted))
+	l.prometheus.deleted.Add(float64(deleted))
+
+	// deleted keys are kept by leveldb as tombstones until compaction
+	if atomic.AddUint64(&l.deleted, uint64(deleted)) >= localCompactDeletes && atomic.CompareAndSwapUint32(&l.compacting, 0, 1) {
+		atomic.StoreUint64(&l.deleted, 0)
+		go func() {
+			defer atomic.StoreUint32(&l.compacting, 0)
+			l.Compact()
+		}()
+	}
+
+	return deleted, nil
+}
+
+// Compact compacts whole index
+func (l *LocalDB) Compact() error {
+	atomic.AddUint32(&l.stat.compactions, 1)
+	l.prometheus.compactions.Inc()
+	err := l.db.CompactRange(util.Range{})
+	if err != nil {
+		l.logger.Error("compaction failed", zap.Error(err))
+	}
+	return err
+}
+
+type tagExpr struct {
+	tag   string
+	value string
+	not   bool
+	re    *regexp.Regexp
+}
+
+// parseTagExpr parses graphite tag expressions: tag=value, tag!=value, tag=~regexp
+// and tag!=~regexp
+func parseTagExpr(s string) (*tagExpr, error) {
+	p := strings.IndexByte(s, '=')
+	if p < 1 {
+		return nil, fmt.Errorf("invalid tag expression %#v", s)
+	}
+
+	e := &tagExpr{tag: s[:p], value: s[p+1:]}
+	if strings.HasSuffix(e.tag, "!") {
+		e.tag = e.tag[:len(e.tag)-1]
+		e.not = true
+	}
+	if strings.HasPrefix(e.value, "~") {
+		e.value = e.value[1:]
+		re, err := regexp.Compile("^(?:" + e.value + ")")
+		if err != nil {
+			return nil, err
+		}
+		e.re = re
+	}
+	if e.tag == "" {
+		return nil, fmt.Errorf("invalid tag expression %#v", s)
+	}
+	return e, nil
+}
+
+// match checks value of tag, empty value means tag is not set
+func (e *tagExpr) match(value string) bool {
+	var res bool
+	if e.re != nil {
+		res = e.re.MatchString(value)
+	} else {
+		res = value == e.value
+	}
+	return res != e.not
+}
+
+func (e *tagExpr) exact() bool {
+	return e.re == nil && !e.not
+}
+
+// selective returns true if expression doesn't match series without the tag, so
+// postings of tag could be used to find series
+func (e *tagExpr) selective() bool {
+	return !e.match("")
+}
+
+var errNoSelectiveExpr = errors.New("at least one tag expression must match non-empty value")
+
+// localFindCheckEvery is number of scanned postings between checks of context
+const localFindCheckEvery = 1000
+
+// FindSeries returns sorted series matched by all expressions. Scan stops with error
+// if ctx is done or more than limit series are matched, 0 - unlimited
+func (l *LocalDB) FindSeries(ctx context.Context, exprs []string, limit int) ([]string, error) {
+	atomic.AddUint32(&l.stat.findCount, 1)
+	l.prometheus.finds.Inc()
+
+	parsed := make([]*tagExpr, 0, len(exprs))
+	var first *tagExpr
+	firstCount := 0
+	for _, s := range exprs {
+		e, err := parseTagExpr(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, e)
+		if !e.selective() {
+			continue
+		}
+		// exact match with the least postings is the cheapest way to select candidates
+		switch {
+		case e.exact() && (first == nil || !first.exact()):
+			first, firstCount = e, l.countPostings(e.tag, e.value, 0)
+		case e.exact() && firstCount > 0:
+			if n := l.countPostings(e.tag, e.value, firstCount); n < firstCount {
+				first, firstCount = e, n
+			}
+		case first == nil:
+			first = e
+		}
+	}
+	if first == nil {
+		return nil, errNoSelectiveExpr
+	}
+
+	res := make([]string, 0)
+	scanned := 0
+	check := func(series string) error {
+		if scanned++; scanned%localFindCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		tags := make(map[string]string)
+		for _, tv := range parseSeries(series) {
+			tags[tv.tag] = tv.value
+		}
+		for _, e := range parsed {
+			if !e.match(tags[e.tag]) {
+				return nil
+			}
+		}
+		if limit > 0 && len(res) >= limit {
+			return fmt.Errorf("more than %d series are matched", limit)
+		}
+		res = append(res, series)
+		return nil
+	}
+
+	// series has single value of tag, so postings of different values don't overlap
+	if first.exact() {
+		if err := l.scanPostings(first.tag, first.value, check); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, v := range l.TagValues(first.tag, nil, 0) {
+			if !first.match(v.Value) {
+				continue
+			}
+			if err := l.scanPostings(first.tag, v.Value, check); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+// scanPostings calls cb for every series with tag value until cb returns error
+func (l *LocalDB) scanPostings(tag, value string, cb func(series string) error) error {
+	prefix := postingKey(tag, value, "")
+	iter := l.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := cb(string(iter.Key()[len(prefix):])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countPostings returns number of series with tag value, counting stops at max if
+// it's set
+func (l *LocalDB) countPostings(tag, value string, max int) int {
+	iter := l.db.NewIterator(util.BytesPrefix(postingKey(tag, value, "")), nil)
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		if n++; max > 0 && n >= max {
+			break
+		}
+	}
+	return n
+}
+
+// Tags returns sorted tags matched by filter. filter and limit are optional
+func (l *LocalDB) Tags(filter *regexp.Regexp, limit int) []string {
+	var res []string
+	iter := l.db.NewIterator(util.BytesPrefix([]byte("t")), nil)
+	defer iter.Release()
+
+	for ok := iter.First(); ok; {
+		key := iter.Key()
+		p := strings.IndexByte(string(key), 0)
+		if p < 0 {
+			ok = iter.Next()
+			continue
+		}
+		tag := string(key[1:p])
+		if filter == nil || filter.MatchString(tag) {
+			res = append(res, tag)
+			if limit > 0 && len(res) >= limit {
+				break
+			}
+		}
+		// skip postings of the tag
+		ok = iter.Seek([]byte("t" + tag + "\x01"))
+	}
+	return res
+}
+
+type TagValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// TagValues returns sorted values of tag matched by filter with number of series
+func (l *LocalDB) TagValues(tag string, filter *regexp.Regexp, limit int) []TagValueCount {
+	var res []TagValueCount
+	prefix := []byte("t" + tag + "\x00")
+	iter := l.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()[len(prefix):]
+		p := strings.IndexByte(string(key), 0)
+		if p < 0 {
+			continue
+		}
+		value := string(key[:p])
+		if n := len(res); n > 0 && res[n-1].Value == value {
+			res[n-1].Count++
+			continue
+		}
+		if filter != nil && !filter.MatchString(value) {
+			continue
+		}
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+		res = append(res, TagValueCount{Value: value, Count: 1})
+	}
+	return res
+}
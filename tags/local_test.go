@@ -0,0 +1,120 @@
+package tags
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+func TestLocalDB(t *testing.T) {
+	qa.Root(t, func(dir string) {
+		assert := assert.New(t)
+
+		db, err := OpenLocalDB(filepath.Join(dir, "index"))
+		assert.NoError(err)
+		defer db.Close()
+
+		series, err := db.AddSeries([]string{
+			"cpu;host=a;dc=x",
+			"cpu;host=b;dc=x",
+			"cpu;host=c;dc=y;env=dev",
+			"mem;host=a;dc=x",
+			"bad;",
+		})
+		assert.NoError(err)
+		assert.Equal([]string{"cpu;dc=x;host=a", "cpu;dc=x;host=b", "cpu;dc=y;env=dev;host=c", "mem;dc=x;host=a"}, series)
+
+		find := func(exprs ...string) []string {
+			res, err := db.FindSeries(context.Background(), exprs, 0)
+			assert.NoError(err)
+			return res
+		}
+
+		assert.Equal([]string{"cpu;dc=x;host=a", "cpu;dc=x;host=b", "cpu;dc=y;env=dev;host=c"}, find("name=cpu"))
+		assert.Equal([]string{"cpu;dc=x;host=a", "mem;dc=x;host=a"}, find("host=a"))
+		assert.Equal([]string{"cpu;dc=x;host=b"}, find("name=cpu", "dc=x", "host!=a"))
+		assert.Equal([]string{"cpu;dc=x;host=a", "cpu;dc=x;host=b"}, find("name=~c", "env="))
+		assert.Equal([]string{"cpu;dc=y;env=dev;host=c"}, find("env!="))
+		assert.Equal([]string{"cpu;dc=x;host=b", "cpu;dc=y;env=dev;host=c"}, find("host!=~a", "dc=~x|y"))
+
+		_, err = db.FindSeries(context.Background(), []string{"env="}, 0)
+		assert.Equal(errNoSelectiveExpr, err)
+		_, err = db.FindSeries(context.Background(), []string{"dc=x"}, 2)
+		assert.Error(err)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for i := 0; i < localFindCheckEvery; i++ {
+			_, err = db.AddSeries([]string{fmt.Sprintf("disk;host=h%d;dc=x", i)})
+			assert.NoError(err)
+		}
+		_, err = db.FindSeries(ctx, []string{"dc=x"}, 0)
+		assert.Equal(context.Canceled, err)
+		// the least selective exact expression isn't used to scan
+		assert.Equal(2, db.countPostings("dc", "x", 2))
+		assert.Equal([]string{"mem;dc=x;host=a"}, find("dc=x", "name=mem"))
+
+		assert.Equal([]string{"dc", "env", "host", "name"}, db.Tags(nil, 0))
+		assert.Equal([]string{"host"}, db.Tags(regexp.MustCompile("^h"), 0))
+		assert.Equal([]TagValueCount{{"x", 3 + localFindCheckEvery}, {"y", 1}}, db.TagValues("dc", nil, 0))
+		assert.Equal([]TagValueCount{{"b", 1}}, db.TagValues("host", regexp.MustCompile("^b"), 1))
+
+		deleted, err := db.DelSeries([]string{"cpu;host=a;dc=x", "cpu;host=unknown"})
+		assert.NoError(err)
+		assert.Equal(1, deleted)
+		assert.Equal([]string{"mem;dc=x;host=a"}, find("host=a"))
+		assert.Equal([]TagValueCount{{"x", 2 + localFindCheckEvery}, {"y", 1}}, db.TagValues("dc", nil, 0))
+		assert.NoError(db.Compact())
+	})
+}
+
+func TestLocalHTTP(t *testing.T) {
+	qa.Root(t, func(dir string) {
+		assert := assert.New(t)
+
+		tags := New(&Options{LocalPath: dir, TagDB: LocalTagDB})
+		defer tags.Stop()
+
+		request := func(method, path string, form url.Values) string {
+			rr := httptest.NewRecorder()
+			var req *http.Request
+			if method == "POST" {
+				req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+			}
+			tags.ServeHTTP(rr, req)
+			assert.Equal(http.StatusOK, rr.Code, path)
+			return rr.Body.String()
+		}
+
+		assert.Equal(`["cpu;dc=x;host=a","cpu;host=b"]`, request("POST", "/tags/tagMultiSeries", url.Values{"path": {"cpu;host=a;dc=x", "cpu;host=b"}}))
+		assert.Equal(`"mem;host=a"`, request("POST", "/tags/tagSeries", url.Values{"path": {"mem;host=a"}}))
+		assert.Equal(`["cpu;dc=x;host=a","cpu;host=b"]`, request("GET", "/tags/findSeries", url.Values{"expr": {"name=cpu"}}))
+		assert.Equal(`[{"tag":"dc"},{"tag":"host"}]`, request("GET", "/tags", url.Values{"filter": {"dc|host"}}))
+		assert.Equal(`{"tag":"host","values":[{"value":"a","count":2},{"value":"b","count":1}]}`, request("GET", "/tags/host", nil))
+		assert.Equal(`true`, request("POST", "/tags/delSeries", url.Values{"path": {"cpu;host=b"}}))
+		assert.Equal(`[]`, request("GET", "/tags/findSeries", url.Values{"expr": {"host=b"}}))
+
+		// series are added to index by queue
+		tags.Add("disk;host=a", true)
+		for i := 0; i < 100; i++ {
+			if request("GET", "/tags/findSeries", url.Values{"expr": {"name=disk"}}) == `["disk;host=a"]` {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("series is not added to local index by queue")
+	})
+}
@@ -0,0 +1,134 @@
+package tags
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queuePrometheus counts queue operations
+type queuePrometheus struct {
+	puts         prometheus.Counter
+	putErrors    prometheus.Counter
+	deletes      prometheus.Counter
+	deleteErrors prometheus.Counter
+}
+
+func newQueuePrometheus() queuePrometheus {
+	return queuePrometheus{
+		puts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tags_queue_puts_total",
+			Help: "Number of series written to TagDB queue",
+		}),
+		putErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tags_queue_put_errors_total",
+			Help: "Number of failed writes to TagDB queue",
+		}),
+		deletes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tags_queue_deletes_total",
+			Help: "Number of records removed from TagDB queue",
+		}),
+		deleteErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tags_queue_delete_errors_total",
+			Help: "Number of failed removals from TagDB queue",
+		}),
+	}
+}
+
+// localPrometheus counts operations of local tag index
+type localPrometheus struct {
+	series      *prometheus.CounterVec
+	added       prometheus.Counter
+	addErrors   prometheus.Counter
+	deleted     prometheus.Counter
+	deleteErrs  prometheus.Counter
+	finds       prometheus.Counter
+	compactions prometheus.Counter
+}
+
+func newLocalPrometheus() localPrometheus {
+	series := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tags_local_series_total",
+		Help: "Series added to and deleted from local tag index, partitioned by operation and result",
+	}, []string{"op", "result"})
+
+	return localPrometheus{
+		series:     series,
+		added:      series.WithLabelValues("add", "success"),
+		addErrors:  series.WithLabelValues("add", "error"),
+		deleted:    series.WithLabelValues("delete", "success"),
+		deleteErrs: series.WithLabelValues("delete", "error"),
+		finds: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tags_local_find_requests_total",
+			Help: "Number of findSeries requests of local tag index",
+		}),
+		compactions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tags_local_compactions_total",
+			Help: "Number of local tag index compactions",
+		}),
+	}
+}
+
+// InitPrometheus registers metrics of queue, endpoints and local index. Tags are
+// re-created on config reload, so metrics are unregistered by Stop
+func (t *Tags) InitPrometheus(reg prometheus.Registerer) {
+	if t.q == nil {
+		return
+	}
+
+	sent := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tags_sent_series_total",
+		Help: "Series sent to TagDB, partitioned by endpoint, operation and result",
+	}, []string{"endpoint", "op", "result"})
+	for _, ep := range t.endpoints {
+		ep.prometheus.sendFail = sent.WithLabelValues(ep.name, "add", "fail")
+		ep.prometheus.sendSuccess = sent.WithLabelValues(ep.name, "add", "success")
+		ep.prometheus.sendDeleteFail = sent.WithLabelValues(ep.name, "delete", "fail")
+		ep.prometheus.sendDeleteSuccess = sent.WithLabelValues(ep.name, "delete", "success")
+	}
+
+	lag := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tags_endpoint_queue_lag_seconds",
+		Help: "Age of the oldest series which is not sent to TagDB endpoint",
+	}, []string{"endpoint"})
+
+	collectors := []prometheus.Collector{
+		sent,
+		t.q.prometheus.puts, t.q.prometheus.putErrors, t.q.prometheus.deletes, t.q.prometheus.deleteErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tags_queue_lag_seconds",
+			Help: "Age of the oldest series which is not sent to all TagDB endpoints",
+		}, func() float64 { return t.q.Lag().Seconds() }),
+		&lagCollector{GaugeVec: lag, t: t},
+	}
+	if t.local != nil {
+		collectors = append(collectors, t.local.prometheus.series, t.local.prometheus.finds, t.local.prometheus.compactions)
+	}
+
+	for _, m := range collectors {
+		reg.MustRegister(m)
+	}
+	t.promRegisterer = reg
+	t.promCollectors = collectors
+}
+
+// lagCollector updates lag of endpoints on scrape
+type lagCollector struct {
+	*prometheus.GaugeVec
+	t *Tags
+}
+
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ep := range c.t.endpoints {
+		c.WithLabelValues(ep.name).Set(c.t.q.ReaderLag(ep.reader).Seconds())
+	}
+	c.GaugeVec.Collect(ch)
+}
+
+func (t *Tags) unregisterPrometheus() {
+	if t.promRegisterer == nil {
+		return
+	}
+	for _, m := range t.promCollectors {
+		t.promRegisterer.Unregister(m)
+	}
+	t.promRegisterer = nil
+}
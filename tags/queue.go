@@ -1,38 +1,79 @@
 package tags
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"go.uber.org/zap"
 
 	"github.com/lomik/go-carbon/helper"
 	"github.com/lomik/zapwriter"
 )
 
+// values of queue records
+var (
+	addValue    = []byte("{}")
+	deleteValue = []byte(`{"delete":true}`)
+)
+
+// cursorPrefix is prefix of keys with positions of queue readers. Keys of records
+// start with sequence number, so cursors are sorted after all records
+var cursorPrefix = []byte("\xffcursor:")
+
+// QueueReader sends records of queue in order of Add and Delete calls. Every reader
+// has own cursor, so slow reader doesn't block others. Records are removed from
+// queue when all readers have sent them.
+type QueueReader struct {
+	Name       string
+	Send       func([]string) error
+	SendDelete func([]string) error
+	// Filter selects series sent by reader. nil - all series
+	Filter func(series string) bool
+}
+
+type queueReader struct {
+	QueueReader
+	changed chan struct{}
+
+	sync.Mutex
+	cursor []byte // key of the last sent record
+}
+
 type Queue struct {
 	helper.Stoppable
 	db        *leveldb.DB
 	logger    *zap.Logger
-	changed   chan struct{}
-	send      func([]string) error
+	readers   []*queueReader
 	sendChunk int
+	trimMutex sync.Mutex
+
+	// seq is sequence number of the last record. It follows time in nanoseconds but
+	// never goes back, records are written in order of keys under putMutex, so reader
+	// can't move cursor over record which is not written yet
+	putMutex sync.Mutex
+	seq      uint64
 
 	stat struct {
-		putErrors    uint32
-		putCount     uint32
-		deleteErrors uint32
-		deleteCount  uint32
-		sendFail     uint32
-		sendSuccess  uint32
+		putErrors         uint32
+		putCount          uint32
+		deleteErrors      uint32
+		deleteCount       uint32
+		sendFail          uint32
+		sendSuccess       uint32
+		sendDeleteFail    uint32
+		sendDeleteSuccess uint32
 	}
+	prometheus queuePrometheus
 }
 
 // exists returns whether the given file or directory exists or not
@@ -47,9 +88,21 @@ func exists(path string) bool {
 	return true
 }
 
-func NewQueue(rootPath string, send func([]string) error, sendChunk int) (*Queue, error) {
-	if send == nil {
-		return nil, fmt.Errorf("send callback not set")
+// NewQueue opens queue of tagged series. send is called with added series and
+// sendDelete with removed ones, in order of Add and Delete calls.
+func NewQueue(rootPath string, send func([]string) error, sendDelete func([]string) error, sendChunk int) (*Queue, error) {
+	return NewQueueReaders(rootPath, []QueueReader{{Name: "default", Send: send, SendDelete: sendDelete}}, sendChunk)
+}
+
+// NewQueueReaders opens queue of tagged series sent by several readers
+func NewQueueReaders(rootPath string, readers []QueueReader, sendChunk int) (*Queue, error) {
+	if len(readers) == 0 {
+		return nil, fmt.Errorf("queue readers not set")
+	}
+	for _, r := range readers {
+		if r.Send == nil || r.SendDelete == nil {
+			return nil, fmt.Errorf("send callback not set")
+		}
 	}
 
 	o := &opt.Options{}
@@ -97,54 +150,135 @@ func NewQueue(rootPath string, send func([]string) error, sendChunk int) (*Queue
 	}
 
 	q := &Queue{
-		db:        db,
-		logger:    logger,
-		changed:   make(chan struct{}, 1),
-		send:      send,
-		sendChunk: sendChunk,
+		db:         db,
+		logger:     logger,
+		sendChunk:  sendChunk,
+		prometheus: newQueuePrometheus(),
+	}
+
+	q.seq = lastSeq(db)
+
+	for _, r := range readers {
+		cursor, err := db.Get(cursorKey(r.Name), nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			logger.Error("can't read queue cursor", zap.String("reader", r.Name), zap.Error(err))
+		}
+		if len(cursor) >= 8 && binary.BigEndian.Uint64(cursor[:8]) > q.seq {
+			q.seq = binary.BigEndian.Uint64(cursor[:8])
+		}
+		q.readers = append(q.readers, &queueReader{
+			QueueReader: r,
+			changed:     make(chan struct{}, 1),
+			cursor:      cursor,
+		})
 	}
 
 	q.Start()
 
-	q.Go(q.sendWorker)
+	for _, r := range q.readers {
+		r := r
+		q.Go(func(exit chan bool) {
+			q.sendWorker(r, exit)
+		})
+	}
 
 	return q, nil
 }
 
+func cursorKey(reader string) []byte {
+	return append(append([]byte{}, cursorPrefix...), reader...)
+}
+
+// lastSeq returns sequence number of the last record in queue
+func lastSeq(db *leveldb.DB) uint64 {
+	iter := db.NewIterator(records(nil), nil)
+	defer iter.Release()
+	if iter.Last() && len(iter.Key()) >= 8 {
+		return binary.BigEndian.Uint64(iter.Key()[:8])
+	}
+	return 0
+}
+
+// records returns range of records after key. nil - all records
+func records(after []byte) *util.Range {
+	r := &util.Range{Limit: cursorPrefix}
+	if after != nil {
+		r.Start = append(append([]byte{}, after...), 0)
+	}
+	return r
+}
+
 func (q *Queue) Stop() {
 	q.StopFunc(func() {})
 	q.db.Close()
 }
 
 func (q *Queue) Add(metric string) {
+	q.put(metric, addValue)
+}
+
+// Delete queues removal of series from TagDB
+func (q *Queue) Delete(metric string) {
+	q.put(metric, deleteValue)
+}
+
+func (q *Queue) put(metric string, value []byte) {
 	// skip not tagged data
 	if strings.IndexByte(metric, ';') < 0 {
 		return
 	}
 
 	key := make([]byte, len(metric)+8)
-
-	binary.BigEndian.PutUint64(key[:8], uint64(time.Now().UnixNano()))
 	copy(key[8:], metric)
 
-	err := q.db.Put(key, []byte("{}"), nil)
+	q.putMutex.Lock()
+	q.seq++
+	if now := uint64(time.Now().UnixNano()); now > q.seq {
+		q.seq = now
+	}
+	binary.BigEndian.PutUint64(key[:8], q.seq)
+	err := q.db.Put(key, value, nil)
+	q.putMutex.Unlock()
+
 	atomic.AddUint32(&q.stat.putCount, 1)
+	q.prometheus.puts.Inc()
 
 	if err != nil {
 		atomic.AddUint32(&q.stat.putErrors, 1)
+		q.prometheus.putErrors.Inc()
 		q.logger.Error("write to queue database failed", zap.Error(err))
 	}
 
-	select {
-	case q.changed <- struct{}{}:
-		// pass
-	default:
-		// pass
+	for _, r := range q.readers {
+		select {
+		case r.changed <- struct{}{}:
+			// pass
+		default:
+			// pass
+		}
 	}
 }
 
+// Lag returns age of the oldest record which is not sent by all readers
 func (q *Queue) Lag() time.Duration {
-	iter := q.db.NewIterator(nil, nil)
+	return q.lag(nil)
+}
+
+// ReaderLag returns age of the oldest record which is not sent by reader
+func (q *Queue) ReaderLag(name string) time.Duration {
+	for _, r := range q.readers {
+		if r.Name == name {
+			r.Lock()
+			cursor := r.cursor
+			r.Unlock()
+			return q.lag(cursor)
+		}
+	}
+	return 0
+}
+
+func (q *Queue) lag(after []byte) time.Duration {
+	iter := q.db.NewIterator(records(after), nil)
 
 	var res time.Duration
 
@@ -153,7 +287,10 @@ func (q *Queue) Lag() time.Duration {
 		if len(key) >= 8 {
 			t := int64(binary.BigEndian.Uint64(key[:8]))
 			tm := time.Unix(t/1000000000, t%1000000000)
-			res = time.Since(tm)
+			// sequence is ahead of time after clock step back
+			if res = time.Since(tm); res < 0 {
+				res = 0
+			}
 		}
 	}
 
@@ -162,37 +299,39 @@ func (q *Queue) Lag() time.Duration {
 	return res
 }
 
-func (q *Queue) sendAll(exit chan bool) {
-	iter := q.db.NewIterator(nil, nil)
+func (q *Queue) sendAll(r *queueReader, exit chan bool) {
+	r.Lock()
+	cursor := r.cursor
+	r.Unlock()
+
+	iter := q.db.NewIterator(records(cursor), nil)
 	defer iter.Release()
 
-	keys := make([][]byte, q.sendChunk)
-	series := make([]string, q.sendChunk)
-	used := 0
+	series := make([]string, 0, q.sendChunk)
+	// key of the last read record, including skipped by filter
+	var last []byte
+	// deletes and additions are sent in separate chunks
+	deleting := false
 
 	flush := func() error {
-		if used <= 0 {
-			return nil
-		}
-
-		for i := 0; i < used; i++ {
-			series[i] = string(keys[i][8:])
-		}
-
-		err := q.send(series[:used])
+		if len(series) > 0 {
+			send, fail, success := r.Send, &q.stat.sendFail, &q.stat.sendSuccess
+			if deleting {
+				send, fail, success = r.SendDelete, &q.stat.sendDeleteFail, &q.stat.sendDeleteSuccess
+			}
 
-		if err != nil {
-			atomic.AddUint32(&q.stat.sendFail, uint32(used))
-			used = 0
-			return err
+			if err := send(series); err != nil {
+				atomic.AddUint32(fail, uint32(len(series)))
+				return err
+			}
+			atomic.AddUint32(success, uint32(len(series)))
+			series = series[:0]
 		}
 
-		atomic.AddUint32(&q.stat.sendSuccess, uint32(used))
-
-		for i := 0; i < used; i++ {
-			q.delete(keys[i])
+		if last != nil {
+			q.setCursor(r, last)
+			last = nil
 		}
-		used = 0
 		return nil
 	}
 
@@ -206,21 +345,28 @@ func (q *Queue) sendAll(exit chan bool) {
 		// Remember that the contents of the returned slice should not be modified, and
 		// only valid until the next call to Next.
 		key := iter.Key()
-		// value := iter.Value()
 		if len(key) < 9 {
-			q.delete(key)
+			last = append(last[:0], key...)
 			continue
 		}
 
-		keys[used] = make([]byte, len(key))
-		copy(keys[used], key)
-		used++
+		if isDelete := bytes.Equal(iter.Value(), deleteValue); isDelete != deleting {
+			if flush() != nil {
+				// retry later, following records could change the same series
+				return
+			}
+			deleting = isDelete
+		}
+
+		if r.Filter == nil || r.Filter(string(key[8:])) {
+			series = append(series, string(key[8:]))
+		}
+		last = append(last[:0], key...)
 
-		if used >= q.sendChunk {
-			err := flush()
-			if err != nil {
+		if len(series) >= q.sendChunk {
+			if flush() != nil {
 				time.Sleep(100 * time.Millisecond)
-				continue
+				return
 			}
 		}
 	}
@@ -228,7 +374,46 @@ func (q *Queue) sendAll(exit chan bool) {
 	flush()
 }
 
-func (q *Queue) sendWorker(exit chan bool) {
+// setCursor saves position of reader and removes records sent by all readers
+func (q *Queue) setCursor(r *queueReader, key []byte) {
+	cursor := append([]byte{}, key...)
+	if err := q.db.Put(cursorKey(r.Name), cursor, nil); err != nil {
+		q.logger.Error("write of queue cursor failed", zap.String("reader", r.Name), zap.Error(err))
+	}
+
+	r.Lock()
+	r.cursor = cursor
+	r.Unlock()
+
+	q.trim()
+}
+
+func (q *Queue) trim() {
+	q.trimMutex.Lock()
+	defer q.trimMutex.Unlock()
+
+	var min []byte
+	for _, r := range q.readers {
+		r.Lock()
+		cursor := r.cursor
+		r.Unlock()
+
+		if cursor == nil {
+			return
+		}
+		if min == nil || bytes.Compare(cursor, min) < 0 {
+			min = cursor
+		}
+	}
+
+	iter := q.db.NewIterator(&util.Range{Limit: append(append([]byte{}, min...), 0)}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		q.delete(iter.Key())
+	}
+}
+
+func (q *Queue) sendWorker(r *queueReader, exit chan bool) {
 	t := time.NewTicker(time.Second)
 	defer t.Stop()
 
@@ -236,12 +421,12 @@ func (q *Queue) sendWorker(exit chan bool) {
 		select {
 		case <-exit:
 			return
-		case <-q.changed:
+		case <-r.changed:
 			// pass
 		case <-t.C:
 			//pass
 		}
-		q.sendAll(exit)
+		q.sendAll(r, exit)
 	}
 }
 
@@ -249,8 +434,10 @@ func (q *Queue) sendWorker(exit chan bool) {
 func (q *Queue) delete(key []byte) {
 	err := q.db.Delete([]byte(key), nil)
 	atomic.AddUint32(&q.stat.deleteCount, 1)
+	q.prometheus.deletes.Inc()
 	if err != nil {
 		atomic.AddUint32(&q.stat.deleteErrors, 1)
+		q.prometheus.deleteErrors.Inc()
 		q.logger.Error("delete from queue database failed", zap.Error(err))
 	}
 }
@@ -1,10 +1,13 @@
 package tags
 
 import (
+	"encoding/binary"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
 
 	"github.com/lomik/go-carbon/helper/qa"
 )
@@ -20,6 +23,8 @@ func TestQueue(t *testing.T) {
 				buf <- series[i]
 			}
 			return nil
+		}, func(series []string) error {
+			return nil
 		}, 1)
 		assert.NoError(err)
 		assert.NotNil(q)
@@ -43,6 +48,8 @@ func TestQueueLag(t *testing.T) {
 		q, err := NewQueue(dir, func(series []string) error {
 			<-exit
 			return nil
+		}, func(series []string) error {
+			return nil
 		}, 1)
 		assert.NoError(err)
 		assert.NotNil(q)
@@ -55,3 +62,117 @@ func TestQueueLag(t *testing.T) {
 		close(exit)
 	})
 }
+
+func TestQueueDelete(t *testing.T) {
+	qa.Root(t, func(dir string) {
+		assert := assert.New(t)
+
+		buf := make(chan string, 100)
+
+		q, err := NewQueue(dir, func(series []string) error {
+			for i := 0; i < len(series); i++ {
+				buf <- "add " + series[i]
+			}
+			return nil
+		}, func(series []string) error {
+			for i := 0; i < len(series); i++ {
+				buf <- "delete " + series[i]
+			}
+			return nil
+		}, 10)
+		assert.NoError(err)
+		assert.NotNil(q)
+
+		defer q.Stop()
+
+		q.Add("hello.world;key=value")
+		q.Delete("hello.world;key=value")
+		q.Add("hello.world;key=value")
+
+		assert.Equal("add hello.world;key=value", <-buf)
+		assert.Equal("delete hello.world;key=value", <-buf)
+		assert.Equal("add hello.world;key=value", <-buf)
+	})
+}
+
+func TestQueueReaders(t *testing.T) {
+	qa.Root(t, func(dir string) {
+		assert := assert.New(t)
+
+		fast := make(chan string, 100)
+		slow := make(chan bool)
+		nop := func(series []string) error { return nil }
+
+		q, err := NewQueueReaders(dir, []QueueReader{
+			{Name: "fast", SendDelete: nop, Send: func(series []string) error {
+				for i := 0; i < len(series); i++ {
+					fast <- series[i]
+				}
+				return nil
+			}},
+			{Name: "slow", SendDelete: nop, Send: func(series []string) error {
+				<-slow
+				return nil
+			}},
+		}, 1)
+		assert.NoError(err)
+		defer q.Stop()
+
+		q.Add("hello.world;key=value")
+		q.Add("hello.world;key=value2")
+
+		// slow reader doesn't block others
+		assert.Equal("hello.world;key=value", <-fast)
+		assert.Equal("hello.world;key=value2", <-fast)
+		assert.True(q.ReaderLag("fast") == 0)
+		assert.True(q.ReaderLag("slow") > 0)
+
+		// records are kept until all readers have sent them
+		assert.True(q.Lag() > 0)
+		close(slow)
+		for i := 0; i < 100 && q.Lag() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.True(q.Lag() == 0)
+	})
+}
+
+func TestQueueClockStepBack(t *testing.T) {
+	qa.Root(t, func(dir string) {
+		assert := assert.New(t)
+
+		// cursor saved before clock went back by an hour
+		db, err := leveldb.OpenFile(filepath.Join(dir, "queue"), nil)
+		if !assert.NoError(err) {
+			return
+		}
+		cursor := make([]byte, 8)
+		binary.BigEndian.PutUint64(cursor, uint64(time.Now().Add(time.Hour).UnixNano()))
+		assert.NoError(db.Put(cursorKey("default"), cursor, nil))
+		db.Close()
+
+		buf := make(chan string, 100)
+		q, err := NewQueue(dir, func(series []string) error {
+			for i := 0; i < len(series); i++ {
+				buf <- series[i]
+			}
+			return nil
+		}, func(series []string) error {
+			return nil
+		}, 1)
+		if !assert.NoError(err) {
+			return
+		}
+		defer q.Stop()
+
+		q.Add("hello.world;key=value")
+
+		select {
+		case s := <-buf:
+			assert.Equal("hello.world;key=value", s)
+		case <-time.After(5 * time.Second):
+			t.Fatal("series written after clock step back is not sent")
+		}
+		assert.True(q.Lag() == 0)
+	})
+}
@@ -2,81 +2,314 @@ package tags
 
 import (
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/lomik/go-carbon/helper"
 	"github.com/lomik/zapwriter"
 )
 
+// Modes of TagDB endpoints
+const (
+	// EndpointBroadcast endpoint receives all series
+	EndpointBroadcast = "broadcast"
+	// EndpointFailover endpoints receive series in turn: the next one is used when the
+	// previous fails
+	EndpointFailover = "failover"
+	// EndpointShard endpoints receive parts of series selected by hash of series
+	EndpointShard = "shard"
+)
+
+// Endpoint is TagDB url or LocalTagDB with sending mode
+type Endpoint struct {
+	URL  string
+	Mode string // EndpointBroadcast if empty
+}
+
 type Options struct {
 	LocalPath           string
-	TagDB               string
+	TagDB               string     // url of TagDB or LocalTagDB. Used if TagDBEndpoints are empty
+	TagDBEndpoints      []Endpoint // several TagDB
 	TagDBTimeout        time.Duration
 	TagDBChunkSize      int
 	TagDBUpdateInterval uint64
 }
 
+// Endpoints returns configured TagDB endpoints
+func (o *Options) Endpoints() []Endpoint {
+	if len(o.TagDBEndpoints) > 0 {
+		return o.TagDBEndpoints
+	}
+	return []Endpoint{{URL: o.TagDB, Mode: EndpointBroadcast}}
+}
+
+// LocalEnabled returns true if series are sent to local tag index
+func (o *Options) LocalEnabled() bool {
+	for _, e := range o.Endpoints() {
+		if e.URL == LocalTagDB {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint is TagDB which receives series from queue
+type endpoint struct {
+	name       string
+	mode       string
+	reader     string // name of queue reader
+	send       func([]string) error
+	sendDelete func([]string) error
+
+	stat struct {
+		sendFail          uint32
+		sendSuccess       uint32
+		sendDeleteFail    uint32
+		sendDeleteSuccess uint32
+	}
+
+	// set by InitPrometheus
+	prometheus struct {
+		sendFail          prometheus.Counter
+		sendSuccess       prometheus.Counter
+		sendDeleteFail    prometheus.Counter
+		sendDeleteSuccess prometheus.Counter
+	}
+}
+
 type Tags struct {
 	q             *Queue
 	qErr          error // queue initialization error
+	local         *LocalDB
+	endpoints     []*endpoint
 	logger        *zap.Logger
 	options       *Options
 	updateCounter uint64
+
+	promRegisterer prometheus.Registerer
+	promCollectors []prometheus.Collector
 }
 
 func New(options *Options) *Tags {
-	var send func([]string) error
-
 	t := &Tags{
 		logger:  zapwriter.Logger("tags"),
 		options: options,
 	}
 
-	u, urlErr := url.Parse(options.TagDB)
-	if urlErr != nil {
-		send = func([]string) error {
+	names := make(map[string]bool)
+	for _, e := range options.Endpoints() {
+		ep, err := t.newEndpoint(e)
+		if err != nil {
+			t.qErr = err
+			return t
+		}
+		// names are used in stats
+		for i := 2; names[ep.name]; i++ {
+			ep.name = fmt.Sprintf("%s_%d", endpointName(e.URL), i)
+		}
+		names[ep.name] = true
+		t.endpoints = append(t.endpoints, ep)
+	}
+
+	t.q, t.qErr = NewQueueReaders(options.LocalPath, t.queueReaders(), options.TagDBChunkSize)
+	if options.TagDBUpdateInterval < 1 {
+		options.TagDBUpdateInterval = 1
+	}
+
+	return t
+}
+
+var endpointNameReplacer = strings.NewReplacer(".", "_", ":", "_", "/", "_")
+
+// endpointName returns name of endpoint used in stats
+func endpointName(tagDB string) string {
+	u, err := url.Parse(tagDB)
+	if err != nil || u.Host == "" {
+		return endpointNameReplacer.Replace(tagDB)
+	}
+	return endpointNameReplacer.Replace(u.Host + strings.TrimRight(u.Path, "/"))
+}
+
+func (t *Tags) newEndpoint(e Endpoint) (*endpoint, error) {
+	ep := &endpoint{name: endpointName(e.URL), mode: e.Mode}
+	if ep.mode == "" {
+		ep.mode = EndpointBroadcast
+	}
+
+	u, urlErr := url.Parse(e.URL)
+	if e.URL == LocalTagDB {
+		if t.local == nil {
+			var err error
+			t.local, err = OpenLocalDB(filepath.Join(t.options.LocalPath, "index"))
+			if err != nil {
+				t.logger.Error("can't open local tag index", zap.Error(err))
+				return nil, err
+			}
+		}
+
+		ep.send = func(paths []string) error {
+			_, err := t.local.AddSeries(paths)
+			if err != nil {
+				t.logger.Error("failed to add tags to local index", zap.Error(err))
+			}
+			return err
+		}
+		ep.sendDelete = func(paths []string) error {
+			_, err := t.local.DelSeries(paths)
+			if err != nil {
+				t.logger.Error("failed to delete tags from local index", zap.Error(err))
+			}
+			return err
+		}
+	} else if urlErr != nil {
+		ep.send = func([]string) error {
 			time.Sleep(time.Second)
-			t.logger.Error("bad tag url", zap.String("url", options.TagDB), zap.Error(urlErr))
+			t.logger.Error("bad tag url", zap.String("url", e.URL), zap.Error(urlErr))
 			return urlErr
 		}
+		ep.sendDelete = ep.send
 	} else {
-		u.Path = "/tags/tagMultiSeries"
-		s := u.String()
+		ep.send = t.post(*u, "/tags/tagMultiSeries")
+		ep.sendDelete = t.post(*u, "/tags/delSeries")
+	}
 
-		send = func(paths []string) error {
-			client := &http.Client{Timeout: options.TagDBTimeout}
+	return ep, nil
+}
 
-			resp, err := client.PostForm(s, url.Values{"path": paths})
-			if err != nil {
-				t.logger.Error("failed to post tags", zap.Error(err))
-				return err
+// counted wraps send callback of endpoint with stats. Prometheus counters are
+// read on every call, they are nil until InitPrometheus
+func counted(send func([]string) error, fail, success *uint32, promFail, promSuccess *prometheus.Counter) func([]string) error {
+	return func(paths []string) error {
+		err := send(paths)
+		if err != nil {
+			atomic.AddUint32(fail, uint32(len(paths)))
+			if *promFail != nil {
+				(*promFail).Add(float64(len(paths)))
 			}
-			if resp.StatusCode != http.StatusOK {
-				t.logger.Error("failed to post tags", zap.Int("status-code", resp.StatusCode))
-				return fmt.Errorf("bad status code: %d", resp.StatusCode)
+		} else {
+			atomic.AddUint32(success, uint32(len(paths)))
+			if *promSuccess != nil {
+				(*promSuccess).Add(float64(len(paths)))
 			}
+		}
+		return err
+	}
+}
 
-			ioutil.ReadAll(resp.Body)
-			return nil
+// failover returns callback which tries endpoints in turn until one succeeds
+func failover(send []func([]string) error) func([]string) error {
+	return func(paths []string) error {
+		var err error
+		for _, s := range send {
+			if err = s(paths); err == nil {
+				return nil
+			}
 		}
+		return err
 	}
+}
 
-	t.q, t.qErr = NewQueue(options.LocalPath, send, options.TagDBChunkSize)
-	if options.TagDBUpdateInterval < 1 {
-		options.TagDBUpdateInterval = 1
+// queueReaders returns readers of queue: one per broadcast and shard endpoint and
+// one for all failover endpoints
+func (t *Tags) queueReaders() []QueueReader {
+	var readers []QueueReader
+	var failoverSend, failoverDelete []func([]string) error
+
+	shards := 0
+	for _, ep := range t.endpoints {
+		if ep.mode == EndpointShard {
+			shards++
+		}
 	}
 
-	return t
+	shard := 0
+	for _, ep := range t.endpoints {
+		send := counted(ep.send, &ep.stat.sendFail, &ep.stat.sendSuccess,
+			&ep.prometheus.sendFail, &ep.prometheus.sendSuccess)
+		sendDelete := counted(ep.sendDelete, &ep.stat.sendDeleteFail, &ep.stat.sendDeleteSuccess,
+			&ep.prometheus.sendDeleteFail, &ep.prometheus.sendDeleteSuccess)
+
+		switch ep.mode {
+		case EndpointFailover:
+			ep.reader = EndpointFailover
+			failoverSend = append(failoverSend, send)
+			failoverDelete = append(failoverDelete, sendDelete)
+			continue
+		case EndpointShard:
+			ep.reader = ep.name
+			index := uint32(shard)
+			shard++
+			readers = append(readers, QueueReader{
+				Name:       ep.reader,
+				Send:       send,
+				SendDelete: sendDelete,
+				Filter: func(series string) bool {
+					return fnv32(series)%uint32(shards) == index
+				},
+			})
+		default:
+			ep.reader = ep.name
+			readers = append(readers, QueueReader{Name: ep.reader, Send: send, SendDelete: sendDelete})
+		}
+	}
+
+	if len(failoverSend) > 0 {
+		readers = append(readers, QueueReader{
+			Name:       EndpointFailover,
+			Send:       failover(failoverSend),
+			SendDelete: failover(failoverDelete),
+		})
+	}
+	return readers
+}
+
+func fnv32(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// post returns callback which posts series to TagDB endpoint
+func (t *Tags) post(u url.URL, path string) func([]string) error {
+	u.Path = path
+	s := u.String()
+
+	return func(paths []string) error {
+		client := &http.Client{Timeout: t.options.TagDBTimeout}
+
+		resp, err := client.PostForm(s, url.Values{"path": paths})
+		if err != nil {
+			t.logger.Error("failed to post tags", zap.String("path", path), zap.Error(err))
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.logger.Error("failed to post tags", zap.String("path", path), zap.Int("status-code", resp.StatusCode))
+			return fmt.Errorf("bad status code: %d", resp.StatusCode)
+		}
+
+		ioutil.ReadAll(resp.Body)
+		return nil
+	}
 }
 
 func (t *Tags) Stop() {
-	t.q.Stop()
+	t.unregisterPrometheus()
+	if t.q != nil {
+		t.q.Stop()
+	}
+	if t.local != nil {
+		t.local.Close()
+	}
 }
 
 func (t *Tags) Add(value string, now bool) {
@@ -89,14 +322,47 @@ func (t *Tags) Add(value string, now bool) {
 	}
 }
 
+// Delete removes series from TagDB. Unlike Add it's never skipped by update interval
+func (t *Tags) Delete(value string) {
+	if t.q == nil {
+		t.logger.Error("queue database not initialized", zap.Error(t.qErr))
+		return
+	}
+	t.q.Delete(value)
+}
+
 // Collect metrics
 func (t *Tags) Stat(send helper.StatCallback) {
+	if t.q == nil {
+		return
+	}
+
 	helper.SendAndSubstractUint32("queuePutErrors", &t.q.stat.putErrors, send)
 	helper.SendAndSubstractUint32("queuePutCount", &t.q.stat.putCount, send)
 	helper.SendAndSubstractUint32("queueDeleteErrors", &t.q.stat.deleteErrors, send)
 	helper.SendAndSubstractUint32("queueDeleteCount", &t.q.stat.deleteCount, send)
 	helper.SendAndSubstractUint32("tagdbSendFail", &t.q.stat.sendFail, send)
 	helper.SendAndSubstractUint32("tagdbSendSuccess", &t.q.stat.sendSuccess, send)
+	helper.SendAndSubstractUint32("tagdbDeleteFail", &t.q.stat.sendDeleteFail, send)
+	helper.SendAndSubstractUint32("tagdbDeleteSuccess", &t.q.stat.sendDeleteSuccess, send)
 
 	send("queueLag", t.q.Lag().Seconds())
+
+	for _, ep := range t.endpoints {
+		prefix := "endpoint." + ep.name + "."
+		send(prefix+"queueLag", t.q.ReaderLag(ep.reader).Seconds())
+		helper.SendAndSubstractUint32(prefix+"sendFail", &ep.stat.sendFail, send)
+		helper.SendAndSubstractUint32(prefix+"sendSuccess", &ep.stat.sendSuccess, send)
+		helper.SendAndSubstractUint32(prefix+"deleteFail", &ep.stat.sendDeleteFail, send)
+		helper.SendAndSubstractUint32(prefix+"deleteSuccess", &ep.stat.sendDeleteSuccess, send)
+	}
+
+	if t.local != nil {
+		helper.SendAndSubstractUint32("localAddCount", &t.local.stat.addCount, send)
+		helper.SendAndSubstractUint32("localAddErrors", &t.local.stat.addErrors, send)
+		helper.SendAndSubstractUint32("localDeleteCount", &t.local.stat.deleteCount, send)
+		helper.SendAndSubstractUint32("localDeleteErrors", &t.local.stat.deleteErrors, send)
+		helper.SendAndSubstractUint32("localFindCount", &t.local.stat.findCount, send)
+		helper.SendAndSubstractUint32("localCompactions", &t.local.stat.compactions, send)
+	}
 }
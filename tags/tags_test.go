@@ -0,0 +1,98 @@
+package tags
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+// tagDB is TagDB test server which remembers received series
+type tagDB struct {
+	*httptest.Server
+	sync.Mutex
+	series []string
+	fail   bool
+}
+
+func newTagDB() *tagDB {
+	db := &tagDB{}
+	db.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db.Lock()
+		defer db.Unlock()
+		if db.fail {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		r.ParseForm()
+		db.series = append(db.series, r.Form["path"]...)
+	}))
+	return db
+}
+
+func (db *tagDB) received() []string {
+	db.Lock()
+	defer db.Unlock()
+	res := append([]string{}, db.series...)
+	sort.Strings(res)
+	return res
+}
+
+func TestEndpoints(t *testing.T) {
+	qa.Root(t, func(dir string) {
+		assert := assert.New(t)
+
+		broadcast, primary, secondary, shard1, shard2 := newTagDB(), newTagDB(), newTagDB(), newTagDB(), newTagDB()
+		for _, db := range []*tagDB{broadcast, primary, secondary, shard1, shard2} {
+			defer db.Close()
+		}
+		primary.fail = true
+
+		tags := New(&Options{
+			LocalPath: dir,
+			TagDBEndpoints: []Endpoint{
+				{URL: broadcast.URL},
+				{URL: primary.URL, Mode: EndpointFailover},
+				{URL: secondary.URL, Mode: EndpointFailover},
+				{URL: shard1.URL, Mode: EndpointShard},
+				{URL: shard2.URL, Mode: EndpointShard},
+			},
+			TagDBTimeout:   time.Second,
+			TagDBChunkSize: 1,
+		})
+		defer tags.Stop()
+
+		all := []string{"cpu;host=a", "cpu;host=b", "cpu;host=c", "cpu;host=d"}
+		for _, s := range all {
+			tags.Add(s, true)
+		}
+
+		for i := 0; i < 100 && tags.q.Lag() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		assert.Equal(all, broadcast.received())
+		assert.Equal(all, secondary.received())
+		assert.Empty(primary.received())
+		sharded := append(shard1.received(), shard2.received()...)
+		sort.Strings(sharded)
+		assert.Equal(all, sharded)
+		assert.NotEmpty(shard1.received())
+		assert.NotEmpty(shard2.received())
+
+		stat := make(map[string]float64)
+		tags.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+		primaryName := endpointName(primary.URL)
+		assert.Equal(float64(4), stat["endpoint."+primaryName+".sendFail"])
+		assert.Equal(float64(4), stat["endpoint."+endpointName(secondary.URL)+".sendSuccess"])
+		assert.Equal(float64(0), stat["endpoint."+primaryName+".queueLag"])
+	})
+}